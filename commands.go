@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"bitbucket.org/nnnco/rev-proxy/service"
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+)
+
+// commandList the dry-run subcommands, none of them touches the live nginx
+var commandList = map[string]func(config *shared.Config, args []string) int{
+	"render":   renderCommand,
+	"validate": validateCommand,
+	"diff":     diffCommand,
+	"snapshot": snapshotCommand,
+	"config":   configCommand,
+}
+
+// runCommand returns the exit code of the subcommand
+func runCommand(config *shared.Config, name string, args []string) int {
+
+	command, found := commandList[name]
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command '%v'. Available commands: render, validate, diff, snapshot, config\n", name)
+		return 2
+	}
+
+	return command(config, args)
+}
+
+// dryRunFlags the inputs shared by all the subcommands
+type dryRunFlags struct {
+	snapshotFile string
+	bundleFile   string
+	templateFile string
+
+	// built once per command, the sessions are only created when discovery or S3 needs them
+	metrics     *shared.Metrics
+	awsSessions *util.AWSSessions
+}
+
+func newDryRunFlags(config *shared.Config) *dryRunFlags {
+
+	metrics := shared.NewMetrics(config)
+
+	ret := &dryRunFlags{
+		metrics:     metrics,
+		awsSessions: util.NewAWSSessions(config, metrics),
+	}
+
+	return ret
+}
+
+func parseDryRunFlags(config *shared.Config, name string, args []string) (*dryRunFlags, error) {
+
+	ret := newDryRunFlags(config)
+
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	flagSet.StringVar(&ret.snapshotFile, "snapshot", "", "snapshot file (as returned by /api/snapshot) used instead of discovery")
+	flagSet.StringVar(&ret.bundleFile, "bundle", "", "local config bundle zip used instead of the S3 one")
+	flagSet.StringVar(&ret.templateFile, "template", "", "upstreams template, defaults to the one in the bundle or the config folder")
+
+	if err := flagSet.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// renderCommand prints the rendered upstreams
+func renderCommand(config *shared.Config, args []string) int {
+
+	flags, err := parseDryRunFlags(config, "render", args)
+
+	if err != nil {
+		return 2
+	}
+
+	// the bundle is only needed when it carries the template
+	var bundle []byte
+
+	if flags.bundleFile != "" {
+		if bundle, err = ioutil.ReadFile(flags.bundleFile); err != nil {
+			return fail(err)
+		}
+	}
+
+	rendered, err := renderDryRun(config, flags, bundle)
+
+	if err != nil {
+		return fail(err)
+	}
+
+	fmt.Print(rendered)
+
+	return 0
+}
+
+// validateCommand runs the proxy configuration test (nginx -t, haproxy -c) on the bundle and the rendered upstreams in a temp folder
+func validateCommand(config *shared.Config, args []string) int {
+
+	flags, err := parseDryRunFlags(config, "validate", args)
+
+	if err != nil {
+		return 2
+	}
+
+	tmpFolder, _, err := prepareDryRun(config, flags)
+
+	if tmpFolder != "" {
+		defer os.RemoveAll(tmpFolder)
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	proxy := service.NewProxy(config, flags.metrics, nil)
+
+	output, err := proxy.TestConfigFile(filepath.Join(tmpFolder, config.Nginx.MainConfigFile))
+
+	fmt.Fprint(os.Stderr, output)
+
+	if err != nil {
+		return fail(fmt.Errorf("Proxy configuration test FAILED: %v", err))
+	}
+
+	fmt.Println("Proxy configuration test SUCCESS")
+
+	return 0
+}
+
+// diffCommand shows what would change in the live config folder. Like diff(1) it exits with 1 on changes.
+func diffCommand(config *shared.Config, args []string) int {
+
+	flags, err := parseDryRunFlags(config, "diff", args)
+
+	if err != nil {
+		return 2
+	}
+
+	tmpFolder, fileList, err := prepareDryRun(config, flags)
+
+	if tmpFolder != "" {
+		defer os.RemoveAll(tmpFolder)
+	}
+
+	if err != nil {
+		return fail(err)
+	}
+
+	changed := false
+
+	for _, fileName := range fileList {
+
+		livePath := filepath.Join(config.Nginx.ConfigFolder, fileName)
+
+		// a missing live file shows as fully added
+		liveBytes, _ := ioutil.ReadFile(livePath)
+
+		newBytes, err := ioutil.ReadFile(filepath.Join(tmpFolder, fileName))
+
+		if err != nil {
+			return fail(err)
+		}
+
+		// paths were relocated to the temp folder for the test, we compare against the live ones
+		newText := strings.Replace(string(newBytes), tmpFolder, filepath.Clean(config.Nginx.ConfigFolder), -1)
+
+		if diff := util.LineDiff(livePath, fileName+" (new)", string(liveBytes), newText); diff != "" {
+			fmt.Print(diff)
+			changed = true
+		}
+	}
+
+	if changed {
+		return 1
+	}
+
+	fmt.Println("No changes")
+
+	return 0
+}
+
+// snapshotCommand saves a discovery result to replay it with the file provider or -snapshot
+func snapshotCommand(config *shared.Config, args []string) int {
+
+	var outFile string
+
+	flagSet := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	flagSet.StringVar(&outFile, "out", "", "snapshot file to write, defaults to stdout")
+
+	if err := flagSet.Parse(args); err != nil {
+		return 2
+	}
+
+	descrMap, err := loadServices(config, newDryRunFlags(config))
+
+	if err != nil {
+		return fail(err)
+	}
+
+	snapshotBytes, err := json.MarshalIndent(service.NewClusterSnapshot(config.AWS.ClusterName, descrMap), "", "  ")
+
+	if err != nil {
+		return fail(err)
+	}
+
+	if outFile == "" {
+		fmt.Println(string(snapshotBytes))
+		return 0
+	}
+
+	if err := ioutil.WriteFile(outFile, snapshotBytes, 0644); err != nil {
+		return fail(err)
+	}
+
+	return 0
+}
+
+// configCommand prints the effective config (config print) or checks it (config check)
+func configCommand(config *shared.Config, args []string) int {
+
+	if len(args) != 1 || (args[0] != "print" && args[0] != "check") {
+		fmt.Fprintln(os.Stderr, "Usage: ecs-ingress [flags] config print|check")
+		return 2
+	}
+
+	if args[0] == "print" {
+		for _, value := range config.Values() {
+			fmt.Printf("%v = %v\n", value.Key, value.Value)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return fail(err)
+	}
+
+	if args[0] == "check" {
+		fmt.Println("Config is valid")
+	}
+
+	return 0
+}
+
+// prepareDryRun extracts the bundle and the rendered upstreams into a temp folder, pointing any
+// reference to the live config folder at it. It returns the folder and the files written there.
+func prepareDryRun(config *shared.Config, flags *dryRunFlags) (string, []string, error) {
+
+	bundle, err := loadBundle(config, flags)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmpFolder, err := ioutil.TempDir("", "ecs-ingress-")
+
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to create temp folder: %v", err)
+	}
+
+	extractedList, err := util.UnzipFileFromMemory(bundle, tmpFolder)
+
+	if err != nil {
+		return tmpFolder, nil, fmt.Errorf("Unable to extract bundle: %v", err)
+	}
+
+	rendered, err := renderDryRun(config, flags, bundle)
+
+	if err != nil {
+		return tmpFolder, nil, err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmpFolder, config.Nginx.UpstreamsConfigFile), []byte(rendered), 0644); err != nil {
+		return tmpFolder, nil, err
+	}
+
+	fileList := []string{config.Nginx.UpstreamsConfigFile}
+
+	for _, extractedPath := range extractedList {
+
+		if info, err := os.Stat(extractedPath); err != nil || info.IsDir() {
+			continue
+		}
+
+		relPath, _ := filepath.Rel(tmpFolder, extractedPath)
+
+		if relPath != config.Nginx.UpstreamsConfigFile {
+			fileList = append(fileList, relPath)
+		}
+	}
+
+	sort.Strings(fileList)
+
+	// nginx includes usually use absolute paths
+	liveFolder := filepath.Clean(config.Nginx.ConfigFolder)
+
+	for _, fileName := range fileList {
+
+		filePath := filepath.Join(tmpFolder, fileName)
+		content, err := ioutil.ReadFile(filePath)
+
+		if err != nil {
+			return tmpFolder, nil, err
+		}
+
+		if bytes.Contains(content, []byte(liveFolder)) {
+			content = bytes.Replace(content, []byte(liveFolder), []byte(tmpFolder), -1)
+
+			if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+				return tmpFolder, nil, err
+			}
+		}
+	}
+
+	if !util.FileExists(filepath.Join(tmpFolder, config.Nginx.MainConfigFile)) {
+		return tmpFolder, nil, fmt.Errorf("Nginx config file '%v' NOT found in the bundle", config.Nginx.MainConfigFile)
+	}
+
+	return tmpFolder, fileList, nil
+}
+
+// renderDryRun renders the upstreams from the snapshot or a fresh discovery
+func renderDryRun(config *shared.Config, flags *dryRunFlags, bundle []byte) (string, error) {
+
+	descrMap, err := loadServices(config, flags)
+
+	if err != nil {
+		return "", err
+	}
+
+	templatePath := flags.templateFile
+
+	if templatePath == "" {
+
+		templatePath = filepath.Join(config.Nginx.ConfigFolder, config.Nginx.UpstreamsTemplateFile)
+
+		// a bundle may carry its own template
+		if bundle != nil {
+
+			tmpFolder, err := ioutil.TempDir("", "ecs-ingress-")
+
+			if err != nil {
+				return "", err
+			}
+
+			defer os.RemoveAll(tmpFolder)
+
+			if _, err := util.UnzipFileFromMemory(bundle, tmpFolder); err != nil {
+				return "", fmt.Errorf("Unable to extract bundle: %v", err)
+			}
+
+			if bundleTemplatePath := filepath.Join(tmpFolder, config.Nginx.UpstreamsTemplateFile); util.FileExists(bundleTemplatePath) {
+				templatePath = bundleTemplatePath
+			}
+		}
+	}
+
+	// no instance metadata here, the zone preference is previewed with -discovery.localzone
+	templateBuffer, err := service.RenderUpstreams(templatePath, descrMap, service.UpstreamOptions{
+		LocalZone:      config.Discovery.LocalZone,
+		ZoneMinHealthy: config.Discovery.ZoneMinHealthy,
+		AddressFamily:  config.Discovery.AddressFamily,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return templateBuffer.String(), nil
+}
+
+func loadServices(config *shared.Config, flags *dryRunFlags) (map[string]service.EcsServiceDescr, error) {
+
+	if flags.snapshotFile != "" {
+
+		snapshot, err := service.LoadClusterSnapshot(flags.snapshotFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return snapshot.Services, nil
+	}
+
+	discovery, err := service.NewDiscovery(config, service.NewEcsService(config, flags.awsSessions))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return discovery.GetServicesAndPorts(config.AWS.ClusterName)
+}
+
+func loadBundle(config *shared.Config, flags *dryRunFlags) ([]byte, error) {
+
+	if flags.bundleFile != "" {
+		return ioutil.ReadFile(flags.bundleFile)
+	}
+
+	if config.Nginx.ConfigBundleFile != "" {
+		return ioutil.ReadFile(config.Nginx.ConfigBundleFile)
+	}
+
+	bundle, err := util.NewS3Client(config, flags.awsSessions.Bundle()).DownloadFileInMemory(config.Nginx.ConfigBundleS3Bucket, config.Nginx.ConfigBundleS3Key)
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download NGINX config bundle: %v", err)
+	}
+
+	return bundle, nil
+}
+
+func fail(err error) int {
+	fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	return 1
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+)
+
+const (
+	testSnapshotFile  = "service/testdata/cluster-snapshot.json"
+	testGoldenRender  = "service/testdata/cluster-snapshot.upstreams.conf"
+	testTemplateFile  = "data/upstreams.conf.tmpl"
+	testMainConfig    = "http { include %v/upstreams.conf; }\n"
+	testChangedServer = "server 10.0.99.99:1;"
+)
+
+// newTestCommandConfig returns a config rendering the golden snapshot, with a live config folder and a bundle
+func newTestCommandConfig(t *testing.T) (*shared.Config, []string) {
+
+	config := &shared.Config{}
+	config.AWS.ClusterName = "prod"
+	config.Nginx.ConfigFolder = t.TempDir()
+	config.Nginx.UpstreamsTemplateFile = "upstreams.conf.tmpl"
+	config.Nginx.UpstreamsConfigFile = "upstreams.conf"
+	config.Nginx.MainConfigFile = "nginx.conf"
+	config.Discovery.LocalZone = "ap-southeast-2a"
+	config.Discovery.ZoneMinHealthy = 1
+	config.Discovery.AddressFamily = "ipv4"
+
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	writer, _ := zipWriter.Create("nginx.conf")
+	writer.Write([]byte(strings.Replace(testMainConfig, "%v", config.Nginx.ConfigFolder, 1)))
+
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bundleFile := filepath.Join(t.TempDir(), "bundle.zip")
+
+	if err := ioutil.WriteFile(bundleFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return config, []string{"-snapshot", testSnapshotFile, "-bundle", bundleFile, "-template", testTemplateFile}
+}
+
+// captureStdout returns what run prints, and its exit code
+func captureStdout(t *testing.T, run func() int) (string, int) {
+
+	reader, writer, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	code := run()
+
+	os.Stdout = stdout
+	writer.Close()
+
+	output, _ := ioutil.ReadAll(reader)
+
+	return string(output), code
+}
+
+func TestRenderCommand(t *testing.T) {
+
+	config, args := newTestCommandConfig(t)
+
+	expected, err := ioutil.ReadFile(testGoldenRender)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, code := captureStdout(t, func() int { return renderCommand(config, args) })
+
+	if code != 0 || output != string(expected) {
+		t.Errorf("expected the golden upstreams, got %v:\n%v", code, output)
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+
+	config, args := newTestCommandConfig(t)
+
+	golden, err := ioutil.ReadFile(testGoldenRender)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the live folder runs the same nginx.conf, and upstreams with one server too many
+	livePath := filepath.Join(config.Nginx.ConfigFolder, "upstreams.conf")
+	liveUpstreams := strings.Replace(string(golden), "upstream web {\n", "upstream web {\n    "+testChangedServer+"\n", 1)
+
+	if liveUpstreams == string(golden) {
+		t.Fatal("no web upstream in the golden file")
+	}
+
+	ioutil.WriteFile(livePath, []byte(liveUpstreams), 0644)
+	ioutil.WriteFile(filepath.Join(config.Nginx.ConfigFolder, "nginx.conf"), []byte(strings.Replace(testMainConfig, "%v", config.Nginx.ConfigFolder, 1)), 0644)
+
+	output, code := captureStdout(t, func() int { return diffCommand(config, args) })
+
+	for _, expected := range []string{"--- " + livePath + "\n", "+++ upstreams.conf (new)\n", "\n-    " + testChangedServer + "\n"} {
+		if code != 1 || !strings.Contains(output, expected) {
+			t.Errorf("expected '%v' in the diff, got %v:\n%v", expected, code, output)
+		}
+	}
+
+	// paths relocated for the test don't show up as changes, and nothing is added: the only "+" line is the header
+	if strings.Contains(output, "nginx.conf") || strings.Count(output, "\n+") != 1 {
+		t.Errorf("unexpected changes:\n%v", output)
+	}
+
+	// nothing left to apply
+	ioutil.WriteFile(livePath, golden, 0644)
+
+	if output, code := captureStdout(t, func() int { return diffCommand(config, args) }); code != 0 || output != "No changes\n" {
+		t.Errorf("expected no changes, got %v:\n%v", code, output)
+	}
+}
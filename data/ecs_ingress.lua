@@ -0,0 +1,149 @@
+-- ecs_ingress balances the upstreams of the openresty apply strategy. The controller writes the server lists to
+-- upstreams.json before every reload, and pushes them to handle() when only the servers changed.
+--
+--   lua_shared_dict ecs_ingress 10m;
+--   init_by_lua_block { require("ecs_ingress").init("/app/nginx/upstreams.json") }
+--
+--   server {
+--     listen 127.0.0.1:8082;
+--     location = /upstreams { content_by_lua_block { require("ecs_ingress").handle() } }
+--   }
+
+local balancer = require("ngx.balancer")
+local cjson = require("cjson.safe")
+
+local _M = {}
+
+local dict = ngx.shared.ecs_ingress
+
+-- the decoded server lists of this worker, by upstream
+local cache = {}
+
+-- set replaces every upstream at once, removing the upstreams that are gone
+function _M.set(body)
+  local upstreams = cjson.decode(body)
+
+  if type(upstreams) ~= "table" then
+    return nil, "invalid server lists"
+  end
+
+  local version = (dict:get("version") or 0) + 1
+
+  for name, servers in pairs(upstreams) do
+    local ok, err = dict:set("upstream:" .. name, cjson.encode(servers))
+
+    if not ok then
+      return nil, err
+    end
+  end
+
+  for _, key in ipairs(dict:get_keys(0)) do
+    local name = key:match("^upstream:(.*)$")
+
+    if name and upstreams[name] == nil then
+      dict:delete(key)
+    end
+  end
+
+  dict:set("version", version)
+
+  return true
+end
+
+-- init loads the server lists written by the controller, when nginx starts or reloads
+function _M.init(path)
+  local file = io.open(path, "r")
+
+  if not file then
+    return
+  end
+
+  local body = file:read("*a")
+  file:close()
+
+  local ok, err = _M.set(body)
+
+  if not ok then
+    ngx.log(ngx.ERR, "ecs_ingress: unable to load ", path, ": ", err)
+  end
+end
+
+-- handle the endpoint the controller pushes the server lists to
+function _M.handle()
+  if ngx.req.get_method() ~= "POST" then
+    return ngx.exit(ngx.HTTP_NOT_ALLOWED)
+  end
+
+  ngx.req.read_body()
+
+  local ok, err = _M.set(ngx.req.get_body_data())
+
+  if not ok then
+    ngx.status = ngx.HTTP_BAD_REQUEST
+    ngx.say(err)
+    return ngx.exit(ngx.HTTP_BAD_REQUEST)
+  end
+
+  ngx.say("ok")
+end
+
+local function servers(name)
+  local version = dict:get("version")
+  local entry = cache[name]
+
+  if entry and entry.version == version then
+    return entry.servers
+  end
+
+  local list = cjson.decode(dict:get("upstream:" .. name) or "[]") or {}
+
+  cache[name] = { version = version, servers = list }
+
+  return list
+end
+
+local function pick(list, backup)
+  local total = 0
+
+  for _, server in ipairs(list) do
+    if not server.Down and server.Backup == backup then
+      total = total + math.max(server.Weight or 1, 1)
+    end
+  end
+
+  if total == 0 then
+    return nil
+  end
+
+  local point = math.random() * total
+
+  for _, server in ipairs(list) do
+    if not server.Down and server.Backup == backup then
+      point = point - math.max(server.Weight or 1, 1)
+
+      if point <= 0 then
+        return server
+      end
+    end
+  end
+end
+
+-- balance picks a server of the upstream by weight, the backup servers only when no other is up
+function _M.balance(name)
+  local list = servers(name)
+  local server = pick(list, false) or pick(list, true)
+
+  if not server then
+    ngx.log(ngx.ERR, "ecs_ingress: no server available for ", name)
+    return ngx.exit(ngx.HTTP_BAD_GATEWAY)
+  end
+
+  local ok, err = balancer.set_current_peer(server.Address, server.Port)
+
+  if not ok then
+    ngx.log(ngx.ERR, "ecs_ingress: unable to set the peer of ", name, ": ", err)
+    return ngx.exit(ngx.HTTP_INTERNAL_SERVER_ERROR)
+  end
+end
+
+return _M
@@ -4,18 +4,18 @@ go 1.15
 
 require (
 	github.com/aws/aws-sdk-go v1.36.8
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/hashicorp/memberlist v0.5.0
 	github.com/magiconair/properties v1.8.4 // indirect
 	github.com/mitchellh/mapstructure v1.4.1 // indirect
 	github.com/pelletier/go-toml v1.8.1 // indirect
+	github.com/prometheus/client_golang v1.19.1
 	github.com/rs/zerolog v1.20.0
-	github.com/spf13/afero v1.5.1 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.7.1
-	golang.org/x/sys v0.0.0-20210113000019-eaf3bda374d2 // indirect
-	golang.org/x/text v0.3.5 // indirect
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.21.0
 	gopkg.in/ini.v1 v1.62.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"bitbucket.org/nnnco/rev-proxy/service"
 	"bitbucket.org/nnnco/rev-proxy/shared"
@@ -28,32 +32,162 @@ func main() {
 	zerolog.MessageFieldName = "m"
 	zerolog.TimeFieldFormat = ""
 
-	config, _ := shared.NewConfig()
-	ecsService := service.NewEcsService(config)
+	// subcommands keep stdout for their own output
+	log.Logger = log.Logger.Output(os.Stderr)
 
-	nginxMonitor := service.NewNginxMonitor(config)
-	s3Client := util.NewS3Client(config)
+	config, args, err := shared.NewConfig(os.Args[1:])
 
-	revProxyService := service.NewRevProxyService(config, ecsService, nginxMonitor, s3Client)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to load config")
+	}
+
+	if len(args) > 0 {
+		os.Exit(runCommand(config, args[0], args[1:]))
+	}
+
+	log.Logger = log.Logger.Output(os.Stdout)
+
+	// we rather not start than run with a broken config
+	if err := config.Validate(); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+
+	config.Log()
+
+	metrics := shared.NewMetrics(config)
+	configReloader := shared.NewConfigReloader(config, metrics)
+	awsSessions := util.NewAWSSessions(config, metrics)
+	ecsService := service.NewEcsService(config, awsSessions)
+	gossipService := service.NewGossipService(config, ecsService)
+
+	discovery, err := service.NewDiscovery(config, ecsService)
+
+	if err != nil {
+		panic(err.Error())
+	}
+
+	notifier := service.NewNotifier(config, gossipService)
+
+	proxy := service.NewProxy(config, metrics, notifier)
+
+	// the pushes fail and every change reloads, we keep going
+	if err := service.CheckApplyStrategy(config); err != nil {
+		log.Error().Err(err).Msg("Dynamic upstreams UNAVAILABLE")
+	}
+	s3Client := util.NewS3Client(config, awsSessions.Default())
+	bundleS3Client := util.NewS3Client(config, awsSessions.Bundle())
+
+	route53Client := util.NewRoute53Client(config, awsSessions.Default())
+
+	stateStore := service.NewStateStore(config, s3Client, gossipService)
+	healthChecker := service.NewHealthChecker(config, metrics)
+	revProxyService := service.NewRevProxyService(config, discovery, proxy, bundleS3Client, metrics, notifier, gossipService, stateStore, configReloader, healthChecker)
+	// servers in the other zones become backups
+	if config.Discovery.ZoneMinHealthy > 0 {
+
+		localZone := config.Discovery.LocalZone
+
+		if localZone == "" {
+			if localZone, err = util.LocalAvailabilityZone(config, awsSessions.Default()); err != nil {
+				log.Error().Err(err).Msg("Zone-local preference DISABLED")
+			}
+		}
+
+		if localZone != "" {
+			log.Info().Msgf("Preferring servers in availability zone '%v'", localZone)
+			revProxyService.SetLocalZone(localZone)
+		}
+	}
+
+	acmeService := service.NewAcmeService(config, s3Client, route53Client, revProxyService, gossipService)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
+	// we coordinate with the other daemons in the cluster
+	if gossipService.Enabled() {
+		if err := gossipService.Start(); err != nil {
+			panic(err.Error())
+		}
+	}
+
+	// we send notifications in the background. Targets can be added by a config reload
+	go notifier.Start()
+
+	// we apply the live settings when the config file changes
+	configReloader.Start()
+
+	// we probe the endpoints ourselves, failing ones are rendered down
+	go healthChecker.Start()
+
+	// we expose metrics and health checks (not ready until the first config is applied)
+	if config.Admin.ListenAddress != "" {
+
+		adminServer := service.NewAdminServer(config, metrics, revProxyService, proxy)
+
+		// nginx proxies the HTTP-01 challenges to us
+		if len(config.Acme.Hostnames) > 0 {
+			adminServer.Handle("/.well-known/acme-challenge/", acmeService)
+		}
+
+		go adminServer.Start()
+	}
+
+	// certificates must be on disk before nginx tests its configuration
+	if len(config.Acme.Hostnames) > 0 {
+		acmeService.Prepare()
+	}
+
 	// we generate the first configuration
-	err := revProxyService.QueryAndUpdate(true)
+	err = revProxyService.QueryAndUpdate(true)
 
 	if err != nil {
-		panic(err.Error())
+
+		log.Error().Err(err).Msg("First ECS configuration FAILED. Trying the last known good state")
+
+		// we rather serve a slightly outdated config than nothing during an AWS outage
+		if restoreErr := revProxyService.RestoreLastKnownGood(); restoreErr != nil {
+			panic(fmt.Sprintf("%v - unable to restore last known good state: %v", err.Error(), restoreErr))
+		}
+
+		log.Warn().Msg("Last known good state restored. Serving while retrying in the background")
+
+	} else {
+		log.Info().Msg("First ECS configuration loaded successfully")
+	}
+
+	// we aggregate the nginx access logs
+	if config.AccessLog.Listen != "" {
+		go service.NewAccessLogService(config, metrics).Start()
+	}
+
+	// we keep DNS pointing at the instances running the ingress
+	if config.Route53.HostedZoneID != "" {
+		go service.NewRoute53Service(config, ecsService, route53Client, gossipService).Start()
 	}
 
-	log.Info().Msg("First ECS configuration loaded successfully")
+	// we issue and renew certificates
+	if len(config.Acme.Hostnames) > 0 {
+		go acmeService.Start()
+	}
+
+	// we start the proxy
+	go proxy.Start(&wg)
 
-	// we start NGINX
-	go nginxMonitor.Start(&wg)
+	// the proxy finishes its connections on shutdown
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		<-signals
+		proxy.Stop()
+	}()
 
 	// we start our updating service
 	go revProxyService.Start()
 
-	// we wait until the nginx monitor dies
+	// we wait until the proxy monitor dies
 	wg.Wait()
+
+	// the nginx_restarted event must leave before we do
+	notifier.Flush(10 * time.Second)
 }
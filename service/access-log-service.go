@@ -0,0 +1,218 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/rs/zerolog/log"
+)
+
+// AccessLogEntry the fields we expect from the nginx JSON log_format
+type AccessLogEntry struct {
+	Upstream    string `json:"upstream"`
+	Status      string `json:"status"`
+	RequestTime string `json:"request_time"`
+	BytesSent   string `json:"bytes_sent"`
+}
+
+// AccessLogService reads nginx access logs and aggregates them per upstream
+type AccessLogService struct {
+	cfg     *shared.Config
+	metrics *shared.Metrics
+}
+
+// NewAccessLogService Creates a new access log service
+func NewAccessLogService(cfg *shared.Config, metrics *shared.Metrics) *AccessLogService {
+
+	ret := &AccessLogService{
+		cfg:     cfg,
+		metrics: metrics,
+	}
+
+	return ret
+}
+
+// Start opens the configured source and consumes it until it fails
+func (a *AccessLogService) Start() {
+
+	source := a.cfg.AccessLog.Listen
+
+	log.Info().Msgf("Access log service START on '%v'", source)
+
+	var err error
+
+	switch {
+	case strings.HasPrefix(source, "unix:"):
+		err = a.listenDatagram("unixgram", strings.TrimPrefix(source, "unix:"))
+	case strings.HasPrefix(source, "udp:"):
+		err = a.listenDatagram("udp", strings.TrimPrefix(source, "udp:"))
+	case strings.HasPrefix(source, "fifo:"):
+		err = a.readFifo(strings.TrimPrefix(source, "fifo:"))
+	default:
+		err = fmt.Errorf("Unsupported access log source '%v'", source)
+	}
+
+	log.Error().Err(err).Msg("Access log service STOPPED")
+}
+
+// listenDatagram receives one syslog message per datagram
+func (a *AccessLogService) listenDatagram(network string, address string) error {
+
+	if network == "unixgram" {
+		// a stale socket from a previous run would prevent us from binding
+		os.Remove(address)
+	}
+
+	conn, err := net.ListenPacket(network, address)
+
+	if err != nil {
+		return fmt.Errorf("Unable to listen on %v %v: %v", network, address, err)
+	}
+
+	defer conn.Close()
+
+	if network == "unixgram" {
+		// nginx workers run as an unprivileged user
+		os.Chmod(address, 0666)
+	}
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+
+		if err != nil {
+			return fmt.Errorf("Unable to read from %v %v: %v", network, address, err)
+		}
+
+		a.HandleLine(buf[:n])
+	}
+}
+
+// readFifo creates a named pipe nginx can write to and reads it line by line
+func (a *AccessLogService) readFifo(path string) error {
+
+	if !fileIsFifo(path) {
+		os.Remove(path)
+
+		if err := syscall.Mkfifo(path, 0666); err != nil {
+			return fmt.Errorf("Unable to create fifo '%v': %v", path, err)
+		}
+	}
+
+	for {
+		// opening blocks until a writer shows up, and we get EOF every time
+		// nginx reopens its logs so we simply start over
+		f, err := os.Open(path)
+
+		if err != nil {
+			return fmt.Errorf("Unable to open fifo '%v': %v", path, err)
+		}
+
+		reader := bufio.NewReader(f)
+
+		for {
+			line, err := reader.ReadBytes('\n')
+
+			if len(line) > 0 {
+				a.HandleLine(line)
+			}
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("Unable to read fifo '%v': %v", path, err)
+			}
+		}
+
+		f.Close()
+	}
+}
+
+// HandleLine parses a single log line (optionally syslog framed) and updates the metrics
+func (a *AccessLogService) HandleLine(line []byte) {
+
+	entry, err := ParseAccessLogLine(line)
+
+	if err != nil {
+		a.metrics.AccessLogLines.WithLabelValues("invalid").Inc()
+		log.Debug().Err(err).Msg("Discarding access log line")
+		return
+	}
+
+	// requests nginx answered by itself
+	if entry.Upstream == "" {
+		a.metrics.AccessLogLines.WithLabelValues("no_upstream").Inc()
+		return
+	}
+
+	a.metrics.AccessLogLines.WithLabelValues("parsed").Inc()
+
+	a.metrics.UpstreamRequests.WithLabelValues(entry.Upstream, statusClass(entry.Status)).Inc()
+
+	if requestTime, err := strconv.ParseFloat(entry.RequestTime, 64); err == nil {
+		a.metrics.UpstreamRequestDuration.WithLabelValues(entry.Upstream).Observe(requestTime)
+	}
+
+	if bytesSent, err := strconv.ParseFloat(entry.BytesSent, 64); err == nil {
+		a.metrics.UpstreamBytesSent.WithLabelValues(entry.Upstream).Add(bytesSent)
+	}
+}
+
+// ParseAccessLogLine extracts the JSON payload from a log line, skipping any syslog header
+func ParseAccessLogLine(line []byte) (*AccessLogEntry, error) {
+
+	start := bytes.IndexByte(line, '{')
+
+	if start < 0 {
+		return nil, fmt.Errorf("No JSON payload found")
+	}
+
+	entry := &AccessLogEntry{}
+
+	if err := json.Unmarshal(bytes.TrimSpace(line[start:]), entry); err != nil {
+		return nil, fmt.Errorf("Invalid JSON payload: %v", err)
+	}
+
+	// nginx logs "-" for the variables without a value, e.g. when no upstream was involved
+	for _, field := range []*string{&entry.Upstream, &entry.Status, &entry.RequestTime, &entry.BytesSent} {
+		if *field == "-" {
+			*field = ""
+		}
+	}
+
+	return entry, nil
+}
+
+// statusClass returns 1xx to 5xx, unknown for anything else
+func statusClass(status string) string {
+
+	if code, err := strconv.Atoi(status); err != nil || code < 100 || code > 599 {
+		return "unknown"
+	}
+
+	return status[:1] + "xx"
+}
+
+func fileIsFifo(path string) bool {
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeNamedPipe != 0
+}
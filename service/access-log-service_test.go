@@ -0,0 +1,78 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestParseAccessLogLine(t *testing.T) {
+
+	testList := []struct {
+		name     string
+		line     string
+		expected *AccessLogEntry
+	}{
+		{
+			name:     "syslog framed",
+			line:     `<190>Oct 19 10:00:00 ingress nginx: {"upstream":"web","status":"200","request_time":"0.012","bytes_sent":"512"}`,
+			expected: &AccessLogEntry{Upstream: "web", Status: "200", RequestTime: "0.012", BytesSent: "512"},
+		},
+		{
+			name:     "quoted request with spaces",
+			line:     `{"request":"GET /search?q=a b \"c\" HTTP/1.1","upstream":"api","status":"404","request_time":"0.001","bytes_sent":"10"}`,
+			expected: &AccessLogEntry{Upstream: "api", Status: "404", RequestTime: "0.001", BytesSent: "10"},
+		},
+		{
+			name:     "no upstream",
+			line:     `{"upstream":"-","status":"301","request_time":"0.000","bytes_sent":"-"}`,
+			expected: &AccessLogEntry{Status: "301", RequestTime: "0.000"},
+		},
+		{
+			name: "malformed",
+			line: `{"upstream":"web","status":`,
+		},
+		{
+			name: "plain text",
+			line: `127.0.0.1 - - [19/Oct/2026:10:00:00 +0000] "GET / HTTP/1.1" 200 612`,
+		},
+	}
+
+	for _, test := range testList {
+
+		entry, err := ParseAccessLogLine([]byte(test.line))
+
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %+v", test.name, entry)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+			continue
+		}
+
+		if *entry != *test.expected {
+			t.Errorf("%v: expected %+v, got %+v", test.name, test.expected, entry)
+		}
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+
+	for status, expected := range map[string]string{
+		"101": "1xx",
+		"200": "2xx",
+		"304": "3xx",
+		"429": "4xx",
+		"503": "5xx",
+		"":    "unknown",
+		"99":  "unknown",
+		"600": "unknown",
+		"2xx": "unknown",
+	} {
+		if class := statusClass(status); class != expected {
+			t.Errorf("%v: expected %v, got %v", status, expected, class)
+		}
+	}
+}
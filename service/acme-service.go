@@ -0,0 +1,624 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+)
+
+// acme challenge types
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+const (
+	acmeChallengePathPrefix = "/.well-known/acme-challenge/"
+	acmeStartDelay          = 10 * time.Second
+	acmeRetryInterval       = 10 * time.Minute
+)
+
+// acmeTokenRegexp ACME tokens are base64url encoded, without padding, of at least 128 bits (RFC 8555 8.1)
+var acmeTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{22,128}$`)
+
+// AcmeService issues and renews certificates, sharing them across hosts through S3
+type AcmeService struct {
+	cfg             *shared.Config
+	s3Client        util.S3API
+	route53Client   util.Route53API
+	revProxyService *RevProxyService
+	gossipService   *GossipService
+
+	lock       sync.RWMutex
+	challenges map[string]string
+}
+
+// NewAcmeService Creates a new acme service
+func NewAcmeService(cfg *shared.Config, s3Client util.S3API, route53Client util.Route53API, revProxyService *RevProxyService, gossipService *GossipService) *AcmeService {
+
+	ret := &AcmeService{
+		cfg:             cfg,
+		s3Client:        s3Client,
+		route53Client:   route53Client,
+		revProxyService: revProxyService,
+		gossipService:   gossipService,
+		challenges:      make(map[string]string),
+	}
+
+	return ret
+}
+
+// Prepare makes sure every hostname has a certificate on disk before nginx is first tested.
+// Certificates are taken from S3 when available, otherwise a short lived self-signed one is
+// written so that nginx can start and serve the HTTP-01 challenges.
+func (a *AcmeService) Prepare() {
+
+	for _, hostname := range a.cfg.Acme.Hostnames {
+
+		if _, err := a.syncFromS3(hostname); err != nil {
+			log.Error().Err(err).Msgf("Unable to fetch the certificate for '%v' from S3", hostname)
+		}
+
+		if util.FileExists(a.localCertPath(hostname)) {
+			continue
+		}
+
+		log.Warn().Msgf("No certificate for '%v' yet. Writing a temporary self-signed one", hostname)
+
+		if err := a.writeSelfSigned(hostname); err != nil {
+			log.Error().Err(err).Msgf("Unable to write a self-signed certificate for '%v'", hostname)
+		}
+	}
+}
+
+// Start checks the certificates forever
+func (a *AcmeService) Start() {
+
+	log.Info().Msgf("ACME service START for %v", a.cfg.Acme.Hostnames)
+
+	// nginx needs to be up to serve the HTTP-01 challenges
+	time.Sleep(acmeStartDelay)
+
+	for {
+
+		if err := a.RenewAll(); err != nil {
+			log.Error().Err(err).Msg("Certificate renewal failed")
+			time.Sleep(acmeRetryInterval)
+			continue
+		}
+
+		time.Sleep(a.cfg.Current().Acme.CheckInterval)
+	}
+}
+
+// RenewAll renews the certificates close to their expiry and reloads nginx if any changed
+func (a *AcmeService) RenewAll() error {
+
+	changed := false
+	errorList := make([]string, 0)
+
+	for _, hostname := range a.cfg.Acme.Hostnames {
+
+		// another host may have renewed it already
+		fromS3, err := a.syncFromS3(hostname)
+
+		if err != nil {
+			errorList = append(errorList, fmt.Sprintf("%v: %v", hostname, err))
+			continue
+		}
+
+		changed = changed || fromS3
+
+		// followers wait for the leader's certificate to show up in S3
+		if !a.needsRenewal(hostname, time.Now()) || !a.gossipService.IsLeader() {
+			continue
+		}
+
+		log.Info().Msgf("Issuing a new certificate for '%v'", hostname)
+
+		if err := a.issue(hostname); err != nil {
+			errorList = append(errorList, fmt.Sprintf("%v: %v", hostname, err))
+			continue
+		}
+
+		changed = true
+	}
+
+	if changed {
+		if err := a.revProxyService.TestAndReload(); err != nil {
+			errorList = append(errorList, err.Error())
+		}
+	}
+
+	if len(errorList) > 0 {
+		return fmt.Errorf("%v", strings.Join(errorList, "; "))
+	}
+
+	return nil
+}
+
+// ServeHTTP answers the HTTP-01 challenges. nginx proxies /.well-known/acme-challenge/ to us.
+func (a *AcmeService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	token := strings.TrimPrefix(req.URL.Path, acmeChallengePathPrefix)
+
+	// anyone can ask, only tokens looking genuine are worth an S3 lookup
+	if !acmeTokenRegexp.MatchString(token) {
+		http.NotFound(w, req)
+		return
+	}
+
+	a.lock.RLock()
+	keyAuth, found := a.challenges[token]
+	a.lock.RUnlock()
+
+	// the challenge may have been started by another host
+	if !found {
+		object, err := a.s3Client.DownloadObjectInMemory(a.bucket(), a.s3Key("challenges", token), "")
+
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+
+		keyAuth = string(object.Bytes)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, keyAuth)
+}
+
+// issue runs a full ACME order for a hostname and stores the result in S3 and on disk
+func (a *AcmeService) issue(hostname string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	client, err := a.newClient(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(hostname))
+
+	if err != nil {
+		return fmt.Errorf("Unable to create order: %v", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+
+	if err != nil {
+		return fmt.Errorf("Order failed: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname},
+		DNSNames: []string{hostname},
+	}, certKey)
+
+	if err != nil {
+		return err
+	}
+
+	derList, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+
+	if err != nil {
+		return fmt.Errorf("Unable to finalize order: %v", err)
+	}
+
+	chainPEM := make([]byte, 0)
+
+	for _, der := range derList {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyPEM, err := encodeECKey(certKey)
+
+	if err != nil {
+		return err
+	}
+
+	// S3 first so that the other hosts pick it up
+	if err := a.s3Client.UploadFileFromMemory(a.bucket(), a.s3Key("certs", hostname, "fullchain.pem"), chainPEM); err != nil {
+		return fmt.Errorf("Unable to upload certificate: %v", err)
+	}
+
+	if err := a.s3Client.UploadFileFromMemory(a.bucket(), a.s3Key("certs", hostname, "privkey.pem"), keyPEM); err != nil {
+		return fmt.Errorf("Unable to upload private key: %v", err)
+	}
+
+	log.Info().Msgf("Certificate for '%v' issued", hostname)
+
+	return a.writeLocal(hostname, chainPEM, keyPEM)
+}
+
+// authorize fulfills a single authorization with the configured challenge type
+func (a *AcmeService) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+
+	authz, err := client.GetAuthorization(ctx, authzURL)
+
+	if err != nil {
+		return fmt.Errorf("Unable to get authorization: %v", err)
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+
+	for _, tmpChallenge := range authz.Challenges {
+		if tmpChallenge.Type == a.cfg.Acme.Challenge {
+			challenge = tmpChallenge
+		}
+	}
+
+	if challenge == nil {
+		return fmt.Errorf("No %v challenge offered for '%v'", a.cfg.Acme.Challenge, authz.Identifier.Value)
+	}
+
+	cleanup, err := a.presentChallenge(client, authz.Identifier.Value, challenge)
+
+	defer cleanup()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("Unable to accept challenge: %v", err)
+	}
+
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("Authorization for '%v' failed: %v", authz.Identifier.Value, err)
+	}
+
+	return nil
+}
+
+// presentChallenge publishes the challenge response and returns how to remove it
+func (a *AcmeService) presentChallenge(client *acme.Client, hostname string, challenge *acme.Challenge) (func(), error) {
+
+	if a.cfg.Acme.Challenge == ChallengeDNS01 {
+
+		value, err := client.DNS01ChallengeRecord(challenge.Token)
+
+		if err != nil {
+			return func() {}, err
+		}
+
+		record := util.Route53Record{
+			Name:   fmt.Sprintf("_acme-challenge.%v.", strings.TrimSuffix(hostname, ".")),
+			Type:   "TXT",
+			TTL:    60,
+			Values: []string{fmt.Sprintf("%q", value)},
+		}
+
+		cleanup := func() {
+			if err := a.route53Client.ChangeRecords(a.cfg.Acme.HostedZoneID, nil, []util.Route53Record{record}); err != nil {
+				log.Warn().Err(err).Msgf("Unable to remove %v", record.Name)
+			}
+		}
+
+		if err := a.route53Client.ChangeRecords(a.cfg.Acme.HostedZoneID, []util.Route53Record{record}, nil); err != nil {
+			return func() {}, fmt.Errorf("Unable to create %v: %v", record.Name, err)
+		}
+
+		// we give route53 time to reach its name servers
+		time.Sleep(a.cfg.Acme.DNSPropagationDelay)
+
+		return cleanup, nil
+	}
+
+	keyAuth, err := client.HTTP01ChallengeResponse(challenge.Token)
+
+	if err != nil {
+		return func() {}, err
+	}
+
+	a.lock.Lock()
+	a.challenges[challenge.Token] = keyAuth
+	a.lock.Unlock()
+
+	challengeKey := a.s3Key("challenges", challenge.Token)
+
+	cleanup := func() {
+		a.lock.Lock()
+		delete(a.challenges, challenge.Token)
+		a.lock.Unlock()
+
+		if err := a.s3Client.DeleteObject(a.bucket(), challengeKey); err != nil {
+			log.Warn().Err(err).Msgf("Unable to remove s3://%v/%v", a.bucket(), challengeKey)
+		}
+	}
+
+	// the validation request can land on any host behind the DNS record
+	if err := a.s3Client.UploadFileFromMemory(a.bucket(), challengeKey, []byte(keyAuth)); err != nil {
+		return cleanup, fmt.Errorf("Unable to share challenge through S3: %v", err)
+	}
+
+	return cleanup, nil
+}
+
+// newClient loads (or creates) the shared account key and registers the account
+func (a *AcmeService) newClient(ctx context.Context) (*acme.Client, error) {
+
+	accountKey, err := a.loadAccountKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+
+	if a.cfg.Acme.InsecureSkipVerify {
+		// only meant for test servers like pebble
+		httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: a.cfg.Acme.DirectoryURL,
+		HTTPClient:   httpClient,
+	}
+
+	account := &acme.Account{}
+
+	if a.cfg.Acme.Email != "" {
+		account.Contact = []string{"mailto:" + a.cfg.Acme.Email}
+	}
+
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("Unable to register ACME account: %v", err)
+	}
+
+	return client, nil
+}
+
+func (a *AcmeService) loadAccountKey() (crypto.Signer, error) {
+
+	accountKeyPath := a.s3Key("account.key")
+
+	object, err := a.s3Client.DownloadObjectInMemory(a.bucket(), accountKeyPath, "")
+
+	if err == nil {
+		block, _ := pem.Decode(object.Bytes)
+
+		if block == nil {
+			return nil, fmt.Errorf("Invalid account key in s3://%v/%v", a.bucket(), accountKeyPath)
+		}
+
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	if !util.IsS3NotFound(err) {
+		return nil, fmt.Errorf("Unable to download account key: %v", err)
+	}
+
+	log.Info().Msgf("Creating a new ACME account key in s3://%v/%v", a.bucket(), accountKeyPath)
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := encodeECKey(accountKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.s3Client.UploadFileFromMemory(a.bucket(), accountKeyPath, keyPEM); err != nil {
+		return nil, fmt.Errorf("Unable to upload account key: %v", err)
+	}
+
+	return accountKey, nil
+}
+
+// syncFromS3 replaces the local certificate when S3 has one expiring later. Returns true if replaced.
+func (a *AcmeService) syncFromS3(hostname string) (bool, error) {
+
+	chainObject, err := a.s3Client.DownloadObjectInMemory(a.bucket(), a.s3Key("certs", hostname, "fullchain.pem"), "")
+
+	if util.IsS3NotFound(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	remoteNotAfter, err := certNotAfter(chainObject.Bytes)
+
+	if err != nil {
+		return false, err
+	}
+
+	localChain, err := ioutil.ReadFile(a.localCertPath(hostname))
+
+	if err == nil {
+		if localNotAfter, err := certNotAfter(localChain); err == nil && !remoteNotAfter.After(localNotAfter) {
+			return false, nil
+		}
+	}
+
+	keyObject, err := a.s3Client.DownloadObjectInMemory(a.bucket(), a.s3Key("certs", hostname, "privkey.pem"), "")
+
+	if err != nil {
+		return false, err
+	}
+
+	log.Info().Msgf("Using certificate for '%v' from S3, valid until %v", hostname, remoteNotAfter)
+
+	return true, a.writeLocal(hostname, chainObject.Bytes, keyObject.Bytes)
+}
+
+func (a *AcmeService) needsRenewal(hostname string, now time.Time) bool {
+
+	chain, err := ioutil.ReadFile(a.localCertPath(hostname))
+
+	if err != nil {
+		return true
+	}
+
+	notAfter, err := certNotAfter(chain)
+
+	if err != nil {
+		return true
+	}
+
+	return notAfter.Sub(now) < a.cfg.Current().Acme.RenewBefore
+}
+
+// writeSelfSigned writes a placeholder valid for one day, so it gets renewed right away
+func (a *AcmeService) writeSelfSigned(hostname string) error {
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &certKey.PublicKey, certKey)
+
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := encodeECKey(certKey)
+
+	if err != nil {
+		return err
+	}
+
+	return a.writeLocal(hostname, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM)
+}
+
+func (a *AcmeService) writeLocal(hostname string, chainPEM []byte, keyPEM []byte) error {
+
+	certFolder := filepath.Dir(a.localCertPath(hostname))
+
+	if err := os.MkdirAll(certFolder, 0755); err != nil {
+		return err
+	}
+
+	keyPath := filepath.Join(certFolder, "privkey.pem")
+	chainPath := filepath.Join(certFolder, "fullchain.pem")
+
+	// the files are written aside first, so that the lock is only held for the renames
+	if err := ioutil.WriteFile(keyPath+".tmp", keyPEM, 0600); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(chainPath+".tmp", chainPEM, 0644); err != nil {
+		return err
+	}
+
+	install := func() error {
+
+		if err := os.Rename(keyPath+".tmp", keyPath); err != nil {
+			return err
+		}
+
+		return os.Rename(chainPath+".tmp", chainPath)
+	}
+
+	// a reconcile testing the config in between would load the new key with the old certificate
+	if a.revProxyService != nil {
+		return a.revProxyService.WithReconcileLock(install)
+	}
+
+	return install()
+}
+
+func (a *AcmeService) localCertPath(hostname string) string {
+	return filepath.Join(a.cfg.Nginx.ConfigFolder, a.cfg.Acme.CertFolder, hostname, "fullchain.pem")
+}
+
+func (a *AcmeService) bucket() string {
+
+	if a.cfg.Acme.S3Bucket != "" {
+		return a.cfg.Acme.S3Bucket
+	}
+
+	return a.cfg.Nginx.ConfigBundleS3Bucket
+}
+
+func (a *AcmeService) s3Key(elements ...string) string {
+	return path.Join(append([]string{a.cfg.Acme.S3Prefix}, elements...)...)
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+
+	der, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// certNotAfter returns the expiry of the first certificate in a PEM chain
+func certNotAfter(chainPEM []byte) (time.Time, error) {
+
+	block, _ := pem.Decode(chainPEM)
+
+	if block == nil {
+		return time.Time{}, fmt.Errorf("No PEM certificate found")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return cert.NotAfter, nil
+}
@@ -0,0 +1,427 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+)
+
+const (
+	testAcmeBucket   = "certs-bucket"
+	testAcmeHostname = "ingress.example.com"
+	testAcmeToken    = "evaGxfADs6pSRb2LAv9IZf17Dt3juxGJ-PCt92wr-oA"
+)
+
+// fakeAcmeCA a minimal RFC 8555 CA with one http-01 authorization. Signatures aren't checked.
+type fakeAcmeCA struct {
+	t      *testing.T
+	server *httptest.Server
+
+	// challengeURL where the http-01 response is fetched from, normally the host being validated
+	challengeURL string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	lock       sync.Mutex
+	nonceSeq   int
+	authzValid bool
+	chainPEM   []byte
+}
+
+func newFakeAcmeCA(t *testing.T) *fakeAcmeCA {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := &fakeAcmeCA{
+		t:      t,
+		caKey:  caKey,
+		caCert: caCert,
+	}
+
+	ret.server = httptest.NewServer(ret)
+	t.Cleanup(ret.server.Close)
+
+	return ret
+}
+
+func (f *fakeAcmeCA) url(path string) string {
+	return f.server.URL + path
+}
+
+func (f *fakeAcmeCA) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.nonceSeq++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%v", f.nonceSeq))
+	w.Header().Set("Content-Type", "application/json")
+
+	payload := f.payload(req)
+
+	switch req.URL.Path {
+
+	case "/directory":
+		f.reply(w, http.StatusOK, map[string]string{
+			"newNonce":   f.url("/new-nonce"),
+			"newAccount": f.url("/new-account"),
+			"newOrder":   f.url("/new-order"),
+		})
+
+	case "/new-nonce":
+		w.WriteHeader(http.StatusOK)
+
+	case "/new-account":
+		w.Header().Set("Location", f.url("/account/1"))
+		f.reply(w, http.StatusCreated, map[string]string{"status": "valid"})
+
+	case "/new-order":
+		w.Header().Set("Location", f.url("/order/1"))
+		f.reply(w, http.StatusCreated, f.order())
+
+	case "/order/1":
+		w.Header().Set("Location", f.url("/order/1"))
+		f.reply(w, http.StatusOK, f.order())
+
+	case "/authz/1":
+		f.reply(w, http.StatusOK, f.authz())
+
+	case "/challenge/1":
+		f.validate()
+		f.reply(w, http.StatusOK, f.challenge())
+
+	case "/finalize/1":
+		f.finalize(payload)
+		w.Header().Set("Location", f.url("/order/1"))
+		f.reply(w, http.StatusOK, f.order())
+
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.WriteHeader(http.StatusOK)
+		w.Write(f.chainPEM)
+
+	default:
+		f.reply(w, http.StatusNotFound, map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+	}
+}
+
+// payload decodes the payload of a JWS request, nil for POST-as-GET and plain requests
+func (f *fakeAcmeCA) payload(req *http.Request) []byte {
+
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+
+	if len(body) == 0 || json.Unmarshal(body, &jws) != nil || jws.Payload == "" {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	if err != nil {
+		f.t.Errorf("Invalid JWS payload: %v", err)
+	}
+
+	return payload
+}
+
+func (f *fakeAcmeCA) reply(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeAcmeCA) order() map[string]interface{} {
+
+	status := "pending"
+
+	if f.chainPEM != nil {
+		status = "valid"
+	} else if f.authzValid {
+		status = "ready"
+	}
+
+	ret := map[string]interface{}{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": testAcmeHostname}},
+		"authorizations": []string{f.url("/authz/1")},
+		"finalize":       f.url("/finalize/1"),
+	}
+
+	if f.chainPEM != nil {
+		ret["certificate"] = f.url("/cert/1")
+	}
+
+	return ret
+}
+
+func (f *fakeAcmeCA) challenge() map[string]string {
+
+	status := "pending"
+
+	if f.authzValid {
+		status = "valid"
+	}
+
+	return map[string]string{
+		"type":   ChallengeHTTP01,
+		"url":    f.url("/challenge/1"),
+		"token":  testAcmeToken,
+		"status": status,
+	}
+}
+
+func (f *fakeAcmeCA) authz() map[string]interface{} {
+
+	status := "pending"
+
+	if f.authzValid {
+		status = "valid"
+	}
+
+	return map[string]interface{}{
+		"identifier": map[string]string{"type": "dns", "value": testAcmeHostname},
+		"status":     status,
+		"challenges": []map[string]string{f.challenge()},
+	}
+}
+
+// validate fetches the key authorization like a CA would
+func (f *fakeAcmeCA) validate() {
+
+	res, err := http.Get(f.challengeURL + acmeChallengePathPrefix + testAcmeToken)
+
+	if err != nil {
+		f.t.Errorf("Unable to fetch the challenge: %v", err)
+		return
+	}
+
+	defer res.Body.Close()
+
+	keyAuth, _ := ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(keyAuth), testAcmeToken+".") {
+		f.t.Errorf("Invalid challenge response: %v %q", res.StatusCode, keyAuth)
+		return
+	}
+
+	f.authzValid = true
+}
+
+// finalize signs the CSR with the fake CA
+func (f *fakeAcmeCA) finalize(payload []byte) {
+
+	var request struct {
+		CSR string `json:"csr"`
+	}
+
+	if err := json.Unmarshal(payload, &request); err != nil {
+		f.t.Errorf("Invalid finalize request: %v", err)
+		return
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(request.CSR)
+
+	if err != nil {
+		f.t.Errorf("Invalid CSR encoding: %v", err)
+		return
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+
+	if err != nil {
+		f.t.Errorf("Invalid CSR: %v", err)
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, f.caCert, csr.PublicKey, f.caKey)
+
+	if err != nil {
+		f.t.Errorf("Unable to sign CSR: %v", err)
+		return
+	}
+
+	f.chainPEM = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+}
+
+func newTestAcmeService(t *testing.T, directoryURL string) (*AcmeService, *fakeaws.S3) {
+
+	cfg := &shared.Config{}
+	cfg.Nginx.ConfigFolder = t.TempDir()
+	cfg.Acme.Hostnames = []string{testAcmeHostname}
+	cfg.Acme.DirectoryURL = directoryURL
+	cfg.Acme.Challenge = ChallengeHTTP01
+	cfg.Acme.S3Bucket = testAcmeBucket
+	cfg.Acme.S3Prefix = "acme"
+	cfg.Acme.CertFolder = "certs"
+	cfg.Acme.RenewBefore = 30 * 24 * time.Hour
+
+	fakeS3 := fakeaws.NewS3()
+
+	return NewAcmeService(cfg, util.NewS3ClientFromAPI(cfg, fakeS3), nil, nil, nil), fakeS3
+}
+
+func TestAcmeIssueHTTP01(t *testing.T) {
+
+	fakeCA := newFakeAcmeCA(t)
+	acmeService, fakeS3 := newTestAcmeService(t, fakeCA.url("/directory"))
+
+	challengeServer := httptest.NewServer(acmeService)
+	defer challengeServer.Close()
+
+	fakeCA.challengeURL = challengeServer.URL
+
+	if !acmeService.needsRenewal(testAcmeHostname, time.Now()) {
+		t.Fatal("A missing certificate must need renewal")
+	}
+
+	if err := acmeService.issue(testAcmeHostname); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fakeCA.authzValid {
+		t.Fatal("The challenge was never validated")
+	}
+
+	localChain, err := ioutil.ReadFile(acmeService.localCertPath(testAcmeHostname))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(localChain) != string(fakeCA.chainPEM) {
+		t.Errorf("Local chain differs from the issued one")
+	}
+
+	if string(fakeS3.Get(testAcmeBucket, "acme/certs/"+testAcmeHostname+"/fullchain.pem")) != string(fakeCA.chainPEM) {
+		t.Errorf("S3 chain differs from the issued one")
+	}
+
+	if fakeS3.Get(testAcmeBucket, "acme/certs/"+testAcmeHostname+"/privkey.pem") == nil {
+		t.Errorf("Private key not uploaded")
+	}
+
+	if fakeS3.Get(testAcmeBucket, "acme/account.key") == nil {
+		t.Errorf("Account key not uploaded")
+	}
+
+	// the challenge is gone from memory and S3 once the order completes
+	if fakeS3.Get(testAcmeBucket, "acme/challenges/"+testAcmeToken) != nil {
+		t.Errorf("Challenge left behind in S3")
+	}
+
+	if len(acmeService.challenges) != 0 {
+		t.Errorf("Challenge left behind in memory: %v", acmeService.challenges)
+	}
+
+	if acmeService.needsRenewal(testAcmeHostname, time.Now()) {
+		t.Errorf("A fresh certificate must not need renewal")
+	}
+
+	if !acmeService.needsRenewal(testAcmeHostname, time.Now().Add(80*24*time.Hour)) {
+		t.Errorf("A certificate expiring within RenewBefore must need renewal")
+	}
+}
+
+func TestAcmeServeHTTP(t *testing.T) {
+
+	acmeService, fakeS3 := newTestAcmeService(t, "")
+
+	// started by another host
+	fakeS3.Put(testAcmeBucket, "acme/challenges/"+testAcmeToken, []byte(testAcmeToken+".thumbprint"))
+
+	acmeService.challenges["Zm9vYmFyYmF6Zm9vYmFyYmF6MTIz"] = "Zm9vYmFyYmF6Zm9vYmFyYmF6MTIz.local"
+
+	tests := []struct {
+		token    string
+		status   int
+		body     string
+		s3Lookup bool
+	}{
+		{testAcmeToken, http.StatusOK, testAcmeToken + ".thumbprint", true},
+		{"Zm9vYmFyYmF6Zm9vYmFyYmF6MTIz", http.StatusOK, "Zm9vYmFyYmF6Zm9vYmFyYmF6MTIz.local", false},
+		{"YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4", http.StatusNotFound, "", true},
+		{"", http.StatusNotFound, "", false},
+		{"short", http.StatusNotFound, "", false},
+		{"../../account.key/aaaaaaaaaaaaaaaaaaaaaa", http.StatusNotFound, "", false},
+		{"evaGxfADs6pSRb2LAv9IZf17Dt3juxGJ+PCt92wr=oA", http.StatusNotFound, "", false},
+		{strings.Repeat("a", 129), http.StatusNotFound, "", false},
+	}
+
+	for _, test := range tests {
+
+		getCount := fakeS3.Calls("GetObject")
+
+		recorder := httptest.NewRecorder()
+		acmeService.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, acmeChallengePathPrefix+test.token, nil))
+
+		if recorder.Code != test.status {
+			t.Errorf("Token %q: expected status %v, got %v", test.token, test.status, recorder.Code)
+		}
+
+		if test.status == http.StatusOK && recorder.Body.String() != test.body {
+			t.Errorf("Token %q: expected %q, got %q", test.token, test.body, recorder.Body.String())
+		}
+
+		if s3Lookup := fakeS3.Calls("GetObject") > getCount; s3Lookup != test.s3Lookup {
+			t.Errorf("Token %q: expected S3 lookup %v, got %v", test.token, test.s3Lookup, s3Lookup)
+		}
+	}
+}
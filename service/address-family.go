@@ -0,0 +1,97 @@
+package service
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TagIngressAddressFamily the service tag overriding DISCOVERY_ADDRESS_FAMILY for one service
+const TagIngressAddressFamily = "ingress.address-family"
+
+// address families
+const (
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// Server the address and port of a location as written in an nginx server line, IPv6 addresses in brackets
+func (l EcsServiceIPPort) Server() string {
+
+	address := l.Address
+
+	if address == "" {
+		address = l.PrivateIPAddress
+	}
+
+	return net.JoinHostPort(address, strconv.FormatInt(l.Port, 10))
+}
+
+// SelectAddresses sets the Address of every location from the address family of its service, the ingress.address-family
+// tag or defaultFamily. A location without an address of that family falls back to the other one.
+func SelectAddresses(descrMap map[string]EcsServiceDescr, defaultFamily string) map[string]EcsServiceDescr {
+
+	retMap := make(map[string]EcsServiceDescr)
+
+	for name, descr := range descrMap {
+
+		family := addressFamily(descr, defaultFamily)
+
+		// a copy, the discovered services are shared with the snapshots and the admin API
+		descr.LocationList = selectLocationAddresses(descr.LocationList, family)
+
+		taskSetList := make([]EcsTaskSetDescr, 0, len(descr.TaskSetList))
+
+		for _, taskSet := range descr.TaskSetList {
+			taskSet.LocationList = selectLocationAddresses(taskSet.LocationList, family)
+			taskSetList = append(taskSetList, taskSet)
+		}
+
+		descr.TaskSetList = taskSetList
+		retMap[name] = descr
+	}
+
+	return retMap
+}
+
+// addressFamily reads the ingress.address-family tag, defaultFamily when missing or invalid
+func addressFamily(descr EcsServiceDescr, defaultFamily string) string {
+
+	value, found := descr.Tags[TagIngressAddressFamily]
+
+	if !found {
+		return defaultFamily
+	}
+
+	if value != AddressFamilyIPv4 && value != AddressFamilyIPv6 {
+		log.Warn().Msgf("Invalid %v tag '%v' on service '%v'. Using %v", TagIngressAddressFamily, value, descr.ServiceName, defaultFamily)
+		return defaultFamily
+	}
+
+	return value
+}
+
+func selectLocationAddresses(locationList []EcsServiceIPPort, family string) []EcsServiceIPPort {
+
+	retList := make([]EcsServiceIPPort, 0, len(locationList))
+
+	for _, location := range locationList {
+
+		preferred, other := location.PrivateIPAddress, location.IPv6Address
+
+		if family == AddressFamilyIPv6 {
+			preferred, other = other, preferred
+		}
+
+		location.Address = preferred
+
+		if location.Address == "" {
+			location.Address = other
+		}
+
+		retList = append(retList, location)
+	}
+
+	return retList
+}
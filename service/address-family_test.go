@@ -0,0 +1,66 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+)
+
+func TestSelectAddresses(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instance := cluster.AddInstance("10.0.0.1", "")
+	instance.IPv6Address = "2600:1f18::1"
+
+	cluster.AddService("web")
+	cluster.AddService("api")
+	cluster.AddService("grpc")
+	cluster.TagService("api", TagIngressAddressFamily, AddressFamilyIPv6)
+
+	cluster.AddTask("web", instance, 32768, 80)
+	cluster.AddAwsvpcTask("api", instance, "10.0.0.20", "2600:1f18::20", 8080)
+	cluster.AddAwsvpcTask("api", instance, "10.0.0.21", "2600:1f18::21", 8080)
+	cluster.AddAwsvpcTask("grpc", instance, "", "2600:1f18::30", 50051)
+
+	descrMap, err := newFakeEcsService(cluster).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	if location := descrMap["web"].LocationList[0]; location.IPv6Address != "2600:1f18::1" || location.Port != 32768 {
+		t.Errorf("unexpected bridge location %+v", location)
+	}
+
+	if location := descrMap["api"].LocationList[0]; location.PrivateIPAddress != "10.0.0.20" || location.IPv6Address != "2600:1f18::20" || location.Port != 8080 {
+		t.Errorf("unexpected awsvpc location %+v", location)
+	}
+
+	// the port of the shared task definition is only read once per discovery
+	if count := cluster.CallCount("DescribeTaskDefinition"); count != 2 {
+		t.Errorf("expected one DescribeTaskDefinition per task definition, got %v", count)
+	}
+
+	upstreamMap := SelectAddresses(descrMap, AddressFamilyIPv4)
+
+	for name, expected := range map[string]string{"web": "10.0.0.1:32768", "api": "[2600:1f18::20]:8080", "grpc": "[2600:1f18::30]:50051"} {
+		if server := upstreamMap[name].LocationList[0].Server(); server != expected {
+			t.Errorf("%v: expected server %v, got %v", name, expected, server)
+		}
+	}
+
+	if descrMap["api"].LocationList[0].Address != "" {
+		t.Error("discovered location modified")
+	}
+
+	buffer, err := RenderUpstreams("../data/upstreams.conf.tmpl", descrMap, UpstreamOptions{AddressFamily: AddressFamilyIPv6})
+
+	if err != nil {
+		t.Fatalf("RenderUpstreams failed: %v", err)
+	}
+
+	if rendered := buffer.String(); !strings.Contains(rendered, "server [2600:1f18::1]:32768;") || !strings.Contains(rendered, "server [2600:1f18::21]:8080;") {
+		t.Errorf("unexpected upstreams:\n%v", rendered)
+	}
+}
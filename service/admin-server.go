@@ -0,0 +1,256 @@
+package service
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// AdminServer the HTTP server exposing the controller's own endpoints
+type AdminServer struct {
+	cfg             *shared.Config
+	metrics         *shared.Metrics
+	revProxyService *RevProxyService
+	proxy           Proxy
+	mux             *http.ServeMux
+}
+
+// NewAdminServer Creates a new admin server
+func NewAdminServer(cfg *shared.Config, metrics *shared.Metrics, revProxyService *RevProxyService, proxy Proxy) *AdminServer {
+
+	ret := &AdminServer{
+		cfg:             cfg,
+		metrics:         metrics,
+		revProxyService: revProxyService,
+		proxy:           proxy,
+		mux:             http.NewServeMux(),
+	}
+
+	ret.mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	ret.mux.HandleFunc("/healthz", ret.handleHealthz)
+	ret.mux.HandleFunc("/readyz", ret.handleReadyz)
+
+	// read-only inspection API
+	ret.mux.HandleFunc("/api/state", ret.handleState)
+	ret.mux.HandleFunc("/api/services", ret.handleServices)
+	ret.mux.HandleFunc("/api/snapshot", ret.handleSnapshot)
+	ret.mux.HandleFunc("/api/rendered", ret.handleRendered)
+	ret.mux.HandleFunc("/api/history", ret.handleHistory)
+	ret.mux.HandleFunc("/api/health-checks", ret.handleHealthChecks)
+
+	// authenticated actions
+	ret.mux.HandleFunc("/api/actions/resync", ret.authorized("resync", ret.handleResync))
+	ret.mux.HandleFunc("/api/actions/pause", ret.authorized("pause", ret.handlePause))
+	ret.mux.HandleFunc("/api/actions/resume", ret.authorized("resume", ret.handleResume))
+	ret.mux.HandleFunc("/api/actions/pin", ret.authorized("pin", ret.handlePin))
+	ret.mux.HandleFunc("/api/actions/unpin", ret.authorized("unpin", ret.handleUnpin))
+
+	return ret
+}
+
+// Handle registers an additional handler, used by optional services
+func (a *AdminServer) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// Start listens on the configured address until the server fails
+func (a *AdminServer) Start() {
+
+	log.Info().Msgf("Admin server START on '%v'", a.cfg.Admin.ListenAddress)
+
+	err := http.ListenAndServe(a.cfg.Admin.ListenAddress, a.mux)
+
+	log.Error().Err(err).Msg("Admin server STOPPED")
+}
+
+// handleHealthz succeeds as long as we and the proxy are alive
+func (a *AdminServer) handleHealthz(w http.ResponseWriter, req *http.Request) {
+
+	if !a.proxy.IsRunning() {
+		http.Error(w, "the proxy is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz succeeds once a config has been applied and discovery is not stale
+func (a *AdminServer) handleReadyz(w http.ResponseWriter, req *http.Request) {
+
+	if reason := a.notReadyReason(time.Now()); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// notReadyReason returns why we should not receive traffic, or an empty string when ready
+func (a *AdminServer) notReadyReason(now time.Time) string {
+
+	if !a.proxy.IsRunning() {
+		return "the proxy is not running"
+	}
+
+	status := a.revProxyService.Status()
+
+	if status.FirstAppliedAt.IsZero() && !status.RestoredAt.IsZero() {
+		return fmt.Sprintf("serving the last known good state restored at %v: %v", status.RestoredAt.Format(time.RFC3339), status.LastError)
+	}
+
+	if status.FirstAppliedAt.IsZero() {
+		return "no configuration applied yet"
+	}
+
+	staleness := now.Sub(status.LastSuccessAt)
+	maxStaleness := a.cfg.Current().Admin.ReadyMaxStaleness
+
+	if staleness > maxStaleness {
+		return fmt.Sprintf("last successful sync %v ago (max %v): %v", staleness.Round(time.Second), maxStaleness, status.LastError)
+	}
+
+	return ""
+}
+
+// handleState dumps everything the controller knows
+func (a *AdminServer) handleState(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, a.revProxyService.State())
+}
+
+// handleServices dumps the latest discovery result
+func (a *AdminServer) handleServices(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, a.revProxyService.State().Services)
+}
+
+// handleSnapshot dumps the latest discovery result as a snapshot that the file provider can replay
+func (a *AdminServer) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+
+	state := a.revProxyService.State()
+
+	snapshot := NewClusterSnapshot(a.cfg.AWS.ClusterName, state.Services)
+	snapshot.CapturedAt = state.DiscoveredAt
+
+	writeJSON(w, snapshot)
+}
+
+// handleRendered prints a rendered file as nginx sees it, or all of them as JSON
+func (a *AdminServer) handleRendered(w http.ResponseWriter, req *http.Request) {
+
+	applied := a.revProxyService.State().Applied
+
+	if applied == nil {
+		http.Error(w, "no configuration applied yet", http.StatusNotFound)
+		return
+	}
+
+	fileName := req.URL.Query().Get("file")
+
+	if fileName == "" {
+		writeJSON(w, applied.Rendered)
+		return
+	}
+
+	content, found := applied.Rendered[fileName]
+
+	if !found {
+		http.Error(w, fmt.Sprintf("no rendered file named '%v'", fileName), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, content)
+}
+
+// handleHistory dumps the most recent reconcile results
+func (a *AdminServer) handleHistory(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, a.revProxyService.State().History)
+}
+
+// handleHealthChecks dumps the state of the endpoints probed by the active health checker
+func (a *AdminServer) handleHealthChecks(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, a.revProxyService.State().HealthChecks)
+}
+
+// authorized only lets POST requests with the admin bearer token through, and audits them
+func (a *AdminServer) authorized(action string, next http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+
+		token := a.cfg.Current().Admin.Token
+
+		if token == "" {
+			http.Error(w, "admin actions are disabled: no admin token configured", http.StatusForbidden)
+			return
+		}
+
+		if req.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		expected := "Bearer " + token
+
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) != 1 {
+			log.Warn().Str("audit", action).Str("remote", req.RemoteAddr).Msg("Admin action REJECTED: invalid token")
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		log.Info().Str("audit", action).Str("remote", req.RemoteAddr).Str("query", req.URL.RawQuery).Msg("Admin action")
+
+		next(w, req)
+	}
+}
+
+// handleResync runs a QueryAndUpdate right away and reports its outcome
+func (a *AdminServer) handleResync(w http.ResponseWriter, req *http.Request) {
+
+	if err := a.revProxyService.Resync(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, a.revProxyService.State())
+}
+
+// handlePause stops applying changes to nginx
+func (a *AdminServer) handlePause(w http.ResponseWriter, req *http.Request) {
+	a.revProxyService.SetPaused(true)
+	writeJSON(w, a.revProxyService.State())
+}
+
+// handleResume applies changes again starting from the next poll
+func (a *AdminServer) handleResume(w http.ResponseWriter, req *http.Request) {
+	a.revProxyService.SetPaused(false)
+	writeJSON(w, a.revProxyService.State())
+}
+
+// handlePin pins the S3 version of the config bundle
+func (a *AdminServer) handlePin(w http.ResponseWriter, req *http.Request) {
+
+	versionID := req.URL.Query().Get("version")
+
+	if versionID == "" {
+		http.Error(w, "missing 'version' parameter", http.StatusBadRequest)
+		return
+	}
+
+	a.revProxyService.PinBundleVersion(versionID)
+	writeJSON(w, a.revProxyService.State())
+}
+
+// handleUnpin goes back to the latest version of the config bundle
+func (a *AdminServer) handleUnpin(w http.ResponseWriter, req *http.Request) {
+	a.revProxyService.PinBundleVersion("")
+	writeJSON(w, a.revProxyService.State())
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, shared.PrettyPrint(data))
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+)
+
+// fakeProxy a proxy that only reports whether it runs
+type fakeProxy struct {
+	running bool
+}
+
+func (f *fakeProxy) Start(wg *sync.WaitGroup)                           { wg.Done() }
+func (f *fakeProxy) Stop()                                              {}
+func (f *fakeProxy) IsRunning() bool                                    { return f.running }
+func (f *fakeProxy) TestConfig() (string, error)                        { return "", nil }
+func (f *fakeProxy) TestConfigFile(mainConfPath string) (string, error) { return "", nil }
+func (f *fakeProxy) Reload()                                            {}
+func (f *fakeProxy) UpstreamAPI() util.UpstreamAPI                      { return nil }
+
+// newTestAdminServer returns an admin server in front of a rev proxy fixture, with a running proxy
+func newTestAdminServer(t *testing.T) (*AdminServer, *revProxyFixture, *fakeProxy) {
+
+	f := newRevProxyFixture(t)
+	f.cfg.Admin.ReadyMaxStaleness = time.Minute
+
+	proxy := &fakeProxy{running: true}
+
+	return NewAdminServer(f.cfg, shared.NewMetrics(f.cfg), f.revProxyService, proxy), f, proxy
+}
+
+// serve runs a request against the admin server
+func serve(adminServer *AdminServer, method string, url string, token string) *httptest.ResponseRecorder {
+
+	req := httptest.NewRequest(method, url, nil)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	adminServer.mux.ServeHTTP(recorder, req)
+
+	return recorder
+}
+
+func TestNotReadyReason(t *testing.T) {
+
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		running       bool
+		restoredAt    time.Time
+		appliedAt     time.Time
+		lastSuccessAt time.Time
+		expected      string
+	}{
+		{
+			name:     "proxy not running",
+			running:  false,
+			expected: "the proxy is not running",
+		},
+		{
+			name:     "nothing applied",
+			running:  true,
+			expected: "no configuration applied yet",
+		},
+		{
+			name:       "restored but not applied",
+			running:    true,
+			restoredAt: now.Add(-time.Minute),
+			expected:   "serving the last known good state restored at",
+		},
+		{
+			name:          "stale",
+			running:       true,
+			appliedAt:     now.Add(-time.Hour),
+			lastSuccessAt: now.Add(-2 * time.Minute),
+			expected:      "last successful sync 2m0s ago (max 1m0s)",
+		},
+		{
+			name:          "ready",
+			running:       true,
+			appliedAt:     now.Add(-time.Hour),
+			lastSuccessAt: now.Add(-30 * time.Second),
+			expected:      "",
+		},
+	}
+
+	for _, test := range tests {
+
+		adminServer, f, proxy := newTestAdminServer(t)
+		proxy.running = test.running
+
+		f.revProxyService.lock.Lock()
+		f.revProxyService.restoredAt = test.restoredAt
+		f.revProxyService.firstAppliedAt = test.appliedAt
+		f.revProxyService.lastSuccessAt = test.lastSuccessAt
+		f.revProxyService.lock.Unlock()
+
+		reason := adminServer.notReadyReason(now)
+
+		if (test.expected == "") != (reason == "") || !strings.HasPrefix(reason, test.expected) {
+			t.Errorf("%v: expected '%v', got '%v'", test.name, test.expected, reason)
+		}
+	}
+
+	// /readyz turns the reason into a 503
+	adminServer, _, _ := newTestAdminServer(t)
+
+	if recorder := serve(adminServer, http.MethodGet, "/readyz", ""); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to fail before the first apply, got %v", recorder.Code)
+	}
+}
+
+func TestAdminRenderedAndSnapshot(t *testing.T) {
+
+	adminServer, f, _ := newTestAdminServer(t)
+
+	if recorder := serve(adminServer, http.MethodGet, "/api/rendered", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before the first apply, got %v", recorder.Code)
+	}
+
+	instance := f.cluster.AddInstance("10.0.0.1", "")
+	f.cluster.AddService("web")
+	f.cluster.AddTask("web", instance, 32768, 80)
+	f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if recorder := serve(adminServer, http.MethodGet, "/api/rendered?file=upstreams.conf", ""); recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "server 10.0.0.1:32768;") {
+		t.Errorf("unexpected rendered upstreams %v:\n%v", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := serve(adminServer, http.MethodGet, "/api/rendered?file=missing.conf", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown file, got %v", recorder.Code)
+	}
+
+	// the file provider replays the snapshot
+	recorder := serve(adminServer, http.MethodGet, "/api/snapshot", "")
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.json")
+
+	if err := ioutil.WriteFile(snapshotPath, recorder.Body.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	descrMap, err := NewFileDiscovery(snapshotPath).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("snapshot not readable by the file provider: %v", err)
+	}
+
+	if locationList := descrMap["web"].LocationList; len(locationList) != 1 || locationList[0].Server() != "10.0.0.1:32768" {
+		t.Errorf("unexpected replayed services %+v", descrMap)
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+
+	adminServer, f, _ := newTestAdminServer(t)
+
+	// no token configured
+	if recorder := serve(adminServer, http.MethodPost, "/api/actions/pause", "secret"); recorder.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a configured token, got %v", recorder.Code)
+	}
+
+	f.cfg.Admin.Token = "secret"
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		token    string
+		expected int
+	}{
+		{name: "GET", method: http.MethodGet, url: "/api/actions/pause", token: "secret", expected: http.StatusMethodNotAllowed},
+		{name: "no token", method: http.MethodPost, url: "/api/actions/pause", expected: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, url: "/api/actions/pause", token: "guess", expected: http.StatusUnauthorized},
+		{name: "pin without version", method: http.MethodPost, url: "/api/actions/pin", token: "secret", expected: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		if recorder := serve(adminServer, test.method, test.url, test.token); recorder.Code != test.expected {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, recorder.Code)
+		}
+	}
+
+	if f.revProxyService.IsPaused() || f.revProxyService.PinnedBundleVersion() != "" {
+		t.Fatal("rejected actions must not change anything")
+	}
+
+	if recorder := serve(adminServer, http.MethodPost, "/api/actions/pause", "secret"); recorder.Code != http.StatusOK || !f.revProxyService.IsPaused() {
+		t.Errorf("expected pause to run, got %v", recorder.Code)
+	}
+
+	if recorder := serve(adminServer, http.MethodPost, "/api/actions/pin?version=v42", "secret"); recorder.Code != http.StatusOK || f.revProxyService.PinnedBundleVersion() != "v42" {
+		t.Errorf("expected the bundle to be pinned, got %v", recorder.Code)
+	}
+}
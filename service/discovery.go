@@ -0,0 +1,138 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+)
+
+// discovery providers
+const (
+	DiscoveryProviderECS    = "ecs"
+	DiscoveryProviderFile   = "file"
+	DiscoveryProviderAgent  = "agent"
+	DiscoveryProviderDocker = "docker"
+)
+
+// ClusterSnapshotVersion the snapshot format we write. Bump it on incompatible changes.
+const ClusterSnapshotVersion = 1
+
+// Discovery finds the services to render in the upstreams
+type Discovery interface {
+	GetServicesAndPorts(clusterName string) (map[string]EcsServiceDescr, error)
+}
+
+// NewDiscovery returns the configured discovery provider
+func NewDiscovery(cfg *shared.Config, ecsService *EcsService) (Discovery, error) {
+
+	switch cfg.Discovery.Provider {
+	case DiscoveryProviderECS, "":
+		return ecsService, nil
+	case DiscoveryProviderFile:
+		return NewFileDiscovery(cfg.Discovery.SnapshotFile), nil
+	case DiscoveryProviderAgent:
+		return NewAgentDiscovery(cfg.Discovery.AgentURL, cfg.Discovery.HostAddress), nil
+	case DiscoveryProviderDocker:
+		return NewDockerDiscovery(cfg.Discovery.DockerHost, cfg.Discovery.HostAddress), nil
+	}
+
+	return nil, fmt.Errorf("Unknown discovery provider '%v'", cfg.Discovery.Provider)
+}
+
+// ClusterSnapshot a complete discovery result, saved to replay it offline
+type ClusterSnapshot struct {
+	Version     int
+	CapturedAt  time.Time
+	ClusterName string
+	Services    map[string]EcsServiceDescr
+}
+
+// NewClusterSnapshot wraps a discovery result
+func NewClusterSnapshot(clusterName string, descrMap map[string]EcsServiceDescr) *ClusterSnapshot {
+
+	return &ClusterSnapshot{
+		Version:     ClusterSnapshotVersion,
+		CapturedAt:  time.Now(),
+		ClusterName: clusterName,
+		Services:    descrMap,
+	}
+}
+
+// DecodeClusterSnapshot reads a snapshot. A bare services map (as returned by /api/services) is accepted too.
+func DecodeClusterSnapshot(snapshotBytes []byte) (*ClusterSnapshot, error) {
+
+	snapshot := &ClusterSnapshot{}
+
+	if err := json.Unmarshal(snapshotBytes, snapshot); err != nil {
+		return nil, fmt.Errorf("Invalid snapshot: %v", err)
+	}
+
+	if snapshot.Version > ClusterSnapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %v, at most %v is supported", snapshot.Version, ClusterSnapshotVersion)
+	}
+
+	if snapshot.Version == 0 {
+
+		descrMap := make(map[string]EcsServiceDescr)
+
+		if err := json.Unmarshal(snapshotBytes, &descrMap); err != nil {
+			return nil, fmt.Errorf("Invalid snapshot: %v", err)
+		}
+
+		return &ClusterSnapshot{Services: descrMap}, nil
+	}
+
+	if snapshot.Services == nil {
+		snapshot.Services = make(map[string]EcsServiceDescr)
+	}
+
+	return snapshot, nil
+}
+
+// LoadClusterSnapshot reads a snapshot file
+func LoadClusterSnapshot(snapshotFile string) (*ClusterSnapshot, error) {
+
+	snapshotBytes, err := ioutil.ReadFile(snapshotFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := DecodeClusterSnapshot(snapshotBytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", snapshotFile, err)
+	}
+
+	return snapshot, nil
+}
+
+// FileDiscovery replays a snapshot instead of querying AWS
+type FileDiscovery struct {
+	snapshotFile string
+}
+
+// NewFileDiscovery Creates a new file discovery
+func NewFileDiscovery(snapshotFile string) *FileDiscovery {
+
+	ret := &FileDiscovery{
+		snapshotFile: snapshotFile,
+	}
+
+	return ret
+}
+
+// GetServicesAndPorts reads the file at every call, so that it can be swapped to replay another state
+func (f *FileDiscovery) GetServicesAndPorts(clusterName string) (map[string]EcsServiceDescr, error) {
+
+	snapshot, err := LoadClusterSnapshot(f.snapshotFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.Services, nil
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// updateGolden rewrites the golden files from the current output: go test ./service -run Golden -update
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+const goldenSnapshotFile = "testdata/cluster-snapshot.json"
+
+// checkGolden compares the output with a golden file, or rewrites it with -update
+func checkGolden(t *testing.T, goldenFile string, output []byte) {
+
+	if *updateGolden {
+		if err := ioutil.WriteFile(goldenFile, output, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(goldenFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(output) != string(expected) {
+		t.Errorf("output differs from %v, run with -update if expected:\n%v", goldenFile, string(output))
+	}
+}
+
+func TestClusterSnapshotGoldenRoundTrip(t *testing.T) {
+
+	snapshot, err := LoadClusterSnapshot(goldenSnapshotFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.Version != ClusterSnapshotVersion || snapshot.ClusterName != "prod" || len(snapshot.Services) != 4 {
+		t.Fatalf("unexpected snapshot %v v%v with %v services", snapshot.ClusterName, snapshot.Version, len(snapshot.Services))
+	}
+
+	if web := snapshot.Services["web"]; len(web.TaskSetList) != 2 || web.TestLocationList()[0].IPv6Address != "2406:da1c:1:3::21" {
+		t.Errorf("task sets not decoded: %+v", web.TaskSetList)
+	}
+
+	// encoding what we decoded gives the file back, as the snapshot command writes it
+	snapshotBytes, err := json.MarshalIndent(snapshot, "", "  ")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, goldenSnapshotFile, append(snapshotBytes, '\n'))
+
+	decoded, err := DecodeClusterSnapshot(snapshotBytes)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, snapshot) {
+		t.Errorf("round trip changed the snapshot:\n%+v\n%+v", snapshot, decoded)
+	}
+}
+
+func TestFileDiscoveryGolden(t *testing.T) {
+
+	descrMap, err := NewFileDiscovery(goldenSnapshotFile).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer, err := RenderUpstreams("../data/upstreams.conf.tmpl", descrMap, UpstreamOptions{
+		LocalZone:      "ap-southeast-2a",
+		ZoneMinHealthy: 1,
+		AddressFamily:  AddressFamilyIPv4,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkGolden(t, "testdata/cluster-snapshot.upstreams.conf", buffer.Bytes())
+}
+
+func TestDecodeClusterSnapshot(t *testing.T) {
+
+	// a bare services map, as returned by /api/services
+	snapshot, err := DecodeClusterSnapshot([]byte(`{"web": {"ServiceName": "web", "LocationList": [{"PrivateIPAddress": "10.0.0.1", "Port": 80}]}}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.Version != 0 || len(snapshot.Services["web"].LocationList) != 1 {
+		t.Errorf("bare services map not decoded: %+v", snapshot)
+	}
+
+	if _, err := DecodeClusterSnapshot([]byte(`{"Version": 99, "Services": {}}`)); err == nil || !strings.Contains(err.Error(), "Unsupported snapshot version 99") {
+		t.Errorf("expected a newer version to be rejected, got %v", err)
+	}
+
+	if _, err := DecodeClusterSnapshot([]byte(`[]`)); err == nil {
+		t.Error("expected invalid JSON to be rejected")
+	}
+}
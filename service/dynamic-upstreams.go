@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+)
+
+// how a new configuration reaches nginx. Besides reload, the strategies push the server lists of the upstreams
+// to the running nginx when only they changed, and reload for anything else.
+const (
+	ApplyStrategyReload    = "reload"
+	ApplyStrategyOpenResty = "openresty"
+	ApplyStrategyNginxPlus = "nginx-plus"
+)
+
+// DynamicUpstreamsFileName the server lists loaded by the ecs_ingress Lua module when nginx starts or reloads,
+// written next to the rendered upstreams
+const DynamicUpstreamsFileName = "upstreams.json"
+
+// OpenRestyModule the Lua module the upstreams of an openresty template balance through
+const OpenRestyModule = "ecs_ingress"
+
+// NewUpstreamAPI returns the client pushing server lists for the configured apply strategy, nil for reload
+func NewUpstreamAPI(cfg *shared.Config) util.UpstreamAPI {
+
+	switch cfg.Nginx.ApplyStrategy {
+	case ApplyStrategyOpenResty:
+		return util.NewOpenRestyClient(cfg.Nginx.DynamicUpstreamsURL)
+	case ApplyStrategyNginxPlus:
+		return util.NewNginxPlusClient(cfg.Nginx.DynamicUpstreamsURL)
+	}
+
+	return nil
+}
+
+// CheckApplyStrategy returns an error when nginx can't take the pushes of the apply strategy. The openresty one needs
+// nginx built with Lua, which the stock nginx:stable-alpine image isn't.
+func CheckApplyStrategy(cfg *shared.Config) error {
+
+	if cfg.Nginx.ApplyStrategy != ApplyStrategyOpenResty {
+		return nil
+	}
+
+	output, err := exec.Command(cfg.Nginx.Binary, "-V").CombinedOutput()
+
+	if err != nil {
+		return fmt.Errorf("Unable to run %v -V: %v", cfg.Nginx.Binary, err)
+	}
+
+	if !strings.Contains(string(output), "lua") {
+		return fmt.Errorf("%v is not built with Lua, the %v apply strategy needs OpenResty", cfg.Nginx.Binary, ApplyStrategyOpenResty)
+	}
+
+	return nil
+}
+
+// templateTakesPushes returns false when the rendered skeleton can't use pushed server lists: with the openresty
+// strategy, a template not balancing through the Lua module (e.g. the stock one) keeps its rendered servers
+func templateTakesPushes(applyStrategy string, skeleton []byte) bool {
+	return applyStrategy != ApplyStrategyOpenResty || bytes.Contains(skeleton, []byte(OpenRestyModule))
+}
+
+// UpstreamServerSets the server lists of the upstreams of the default template: one per upstream, plus a
+// <upstream>.test one for the services with task sets
+func UpstreamServerSets(upstreamMap map[string]EcsServiceDescr) map[string][]util.UpstreamServer {
+
+	retMap := make(map[string][]util.UpstreamServer)
+
+	for name, descr := range upstreamMap {
+
+		retMap[name] = upstreamServers(descr.LocationList)
+
+		if len(descr.TaskSetList) > 0 {
+			retMap[name+TestUpstreamSuffix] = upstreamServers(descr.TestLocationList())
+		}
+	}
+
+	return retMap
+}
+
+// StripServers returns the upstreams without their servers. Rendered, they only change with the structure of
+// the upstreams, telling changes nginx must reload for from those a server list update is enough for.
+func StripServers(upstreamMap map[string]EcsServiceDescr) map[string]EcsServiceDescr {
+
+	retMap := make(map[string]EcsServiceDescr)
+
+	for name, descr := range upstreamMap {
+
+		descr.LocationList = make([]EcsServiceIPPort, 0)
+
+		taskSetList := make([]EcsTaskSetDescr, 0, len(descr.TaskSetList))
+
+		for _, taskSet := range descr.TaskSetList {
+			taskSet.LocationList = make([]EcsServiceIPPort, 0)
+			taskSetList = append(taskSetList, taskSet)
+		}
+
+		descr.TaskSetList = taskSetList
+		retMap[name] = descr
+	}
+
+	return retMap
+}
+
+func upstreamServers(locationList []EcsServiceIPPort) []util.UpstreamServer {
+
+	retList := make([]util.UpstreamServer, 0, len(locationList))
+
+	for _, location := range locationList {
+
+		address := location.Address
+
+		if address == "" {
+			address = location.PrivateIPAddress
+		}
+
+		retList = append(retList, util.UpstreamServer{
+			Address: address,
+			Port:    location.Port,
+			Server:  location.Server(),
+			Weight:  location.Weight,
+			Backup:  location.Backup,
+			Down:    location.Down,
+		})
+	}
+
+	return retList
+}
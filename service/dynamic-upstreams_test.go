@@ -0,0 +1,263 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+)
+
+func TestQueryAndUpdateOpenResty(t *testing.T) {
+
+	pushList := make([]map[string][]util.UpstreamServer, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		upstreamMap := make(map[string][]util.UpstreamServer)
+
+		if err := json.NewDecoder(r.Body).Decode(&upstreamMap); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		pushList = append(pushList, upstreamMap)
+	}))
+	defer server.Close()
+
+	f := newRevProxyFixture(t)
+	f.cfg.Nginx.ApplyStrategy = ApplyStrategyOpenResty
+	f.cfg.Nginx.DynamicUpstreamsURL = server.URL
+	f.revProxyService.upstreamAPI = NewUpstreamAPI(f.cfg)
+	f.useTemplate("../data/upstreams-openresty.conf.tmpl")
+
+	instance := f.cluster.AddInstance("10.0.0.1", "")
+	f.cluster.AddService("web")
+	f.cluster.AddTask("web", instance, 32768, 80)
+
+	f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("first QueryAndUpdate failed: %v", err)
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 1 || len(pushList) != 0 {
+		t.Errorf("expected the first configuration to be reloaded, got %v reloads and %v pushes", calls, len(pushList))
+	}
+
+	// a new task only changes the server lists
+	f.cluster.AddTask("web", instance, 32769, 80)
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("QueryAndUpdate failed: %v", err)
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 1 || len(pushList) != 1 || len(pushList[0]["web"]) != 2 {
+		t.Fatalf("expected the servers to be pushed without a reload, got %v reloads and %+v", calls, pushList)
+	}
+
+	if serverSets := f.readConfig(DynamicUpstreamsFileName); !strings.Contains(serverSets, "10.0.0.1:32769") {
+		t.Errorf("expected the server lists to be written for the next reload:\n%v", serverSets)
+	}
+
+	// a new upstream needs a reload
+	f.cluster.AddService("api")
+	f.cluster.AddTask("api", instance, 32770, 80)
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("QueryAndUpdate failed: %v", err)
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 2 || len(pushList) != 1 {
+		t.Errorf("expected a reload for the new upstream, got %v reloads and %v pushes", calls, len(pushList))
+	}
+}
+
+func TestQueryAndUpdateOpenRestyStockTemplate(t *testing.T) {
+
+	pushCount := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushCount++
+	}))
+	defer server.Close()
+
+	// the stock template renders the servers, pushing them would change nothing
+	f := newRevProxyFixture(t)
+	f.cfg.Nginx.ApplyStrategy = ApplyStrategyOpenResty
+	f.cfg.Nginx.DynamicUpstreamsURL = server.URL
+	f.revProxyService.upstreamAPI = NewUpstreamAPI(f.cfg)
+
+	instance := f.cluster.AddInstance("10.0.0.1", "")
+	f.cluster.AddService("web")
+	f.cluster.AddTask("web", instance, 32768, 80)
+
+	f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	for i := 0; i < 2; i++ {
+
+		if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+			t.Fatalf("QueryAndUpdate failed: %v", err)
+		}
+
+		f.cluster.AddTask("web", instance, 32769, 80)
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 2 || pushCount != 0 {
+		t.Errorf("expected every change to be reloaded, got %v reloads and %v pushes", calls, pushCount)
+	}
+
+	if upstreams := f.readConfig("upstreams.conf"); !strings.Contains(upstreams, "server 10.0.0.1:32769;") {
+		t.Errorf("new server not rendered:\n%v", upstreams)
+	}
+}
+
+func TestCheckApplyStrategy(t *testing.T) {
+
+	binFolder := t.TempDir()
+
+	cfg := &shared.Config{}
+	cfg.Nginx.ApplyStrategy = ApplyStrategyOpenResty
+
+	tests := []struct {
+		version string
+		valid   bool
+	}{
+		{"nginx version: nginx/1.24.0\nconfigure arguments: --with-http_ssl_module", false},
+		{"nginx version: openresty/1.21.4.3\nconfigure arguments: --add-module=../ngx_lua-0.10.26", true},
+	}
+
+	for i, test := range tests {
+
+		cfg.Nginx.Binary = filepath.Join(binFolder, fmt.Sprintf("nginx-%v", i))
+
+		if err := ioutil.WriteFile(cfg.Nginx.Binary, []byte(fmt.Sprintf("#!/bin/sh\necho '%v' >&2\n", test.version)), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := CheckApplyStrategy(cfg); (err == nil) != test.valid {
+			t.Errorf("%v: expected valid %v, got %v", test.version, test.valid, err)
+		}
+	}
+
+	// nothing to check with reloads
+	cfg.Nginx.ApplyStrategy = ApplyStrategyReload
+	cfg.Nginx.Binary = filepath.Join(binFolder, "missing")
+
+	if err := CheckApplyStrategy(cfg); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// fakeNginxPlus the servers of the upstreams of the nginx Plus API, and the calls changing them
+type fakeNginxPlus struct {
+	lock        sync.Mutex
+	nextID      int64
+	upstreamMap map[string][]util.NginxPlusServer
+	callList    []string
+}
+
+func (n *fakeNginxPlus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// /api/http/upstreams/{name}/servers[/{id}]
+	partList := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/http/upstreams/"), "/")
+	upstreamName := partList[0]
+	serverList, found := n.upstreamMap[upstreamName]
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(serverList)
+		return
+	}
+
+	n.callList = append(n.callList, r.Method)
+
+	body, _ := ioutil.ReadAll(r.Body)
+	payload := util.NginxPlusServer{}
+	json.Unmarshal(body, &payload)
+
+	if r.Method == "POST" {
+		n.nextID++
+		payload.ID = n.nextID
+		n.upstreamMap[upstreamName] = append(serverList, payload)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	id, _ := strconv.ParseInt(partList[2], 10, 64)
+	retList := make([]util.NginxPlusServer, 0)
+
+	for _, server := range serverList {
+
+		if server.ID != id {
+			retList = append(retList, server)
+			continue
+		}
+
+		if r.Method == "PATCH" {
+			server.Weight = payload.Weight
+			server.Down = payload.Down
+			retList = append(retList, server)
+		}
+	}
+
+	n.upstreamMap[upstreamName] = retList
+}
+
+func TestNginxPlusClient(t *testing.T) {
+
+	api := &fakeNginxPlus{
+		nextID: 2,
+		upstreamMap: map[string][]util.NginxPlusServer{
+			"web": {
+				{ID: 1, Server: "10.0.0.1:32768", Weight: 1},
+				{ID: 2, Server: "10.0.0.1:32769", Weight: 1},
+			},
+		},
+	}
+
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := util.NewNginxPlusClient(server.URL + "/api/")
+
+	err := client.UpdateUpstreams(map[string][]util.UpstreamServer{
+		"web": {
+			{Server: "10.0.0.1:32768", Weight: 1, Down: true},
+			{Server: "10.0.0.2:32770", Weight: 2},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("UpdateUpstreams failed: %v", err)
+	}
+
+	expected := "[{ID:1 Server:10.0.0.1:32768 Weight:1 Backup:false Down:true} {ID:3 Server:10.0.0.2:32770 Weight:2 Backup:false Down:false}]"
+
+	if servers := fmt.Sprintf("%+v", api.upstreamMap["web"]); servers != expected {
+		t.Errorf("expected %v, got %v", expected, servers)
+	}
+
+	if calls := strings.Join(api.callList, " "); calls != "PATCH POST DELETE" {
+		t.Errorf("expected the new servers added before the old ones removed, got %v", calls)
+	}
+
+	if err := client.UpdateUpstreams(map[string][]util.UpstreamServer{"api": {}}); err == nil {
+		t.Error("expected an unknown upstream to fail")
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"bitbucket.org/nnnco/rev-proxy/shared"
 	"bitbucket.org/nnnco/rev-proxy/util"
+	"github.com/rs/zerolog/log"
 )
 
 // EcsServiceDescr blah blah
@@ -13,29 +14,73 @@ type EcsServiceDescr struct {
 	ClusterName  string
 	ServiceArn   string
 	ServiceName  string
+	Tags         map[string]string
 	LocationList []EcsServiceIPPort
+	TaskSetList  []EcsTaskSetDescr
 }
 
-// EcsServiceIPPort blah blah
+// task set statuses. Only the PRIMARY task set gets production traffic.
+const (
+	TaskSetPrimary  = "PRIMARY"
+	TaskSetActive   = "ACTIVE"
+	TaskSetDraining = "DRAINING"
+)
+
+// EcsTaskSetDescr a task set of a service deployed by CodeDeploy or an external controller
+type EcsTaskSetDescr struct {
+	ID           string
+	Status       string
+	Scale        float64
+	LocationList []EcsServiceIPPort
+}
+
+// TestLocationList the tasks of the ACTIVE task sets, e.g. the green deployment before traffic is shifted to it
+func (d EcsServiceDescr) TestLocationList() []EcsServiceIPPort {
+
+	retList := make([]EcsServiceIPPort, 0)
+
+	for _, taskSet := range d.TaskSetList {
+		if taskSet.Status == TaskSetActive {
+			retList = append(retList, taskSet.LocationList...)
+		}
+	}
+
+	return retList
+}
+
+// EcsServiceIPPort blah blah. Address is the one nginx connects to, chosen by SelectAddresses.
 type EcsServiceIPPort struct {
 	TaskArn          string
 	PublicIPAddress  string
 	PrivateIPAddress string
+	IPv6Address      string
+	Address          string
 	Port             int64
+	HealthStatus     string
+	AvailabilityZone string
+	SubnetID         string
+	Weight           int64
+	Backup           bool
+	Down             bool
 }
 
 // EcsService simplified client to access ECS resources on AWS
 type EcsService struct {
-	ecsClient *util.EcsClient
-	ec2Client *util.Ec2Client
+	ecsClient util.EcsAPI
+	ec2Client util.Ec2API
 }
 
 // NewEcsService Creates a new ecs client
-func NewEcsService(cfg *shared.Config) *EcsService {
+func NewEcsService(cfg *shared.Config, awsSessions *util.AWSSessions) *EcsService {
+	return NewEcsServiceWithClients(util.NewEcsClient(cfg, awsSessions.Discovery()), util.NewEc2Client(cfg, awsSessions.Discovery()))
+}
+
+// NewEcsServiceWithClients Creates a new ecs service on top of the given clients
+func NewEcsServiceWithClients(ecsClient util.EcsAPI, ec2Client util.Ec2API) *EcsService {
 
 	ret := &EcsService{
-		ecsClient: util.NewEcsClient(cfg),
-		ec2Client: util.NewEc2Client(cfg),
+		ecsClient: ecsClient,
+		ec2Client: ec2Client,
 	}
 
 	return ret
@@ -49,21 +94,65 @@ func (e *EcsService) GetServicesAndPorts(clusterName string) (map[string]EcsServ
 	// maps a ec2 instance id to an ec2 instance networking info
 	ec2InstanceCache := make(map[string]util.Ec2Instance)
 
+	// maps a task definition arn to its container port, awsvpc tasks only report their address
+	taskDefinitionPortCache := make(map[string]int64)
+
 	serviceArnList, err := e.ecsClient.ListServices(clusterName)
 
 	if err != nil {
 		return nil, err
 	}
 
+	// the tags group services into upstreams (see GroupUpstreams), the task sets split blue and green tasks
+	serviceInfoMap := make(map[string]util.EcsServiceInfo)
+
+	for start := 0; start < len(serviceArnList); start += 10 {
+
+		end := start + 10
+
+		if end > len(serviceArnList) {
+			end = len(serviceArnList)
+		}
+
+		tmpInfoList, err := e.ecsClient.DescribeServices(clusterName, serviceArnList[start:end])
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, serviceInfo := range tmpInfoList {
+			serviceInfoMap[serviceInfo.ServiceArn] = serviceInfo
+		}
+	}
+
 	for _, serviceArn := range serviceArnList {
 
 		serviceNameList := strings.Split(serviceArn, "/")
 
+		serviceInfo := serviceInfoMap[serviceArn]
+
 		ecsServiceDescr := EcsServiceDescr{
 			ClusterName:  clusterName,
 			ServiceName:  serviceNameList[len(serviceNameList)-1],
 			ServiceArn:   serviceArn,
+			Tags:         serviceInfo.Tags,
 			LocationList: make([]EcsServiceIPPort, 0),
+			TaskSetList:  make([]EcsTaskSetDescr, 0),
+		}
+
+		// tasks are started by their task set
+		taskSetIndexMap := make(map[string]int)
+
+		for index, taskSet := range serviceInfo.TaskSetList {
+
+			taskSetIndexMap[taskSet.ID] = index
+
+			ecsServiceDescr.TaskSetList = append(ecsServiceDescr.TaskSetList, EcsTaskSetDescr{
+				ID:           taskSet.ID,
+				Status:       taskSet.Status,
+				Scale:        taskSet.Scale,
+				LocationList: make([]EcsServiceIPPort, 0),
+			})
 		}
 
 		// for each service we query the tasks
@@ -88,42 +177,103 @@ func (e *EcsService) GetServicesAndPorts(clusterName string) (map[string]EcsServ
 				continue
 			}
 
-			// we determine the EC2 instance
-			containerInstance, err := e.ecsClient.DescribeContainerInstance(clusterName, taskDescr.InstanceArn)
+			var ec2Instance util.Ec2Instance
 
-			if err != nil {
-				return nil, err
+			// Fargate tasks run on no container instance
+			if taskDescr.InstanceArn != "" {
+
+				// we determine the EC2 instance
+				containerInstance, err := e.ecsClient.DescribeContainerInstance(clusterName, taskDescr.InstanceArn)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if containerInstance == nil {
+					return nil, fmt.Errorf("No container instance with arn %v - unable to proceed", taskDescr.InstanceArn)
+				}
+
+				var found bool
+
+				ec2Instance, found = ec2InstanceCache[containerInstance.Ec2InstanceID]
+
+				// caching
+				if !found {
+
+					localEc2Instance, err := e.ec2Client.DescribeInstance(containerInstance.Ec2InstanceID)
+
+					if err != nil {
+						return nil, err
+					}
+
+					if localEc2Instance == nil {
+						return nil, fmt.Errorf("No ec2 instance with ID %v - unable to proceed", containerInstance.Ec2InstanceID)
+					}
+
+					ec2InstanceCache[containerInstance.Ec2InstanceID] = *localEc2Instance
+					ec2Instance = *localEc2Instance
+				}
 			}
 
-			if containerInstance == nil {
-				return nil, fmt.Errorf("No container instance with arn %v - unable to proceed", taskDescr.InstanceArn)
+			location := EcsServiceIPPort{
+				TaskArn:          taskArn,
+				PrivateIPAddress: ec2Instance.PrivateIPAddress,
+				PublicIPAddress:  ec2Instance.PublicIPAddress,
+				IPv6Address:      ec2Instance.IPv6Address,
+				Port:             taskDescr.HostPort,
+				HealthStatus:     taskDescr.HealthStatus,
+				AvailabilityZone: taskDescr.AvailabilityZone,
+				SubnetID:         ec2Instance.SubnetID,
 			}
 
-			ec2Instance, found := ec2InstanceCache[containerInstance.Ec2InstanceID]
+			// ECS reports the zone of every task, Fargate ones included
+			if location.AvailabilityZone == "" {
+				location.AvailabilityZone = ec2Instance.AvailabilityZone
+			}
 
-			// caching
-			if !found {
+			// awsvpc tasks are reached on the addresses of their ENI and their container port
+			if taskDescr.HostPort == 0 {
 
-				localEc2Instance, err := e.ec2Client.DescribeInstance(containerInstance.Ec2InstanceID)
+				port, err := e.taskDefinitionPort(taskDescr, taskDefinitionPortCache)
 
 				if err != nil {
 					return nil, err
 				}
 
-				if localEc2Instance == nil {
-					return nil, fmt.Errorf("No ec2 instance with ID %v - unable to proceed", containerInstance.Ec2InstanceID)
+				if port == 0 {
+					log.Debug().Msgf("Task '%v' of service '%v' exposes no port. Ignoring it", taskArn, ecsServiceDescr.ServiceName)
+					continue
 				}
 
-				ec2InstanceCache[containerInstance.Ec2InstanceID] = *localEc2Instance
-				ec2Instance = *localEc2Instance
+				location.PrivateIPAddress = taskDescr.PrivateIPv4Address
+				location.PublicIPAddress = ""
+				location.IPv6Address = taskDescr.IPv6Address
+				location.Port = port
+
+				if taskDescr.SubnetID != "" {
+					location.SubnetID = taskDescr.SubnetID
+				}
 			}
 
-			ecsServiceDescr.LocationList = append(ecsServiceDescr.LocationList, EcsServiceIPPort{
-				TaskArn:          taskArn,
-				PrivateIPAddress: ec2Instance.PrivateIPAddress,
-				PublicIPAddress:  ec2Instance.PublicIPAddress,
-				Port:             taskDescr.HostPort,
-			})
+			if len(taskSetIndexMap) == 0 {
+				ecsServiceDescr.LocationList = append(ecsServiceDescr.LocationList, location)
+				continue
+			}
+
+			index, found := taskSetIndexMap[taskDescr.StartedBy]
+
+			// most likely a task set created after we described the service, we rather not send it production traffic
+			if !found {
+				log.Debug().Msgf("Task '%v' of service '%v' belongs to no known task set. Ignoring it", taskArn, ecsServiceDescr.ServiceName)
+				continue
+			}
+
+			taskSet := &ecsServiceDescr.TaskSetList[index]
+			taskSet.LocationList = append(taskSet.LocationList, location)
+
+			if taskSet.Status == TaskSetPrimary {
+				ecsServiceDescr.LocationList = append(ecsServiceDescr.LocationList, location)
+			}
 		}
 
 		retMap[ecsServiceDescr.ServiceName] = ecsServiceDescr
@@ -131,3 +281,90 @@ func (e *EcsService) GetServicesAndPorts(clusterName string) (map[string]EcsServ
 
 	return retMap, nil
 }
+
+// taskDefinitionPort the container port of an awsvpc task, from its task definition when the task has no binding
+func (e *EcsService) taskDefinitionPort(taskDescr *util.EcsTask, cache map[string]int64) (int64, error) {
+
+	if taskDescr.ContainerPort > 0 {
+		return taskDescr.ContainerPort, nil
+	}
+
+	port, found := cache[taskDescr.TaskDefinitionArn]
+
+	if found {
+		return port, nil
+	}
+
+	port, err := e.ecsClient.DescribeTaskDefinitionPort(taskDescr.TaskDefinitionArn)
+
+	if err != nil {
+		return 0, err
+	}
+
+	cache[taskDescr.TaskDefinitionArn] = port
+
+	return port, nil
+}
+
+// GetServiceInstances returns the EC2 instances running the tasks of a service
+func (e *EcsService) GetServiceInstances(clusterName string, serviceName string) ([]util.Ec2Instance, error) {
+
+	retList := make([]util.Ec2Instance, 0)
+
+	taskArnList, err := e.ecsClient.ListServiceTasks(clusterName, serviceName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	containerInstanceArnList := make([]string, 0)
+
+	for start := 0; start < len(taskArnList); start += 100 {
+
+		end := start + 100
+
+		if end > len(taskArnList) {
+			end = len(taskArnList)
+		}
+
+		tmpArnList, err := e.ecsClient.DescribeTaskContainerInstances(clusterName, taskArnList[start:end])
+
+		if err != nil {
+			return nil, err
+		}
+
+		containerInstanceArnList = append(containerInstanceArnList, tmpArnList...)
+	}
+
+	// a daemon runs once per instance but we make sure of it
+	seenInstanceIDs := make(map[string]bool)
+
+	for _, containerInstanceArn := range containerInstanceArnList {
+
+		containerInstance, err := e.ecsClient.DescribeContainerInstance(clusterName, containerInstanceArn)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if containerInstance == nil || seenInstanceIDs[containerInstance.Ec2InstanceID] {
+			continue
+		}
+
+		seenInstanceIDs[containerInstance.Ec2InstanceID] = true
+
+		ec2Instance, err := e.ec2Client.DescribeInstance(containerInstance.Ec2InstanceID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ec2Instance == nil {
+			continue
+		}
+
+		retList = append(retList, *ec2Instance)
+	}
+
+	return retList, nil
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+)
+
+func newFakeEcsService(cluster *fakeaws.Cluster) *EcsService {
+
+	cfg := &shared.Config{}
+
+	return NewEcsServiceWithClients(
+		util.NewEcsClientFromAPI(cfg, fakeaws.NewECS(cluster)),
+		util.NewEc2ClientFromAPI(cfg, fakeaws.NewEC2(cluster)),
+	)
+}
+
+func locationAddresses(descr EcsServiceDescr) []string {
+
+	retList := make([]string, 0)
+
+	for _, location := range descr.LocationList {
+		retList = append(retList, location.PrivateIPAddress+":"+strconv.FormatInt(location.Port, 10))
+	}
+
+	sort.Strings(retList)
+
+	return retList
+}
+
+func TestGetServicesAndPorts(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instanceA := cluster.AddInstance("10.0.0.1", "54.0.0.1")
+	instanceB := cluster.AddInstance("10.0.0.2", "")
+
+	cluster.AddService("web")
+	cluster.AddService("api")
+	cluster.AddService("idle")
+
+	cluster.AddTask("web", instanceA, 32768, 80)
+	cluster.AddTask("web", instanceB, 32769, 80)
+	cluster.AddTask("api", instanceA, 32770, 8080)
+
+	descrMap, err := newFakeEcsService(cluster).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	if len(descrMap) != 3 {
+		t.Fatalf("expected 3 services, got %v", len(descrMap))
+	}
+
+	if got := locationAddresses(descrMap["web"]); len(got) != 2 || got[0] != "10.0.0.1:32768" || got[1] != "10.0.0.2:32769" {
+		t.Errorf("unexpected web locations %v", got)
+	}
+
+	if got := locationAddresses(descrMap["api"]); len(got) != 1 || got[0] != "10.0.0.1:32770" {
+		t.Errorf("unexpected api locations %v", got)
+	}
+
+	if len(descrMap["idle"].LocationList) != 0 {
+		t.Errorf("expected no idle locations, got %v", descrMap["idle"].LocationList)
+	}
+
+	web := descrMap["web"]
+
+	if web.ClusterName != "prod" || web.ServiceArn == "" || web.LocationList[0].HealthStatus != "HEALTHY" {
+		t.Errorf("unexpected web description %+v", web)
+	}
+
+	if web.LocationList[0].PublicIPAddress != "54.0.0.1" {
+		t.Errorf("expected the public address of the instance, got '%v'", web.LocationList[0].PublicIPAddress)
+	}
+
+	// instances are described once per discovery
+	if calls := cluster.CallCount("DescribeInstances"); calls != 2 {
+		t.Errorf("expected 2 DescribeInstances calls, got %v", calls)
+	}
+}
+
+func TestGetServicesAndPortsPagination(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	cluster.PageSize = 2
+
+	instance := cluster.AddInstance("10.0.0.1", "")
+
+	for _, serviceName := range []string{"a", "b", "c", "d", "e"} {
+		cluster.AddService(serviceName)
+	}
+
+	for port := int64(1); port <= 5; port++ {
+		cluster.AddTask("c", instance, 30000+port, 80)
+	}
+
+	descrMap, err := newFakeEcsService(cluster).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	if len(descrMap) != 5 {
+		t.Errorf("expected 5 services across pages, got %v", len(descrMap))
+	}
+
+	if len(descrMap["c"].LocationList) != 5 {
+		t.Errorf("expected 5 tasks across pages, got %v", len(descrMap["c"].LocationList))
+	}
+
+	if calls := cluster.CallCount("ListServices"); calls != 3 {
+		t.Errorf("expected 3 ListServices pages, got %v", calls)
+	}
+}
+
+func TestGetServicesAndPortsThrottling(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instance := cluster.AddInstance("10.0.0.1", "")
+	cluster.AddService("web")
+	cluster.AddTask("web", instance, 32768, 80)
+
+	ecsService := newFakeEcsService(cluster)
+
+	cluster.Throttle("ListTasks", 1)
+
+	if _, err := ecsService.GetServicesAndPorts("prod"); err == nil {
+		t.Fatal("expected the throttling error to surface")
+	}
+
+	descrMap, err := ecsService.GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("expected the next discovery to succeed, got %v", err)
+	}
+
+	if len(descrMap["web"].LocationList) != 1 {
+		t.Errorf("expected 1 web location, got %v", len(descrMap["web"].LocationList))
+	}
+}
+
+func TestGetServicesAndPortsEventualConsistency(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instance := cluster.AddInstance("10.0.0.1", "")
+	cluster.AddService("web")
+	cluster.AddTask("web", instance, 32768, 80)
+
+	// the new task is listed before it can be described
+	cluster.SetDescribeLag(1)
+	cluster.AddTask("web", instance, 32769, 80)
+
+	ecsService := newFakeEcsService(cluster)
+
+	descrMap, err := ecsService.GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("a task missing from DescribeTasks must not fail the discovery: %v", err)
+	}
+
+	if len(descrMap["web"].LocationList) != 1 {
+		t.Errorf("expected the lagging task to be skipped, got %v locations", len(descrMap["web"].LocationList))
+	}
+
+	descrMap, _ = ecsService.GetServicesAndPorts("prod")
+
+	if len(descrMap["web"].LocationList) != 2 {
+		t.Errorf("expected the lagging task to show up, got %v locations", len(descrMap["web"].LocationList))
+	}
+}
+
+func TestGetServicesAndPortsTaskSets(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instance := cluster.AddInstance("10.0.0.1", "")
+	cluster.AddService("api")
+
+	blue := cluster.AddTaskSet("api", TaskSetPrimary, 100)
+	green := cluster.AddTaskSet("api", TaskSetActive, 100)
+
+	cluster.AddTaskSetTask(blue, instance, 32768, 8080)
+	cluster.AddTaskSetTask(blue, instance, 32769, 8080)
+	cluster.AddTaskSetTask(green, instance, 32770, 8080)
+
+	// started by a task set we haven't seen yet
+	cluster.AddTask("api", instance, 32771, 8080)
+
+	ecsService := newFakeEcsService(cluster)
+
+	descrMap, err := ecsService.GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	api := descrMap["api"]
+
+	if got := locationAddresses(api); len(got) != 2 || got[0] != "10.0.0.1:32768" || got[1] != "10.0.0.1:32769" {
+		t.Errorf("only the PRIMARY task set must get production traffic, got %v", got)
+	}
+
+	if testList := api.TestLocationList(); len(testList) != 1 || testList[0].Port != 32770 {
+		t.Errorf("unexpected test locations %+v", testList)
+	}
+
+	if len(api.TaskSetList) != 2 || api.TaskSetList[1].ID != green.ID || api.TaskSetList[1].Scale != 100 {
+		t.Errorf("unexpected task sets %+v", api.TaskSetList)
+	}
+
+	// CodeDeploy shifts the traffic
+	cluster.SetTaskSetStatus(green, TaskSetPrimary)
+	cluster.SetTaskSetStatus(blue, TaskSetDraining)
+
+	descrMap, _ = ecsService.GetServicesAndPorts("prod")
+
+	if got := locationAddresses(descrMap["api"]); len(got) != 1 || got[0] != "10.0.0.1:32770" {
+		t.Errorf("expected the green tasks after the shift, got %v", got)
+	}
+
+	if testList := descrMap["api"].TestLocationList(); len(testList) != 0 {
+		t.Errorf("draining task sets are not test locations, got %+v", testList)
+	}
+}
+
+func TestGetServiceInstances(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instanceA := cluster.AddInstance("10.0.0.1", "")
+	instanceB := cluster.AddInstance("10.0.0.2", "")
+	cluster.AddService("ecs-ingress")
+	cluster.AddTask("ecs-ingress", instanceA, 80, 80)
+	cluster.AddTask("ecs-ingress", instanceB, 80, 80)
+	cluster.AddTask("ecs-ingress", instanceB, 81, 80)
+
+	instanceList, err := newFakeEcsService(cluster).GetServiceInstances("prod", "ecs-ingress")
+
+	if err != nil {
+		t.Fatalf("GetServiceInstances failed: %v", err)
+	}
+
+	if len(instanceList) != 2 {
+		t.Errorf("expected 2 distinct instances, got %v", len(instanceList))
+	}
+}
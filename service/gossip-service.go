@@ -0,0 +1,260 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/hashicorp/memberlist"
+	"github.com/rs/zerolog/log"
+)
+
+// DiscoverySnapshot a discovery result shared by the leader with its peers
+type DiscoverySnapshot struct {
+	From         string
+	DiscoveredAt time.Time
+	Services     map[string]EcsServiceDescr
+}
+
+// GossipService forms a cluster with the other ingress daemons to elect a leader and share discovery
+type GossipService struct {
+	cfg        *shared.Config
+	ecsService *EcsService
+	list       *memberlist.Memberlist
+
+	lock     sync.RWMutex
+	snapshot *DiscoverySnapshot
+}
+
+// NewGossipService Creates a new gossip service
+func NewGossipService(cfg *shared.Config, ecsService *EcsService) *GossipService {
+
+	ret := &GossipService{
+		cfg:        cfg,
+		ecsService: ecsService,
+	}
+
+	return ret
+}
+
+// Enabled returns true when gossip has been configured
+func (g *GossipService) Enabled() bool {
+	return g.cfg.Gossip.Enabled
+}
+
+// Start creates the local member and keeps joining the peers found in the daemon service
+func (g *GossipService) Start() error {
+
+	if err := g.create(); err != nil {
+		return err
+	}
+
+	go g.joinLoop()
+
+	return nil
+}
+
+// create starts the local member, without any peer yet
+func (g *GossipService) create() error {
+
+	// anyone reaching the port could otherwise inject discovery snapshots
+	if g.cfg.Gossip.SecretKey == "" {
+		return fmt.Errorf("Refusing to start gossip without a secret key")
+	}
+
+	secretKey, err := base64.StdEncoding.DecodeString(g.cfg.Gossip.SecretKey)
+
+	if err != nil {
+		return fmt.Errorf("Invalid gossip secret key: %v", err)
+	}
+
+	memberlistConfig := memberlist.DefaultLANConfig()
+	memberlistConfig.BindPort = g.cfg.Gossip.BindPort
+	memberlistConfig.AdvertiseAddr = g.cfg.Gossip.AdvertiseAddr
+	memberlistConfig.AdvertisePort = g.advertisePort()
+	memberlistConfig.SecretKey = secretKey
+	memberlistConfig.Delegate = g
+	memberlistConfig.Logger = stdlog.New(ioutil.Discard, "", 0)
+
+	if g.cfg.Gossip.NodeName != "" {
+		memberlistConfig.Name = g.cfg.Gossip.NodeName
+	}
+
+	list, err := memberlist.Create(memberlistConfig)
+
+	if err != nil {
+		return fmt.Errorf("Unable to start gossip: %v", err)
+	}
+
+	g.list = list
+
+	log.Info().Msgf("Gossip service START as '%v' on port %v, advertising %v", memberlistConfig.Name, memberlistConfig.BindPort, list.LocalNode().Address())
+
+	return nil
+}
+
+// advertisePort the port peers reach us on, the bind port unless behind a port mapping
+func (g *GossipService) advertisePort() int {
+
+	if g.cfg.Gossip.AdvertisePort > 0 {
+		return g.cfg.Gossip.AdvertisePort
+	}
+
+	return g.cfg.Gossip.BindPort
+}
+
+// joinLoop periodically joins the instances running the daemon service, so that new hosts and
+// partitions are picked up
+func (g *GossipService) joinLoop() {
+
+	for {
+
+		instanceList, err := g.ecsService.GetServiceInstances(g.cfg.AWS.ClusterName, g.cfg.AWS.DaemonServiceName)
+
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to list gossip seeds")
+		} else {
+
+			seedList := make([]string, 0)
+
+			for _, instance := range instanceList {
+				seedList = append(seedList, instance.PrivateIPAddress+":"+strconv.Itoa(g.advertisePort()))
+			}
+
+			if joined, err := g.list.Join(seedList); err != nil && joined == 0 {
+				log.Warn().Err(err).Msg("Unable to join any gossip peer")
+			}
+		}
+
+		log.Debug().Msgf("Gossip members: %v, leader: '%v'", g.list.NumMembers(), g.LeaderName())
+
+		time.Sleep(g.cfg.Current().Gossip.JoinInterval)
+	}
+}
+
+// IsLeader returns true when this daemon should run the cluster-wide singleton jobs.
+// Without gossip every daemon is its own leader.
+func (g *GossipService) IsLeader() bool {
+
+	if g.list == nil {
+		return true
+	}
+
+	return g.LeaderName() == g.list.LocalNode().Name
+}
+
+// LeaderName the alive member with the lowest name leads
+func (g *GossipService) LeaderName() string {
+
+	if g.list == nil {
+		return ""
+	}
+
+	nameList := make([]string, 0)
+
+	for _, member := range g.list.Members() {
+		nameList = append(nameList, member.Name)
+	}
+
+	sort.Strings(nameList)
+
+	return nameList[0]
+}
+
+// PublishSnapshot sends the leader's discovery result to every peer
+func (g *GossipService) PublishSnapshot(descrMap map[string]EcsServiceDescr) {
+
+	if g.list == nil || !g.IsLeader() || !g.sharesDiscovery() {
+		return
+	}
+
+	msg, err := json.Marshal(DiscoverySnapshot{
+		From:         g.list.LocalNode().Name,
+		DiscoveredAt: time.Now(),
+		Services:     descrMap,
+	})
+
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode discovery snapshot")
+		return
+	}
+
+	for _, member := range g.list.Members() {
+
+		if member.Name == g.list.LocalNode().Name {
+			continue
+		}
+
+		// snapshots easily exceed a UDP packet
+		if err := g.list.SendReliable(member, msg); err != nil {
+			log.Warn().Err(err).Msgf("Unable to send discovery snapshot to '%v'", member.Name)
+		}
+	}
+}
+
+// sharesDiscovery only the ECS discovery sees the whole cluster. The host-local and file providers see what the
+// leader's host sees, which the followers must not route to.
+func (g *GossipService) sharesDiscovery() bool {
+	provider := g.cfg.Discovery.Provider
+
+	return provider == DiscoveryProviderECS || provider == ""
+}
+
+// LatestSnapshot returns the leader's snapshot if it is recent enough to skip our own discovery
+func (g *GossipService) LatestSnapshot(now time.Time) *DiscoverySnapshot {
+
+	if g.list == nil || g.IsLeader() || !g.sharesDiscovery() {
+		return nil
+	}
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if g.snapshot == nil || g.snapshot.From != g.LeaderName() || now.Sub(g.snapshot.DiscoveredAt) > g.cfg.Current().Gossip.SnapshotMaxAge {
+		return nil
+	}
+
+	return g.snapshot
+}
+
+// NodeMeta memberlist.Delegate
+func (g *GossipService) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg memberlist.Delegate, receives the snapshots
+func (g *GossipService) NotifyMsg(msg []byte) {
+
+	snapshot := &DiscoverySnapshot{}
+
+	if err := json.Unmarshal(msg, snapshot); err != nil {
+		log.Warn().Err(err).Msg("Invalid gossip message")
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.snapshot = snapshot
+}
+
+// GetBroadcasts memberlist.Delegate
+func (g *GossipService) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
+
+// LocalState memberlist.Delegate
+func (g *GossipService) LocalState(join bool) []byte {
+	return nil
+}
+
+// MergeRemoteState memberlist.Delegate
+func (g *GossipService) MergeRemoteState(buf []byte, join bool) {
+}
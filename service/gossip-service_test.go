@@ -0,0 +1,194 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+)
+
+const testGossipKey = "bWVtYmVybGlzdC10ZXN0LWtleS0zMi1ieXRlcyEhISE="
+
+// newTestGossipService starts a loopback member on a free port, without joining anyone
+func newTestGossipService(t *testing.T, nodeName string) *GossipService {
+
+	cfg := &shared.Config{}
+	cfg.Gossip.Enabled = true
+	cfg.Gossip.NodeName = nodeName
+	cfg.Gossip.AdvertiseAddr = "127.0.0.1"
+	cfg.Gossip.SecretKey = testGossipKey
+	cfg.Gossip.SnapshotMaxAge = 30 * time.Second
+
+	ret := NewGossipService(cfg, nil)
+
+	if err := ret.create(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ret.list.Shutdown()
+	})
+
+	return ret
+}
+
+// newTestGossipCluster returns a leader and a follower that know each other
+func newTestGossipCluster(t *testing.T) (*GossipService, *GossipService) {
+
+	leader := newTestGossipService(t, "a-leader")
+	follower := newTestGossipService(t, "b-follower")
+
+	if _, err := follower.list.Join([]string{leader.list.LocalNode().Address()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !leader.IsLeader() || follower.IsLeader() || follower.LeaderName() != "a-leader" {
+		t.Fatalf("expected a-leader to lead, got '%v'", follower.LeaderName())
+	}
+
+	return leader, follower
+}
+
+// waitSnapshot polls until the follower holds a snapshot, snapshots travel over TCP in the background
+func waitSnapshot(t *testing.T, follower *GossipService) *DiscoverySnapshot {
+
+	for i := 0; i < 100; i++ {
+
+		if snapshot := follower.LatestSnapshot(time.Now()); snapshot != nil {
+			return snapshot
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("no snapshot received")
+
+	return nil
+}
+
+func TestGossipRequiresSecretKey(t *testing.T) {
+
+	cfg := &shared.Config{}
+	cfg.Gossip.Enabled = true
+
+	if err := NewGossipService(cfg, nil).create(); err == nil || !strings.Contains(err.Error(), "secret key") {
+		t.Errorf("expected gossip to refuse to start without a key, got %v", err)
+	}
+}
+
+func TestGossipSnapshotMerge(t *testing.T) {
+
+	leader, follower := newTestGossipCluster(t)
+
+	location := []EcsServiceIPPort{{PrivateIPAddress: "10.0.0.1", Port: 32768}}
+
+	// followers don't publish, and the leader never reads its own snapshot
+	follower.PublishSnapshot(map[string]EcsServiceDescr{"web": {ServiceName: "web"}})
+	leader.PublishSnapshot(map[string]EcsServiceDescr{"web": {ServiceName: "web", LocationList: location}})
+
+	snapshot := waitSnapshot(t, follower)
+
+	if snapshot.From != "a-leader" || len(snapshot.Services["web"].LocationList) != 1 {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+
+	if leader.LatestSnapshot(time.Now()) != nil {
+		t.Error("the leader must run its own discovery")
+	}
+
+	// a newer snapshot replaces the previous one
+	leader.PublishSnapshot(map[string]EcsServiceDescr{"api": {ServiceName: "api", LocationList: location}})
+
+	for i := 0; i < 100 && len(waitSnapshot(t, follower).Services["web"].LocationList) > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if snapshot := waitSnapshot(t, follower); len(snapshot.Services) != 1 || snapshot.Services["api"].ServiceName != "api" {
+		t.Errorf("expected the api snapshot, got %+v", snapshot)
+	}
+
+	// too old
+	if follower.LatestSnapshot(time.Now().Add(time.Minute)) != nil {
+		t.Error("a stale snapshot must be ignored")
+	}
+
+	// from a member that isn't leading
+	follower.NotifyMsg([]byte(`{"From":"z-other","DiscoveredAt":"` + time.Now().Format(time.RFC3339Nano) + `","Services":{}}`))
+
+	if follower.LatestSnapshot(time.Now()) != nil {
+		t.Error("a snapshot from a non-leader must be ignored")
+	}
+
+	// garbage keeps the previous snapshot
+	follower.NotifyMsg([]byte(`{"From":"a-leader","DiscoveredAt":"` + time.Now().Format(time.RFC3339Nano) + `","Services":{}}`))
+	follower.NotifyMsg([]byte("not json"))
+
+	if snapshot := follower.LatestSnapshot(time.Now()); snapshot == nil || len(snapshot.Services) != 0 {
+		t.Errorf("expected the empty leader snapshot to survive an invalid message, got %+v", snapshot)
+	}
+}
+
+func TestGossipSnapshotHostLocalProvider(t *testing.T) {
+
+	leader, follower := newTestGossipCluster(t)
+
+	// the leader's containers are of no use to the followers
+	leader.cfg.Discovery.Provider = DiscoveryProviderAgent
+	follower.cfg.Discovery.Provider = DiscoveryProviderAgent
+
+	leader.PublishSnapshot(map[string]EcsServiceDescr{"web": {ServiceName: "web"}})
+	follower.NotifyMsg([]byte(`{"From":"a-leader","DiscoveredAt":"` + time.Now().Format(time.RFC3339Nano) + `","Services":{}}`))
+
+	if follower.LatestSnapshot(time.Now()) != nil {
+		t.Error("a host-local discovery snapshot must not be used by the followers")
+	}
+}
+
+func TestGossipSnapshotApply(t *testing.T) {
+
+	leader, follower := newTestGossipCluster(t)
+
+	leaderFixture := newRevProxyFixture(t)
+	leaderFixture.revProxyService.gossipService = leader
+
+	followerFixture := newRevProxyFixture(t)
+	followerFixture.revProxyService.gossipService = follower
+
+	instance := leaderFixture.cluster.AddInstance("10.0.0.1", "")
+	leaderFixture.cluster.AddService("web")
+	leaderFixture.cluster.AddTask("web", instance, 32768, 80)
+
+	bundle := map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"}
+	leaderFixture.putBundle(bundle)
+	followerFixture.putBundle(bundle)
+
+	// the leader discovers and publishes
+	if err := leaderFixture.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	waitSnapshot(t, follower)
+
+	// the follower's own cluster is empty, its upstreams come from the leader
+	if err := followerFixture.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if upstreams := followerFixture.readConfig("upstreams.conf"); !strings.Contains(upstreams, "server 10.0.0.1:32768;") {
+		t.Errorf("leader's discovery not applied by the follower:\n%v", upstreams)
+	}
+
+	// without a fresh snapshot the follower is back to its own discovery
+	follower.lock.Lock()
+	follower.snapshot.DiscoveredAt = time.Now().Add(-time.Hour)
+	follower.lock.Unlock()
+
+	if err := followerFixture.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if upstreams := followerFixture.readConfig("upstreams.conf"); strings.Contains(upstreams, "10.0.0.1:32768") {
+		t.Errorf("stale snapshot applied:\n%v", upstreams)
+	}
+}
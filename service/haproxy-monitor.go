@@ -0,0 +1,73 @@
+package service
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"github.com/rs/zerolog/log"
+)
+
+// HAProxyMonitor runs HAProxy in master-worker mode and hands it its configuration
+type HAProxyMonitor struct {
+	*proxyProcess
+}
+
+// NewHAProxyMonitor Creates a new HAProxy monitor
+func NewHAProxyMonitor(cfg *shared.Config, metrics *shared.Metrics, notifier *Notifier) *HAProxyMonitor {
+
+	ret := &HAProxyMonitor{
+		proxyProcess: newProxyProcess(cfg, metrics, notifier, "HAProxy"),
+	}
+
+	return ret
+}
+
+// Start starts and monitor the HAProxy master process
+func (h *HAProxyMonitor) Start(wg *sync.WaitGroup) {
+
+	log.Info().Msg("HAProxy Monitor START")
+
+	mainConfPath := filepath.Join(h.cfg.Nginx.ConfigFolder, h.cfg.Nginx.MainConfigFile)
+
+	// -W master-worker, -db in the foreground
+	h.run(wg, h.cfg.Proxy.HAProxyBinary, append([]string{"-W", "-db"}, h.configArgs(mainConfPath)...)...)
+}
+
+// Stop lets the workers finish their connections, then the master exits
+func (h *HAProxyMonitor) Stop() {
+	h.stop(syscall.SIGUSR1)
+}
+
+// Reload asks the master to start new workers with the config on disk
+func (h *HAProxyMonitor) Reload() {
+	log.Info().Msg("Sending reload signal to HAProxy")
+	h.reloaded(h.signal(syscall.SIGUSR2))
+}
+
+// TestConfig Tests the HAProxy configuration
+func (h *HAProxyMonitor) TestConfig() (string, error) {
+	return h.TestConfigFile(filepath.Join(h.cfg.Nginx.ConfigFolder, h.cfg.Nginx.MainConfigFile))
+}
+
+// TestConfigFile Tests an HAProxy configuration that is not necessarily the live one
+func (h *HAProxyMonitor) TestConfigFile(mainConfPath string) (string, error) {
+	return h.testConfig(h.cfg.Proxy.HAProxyBinary, append([]string{"-c"}, h.configArgs(mainConfPath)...)...)
+}
+
+// configArgs HAProxy has no include directive: the rendered backends next to the main file are loaded after it
+func (h *HAProxyMonitor) configArgs(mainConfPath string) []string {
+	return []string{"-f", mainConfPath, "-f", filepath.Join(filepath.Dir(mainConfPath), h.cfg.Nginx.UpstreamsConfigFile)}
+}
+
+// UpstreamAPI returns the Runtime API client, nil without a runtime socket
+func (h *HAProxyMonitor) UpstreamAPI() util.UpstreamAPI {
+
+	if h.cfg.Proxy.HAProxyRuntimeSocket == "" {
+		return nil
+	}
+
+	return util.NewHAProxyRuntimeClient(h.cfg.Proxy.HAProxyRuntimeSocket)
+}
@@ -0,0 +1,271 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+)
+
+// stubHAProxy records its arguments and signals, and runs until SIGUSR1
+const stubHAProxy = `#!/bin/sh
+log="$(dirname "$0")/calls.log"
+trap 'echo reload >> "$log"' USR2
+trap 'echo stop >> "$log"; exit 0' USR1
+echo "$@" >> "$log"
+if [ "$1" = "-c" ]; then
+	exit 0
+fi
+while true; do sleep 0.05; done
+`
+
+// serverStateHeader the header of "show servers state"
+const serverStateHeader = "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord\n"
+
+// fakeRuntimeAPI answers "show servers state" with slotList, and records the other commands
+type fakeRuntimeAPI struct {
+	lock        sync.Mutex
+	slotList    []util.HAProxyServerSlot
+	commandList []string
+}
+
+func (f *fakeRuntimeAPI) serve(listener net.Listener) {
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		command, _ := bufio.NewReader(conn).ReadString('\n')
+		command = strings.TrimSpace(command)
+
+		f.lock.Lock()
+
+		if strings.HasPrefix(command, "show servers state ") {
+
+			reply := serverStateHeader
+
+			for index, slot := range f.slotList {
+				reply += fmt.Sprintf("3 %v %v %v %v 2 0 1 1 100 6 3 4 6 0 0 0 - %v -\n", strings.TrimPrefix(command, "show servers state "), index+1, slot.Name, slot.Address, slot.Port)
+			}
+
+			conn.Write([]byte(reply))
+
+		} else {
+			f.commandList = append(f.commandList, command)
+		}
+
+		f.lock.Unlock()
+		conn.Close()
+	}
+}
+
+// commands returns the commands received since the last call
+func (f *fakeRuntimeAPI) commands() string {
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	commands := strings.Join(f.commandList, "\n")
+	f.commandList = nil
+
+	return commands
+}
+
+func TestHAProxyRuntimeClient(t *testing.T) {
+
+	api := &fakeRuntimeAPI{
+		slotList: []util.HAProxyServerSlot{
+			{Name: "s0", Address: "10.0.0.1", Port: 80},
+			{Name: "s1", Address: "10.0.0.2", Port: 80},
+			{Name: "s2", Address: "127.0.0.1", Port: 1},
+			{Name: "b2", Address: "127.0.0.1", Port: 1},
+		},
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "runtime.sock"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+	go api.serve(listener)
+
+	client := util.NewHAProxyRuntimeClient(listener.Addr().String())
+
+	err = client.UpdateUpstreams(map[string][]util.UpstreamServer{
+		"web": {
+			{Address: "10.0.0.3", Port: 8080, Weight: 2},
+			{Address: "10.0.0.1", Port: 80, Down: true},
+			{Address: "10.0.1.1", Port: 80, Backup: true},
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("UpdateUpstreams failed: %v", err)
+	}
+
+	expected := strings.Join([]string{
+		"set server web/s0 weight 1",
+		"set server web/s0 state maint",
+		"set server web/s1 addr 10.0.0.3 port 8080",
+		"set server web/s1 weight 2",
+		"set server web/s1 state ready",
+		"set server web/s2 state maint",
+		"set server web/b2 addr 10.0.1.1 port 80",
+		"set server web/b2 weight 1",
+		"set server web/b2 state ready",
+	}, "\n")
+
+	if commands := api.commands(); commands != expected {
+		t.Errorf("expected\n%v\ngot\n%v", expected, commands)
+	}
+
+	// two backups don't fit, nothing must change
+	err = client.UpdateUpstreams(map[string][]util.UpstreamServer{
+		"web": {
+			{Address: "10.0.1.1", Port: 80, Backup: true},
+			{Address: "10.0.1.2", Port: 80, Backup: true},
+		},
+	})
+
+	if commands := api.commands(); err == nil || commands != "" {
+		t.Errorf("expected running out of slots to fail without changes, got %v and %v", err, commands)
+	}
+}
+
+func TestHAProxyGroupWeights(t *testing.T) {
+
+	locationList := func(count int) []EcsServiceIPPort {
+		retList := make([]EcsServiceIPPort, 0, count)
+		for index := 0; index < count; index++ {
+			retList = append(retList, EcsServiceIPPort{PrivateIPAddress: fmt.Sprintf("10.0.0.%v", index+1), Port: 80})
+		}
+		return retList
+	}
+
+	// 3000 per stable task and 1000 for the canary before scaling
+	descrMap := map[string]EcsServiceDescr{
+		"api-stable": {ServiceName: "api-stable", Tags: map[string]string{TagIngressGroup: "api", TagIngressWeight: "90"}, LocationList: locationList(3)},
+		"api-canary": {ServiceName: "api-canary", Tags: map[string]string{TagIngressGroup: "api", TagIngressWeight: "10"}, LocationList: locationList(4)[3:]},
+	}
+
+	buffer, err := RenderUpstreams("../data/haproxy-backends.cfg.tmpl", descrMap, UpstreamOptions{})
+
+	if err != nil {
+		t.Fatalf("RenderUpstreams failed: %v", err)
+	}
+
+	for _, server := range []string{"10.0.0.1:80 weight 256", "10.0.0.2:80 weight 256", "10.0.0.3:80 weight 256", "10.0.0.4:80 weight 85"} {
+		if !strings.Contains(buffer.String(), server) {
+			t.Errorf("expected '%v' in:\n%v", server, buffer.String())
+		}
+	}
+
+	api := &fakeRuntimeAPI{}
+
+	for index := 0; index < 4; index++ {
+		api.slotList = append(api.slotList, util.HAProxyServerSlot{Name: fmt.Sprintf("s%v", index), Address: fmt.Sprintf("10.0.0.%v", index+1), Port: 80})
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "runtime.sock"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+	go api.serve(listener)
+
+	serverSets := UpstreamServerSets(BuildUpstreams(descrMap, UpstreamOptions{}))
+
+	if err := util.NewHAProxyRuntimeClient(listener.Addr().String()).UpdateUpstreams(map[string][]util.UpstreamServer{"api": serverSets["api"]}); err != nil {
+		t.Fatalf("UpdateUpstreams failed: %v", err)
+	}
+
+	expected := strings.Join([]string{
+		"set server api/s0 weight 256",
+		"set server api/s0 state ready",
+		"set server api/s1 weight 256",
+		"set server api/s1 state ready",
+		"set server api/s2 weight 256",
+		"set server api/s2 state ready",
+		"set server api/s3 weight 85",
+		"set server api/s3 state ready",
+	}, "\n")
+
+	if commands := api.commands(); commands != expected {
+		t.Errorf("expected\n%v\ngot\n%v", expected, commands)
+	}
+}
+
+func TestHAProxyMonitor(t *testing.T) {
+
+	binFolder := t.TempDir()
+
+	if err := ioutil.WriteFile(filepath.Join(binFolder, "haproxy"), []byte(stubHAProxy), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &shared.Config{}
+	cfg.Proxy.Type = ProxyTypeHAProxy
+	cfg.Proxy.HAProxyBinary = filepath.Join(binFolder, "haproxy")
+	cfg.Nginx.ConfigFolder = "/app/haproxy"
+	cfg.Nginx.MainConfigFile = "haproxy.cfg"
+	cfg.Nginx.UpstreamsConfigFile = "backends.cfg"
+
+	proxy := NewProxy(cfg, shared.NewMetrics(cfg), nil)
+
+	if proxy.UpstreamAPI() != nil {
+		t.Error("expected no runtime API without a socket")
+	}
+
+	if _, err := proxy.TestConfig(); err != nil {
+		t.Fatalf("TestConfig failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go proxy.Start(&wg)
+
+	calls := func() string {
+		content, _ := ioutil.ReadFile(filepath.Join(binFolder, "calls.log"))
+		return string(content)
+	}
+
+	waitFor := func(description string, condition func() bool) {
+		t.Helper()
+
+		for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %v, calls:\n%v", description, calls())
+			}
+		}
+	}
+
+	waitFor("haproxy to start", func() bool { return proxy.IsRunning() && strings.Contains(calls(), "-W -db") })
+
+	proxy.Reload()
+	waitFor("the reload", func() bool { return strings.Contains(calls(), "reload") })
+
+	proxy.Stop()
+	wg.Wait()
+
+	expected := "-c -f /app/haproxy/haproxy.cfg -f /app/haproxy/backends.cfg\n-W -db -f /app/haproxy/haproxy.cfg -f /app/haproxy/backends.cfg\nreload\nstop\n"
+
+	if calls() != expected || proxy.IsRunning() {
+		t.Errorf("expected\n%v\ngot\n%v", expected, calls())
+	}
+}
@@ -0,0 +1,430 @@
+package service
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/rs/zerolog/log"
+)
+
+// service tags overriding the health check settings for one service
+const (
+	TagHealthCheckType           = "ingress.health-check.type"
+	TagHealthCheckPath           = "ingress.health-check.path"
+	TagHealthCheckExpectedStatus = "ingress.health-check.expected-status"
+)
+
+// health check types. none disables the checks of a service.
+const (
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+	HealthCheckGRPC = "grpc"
+	HealthCheckNone = "none"
+)
+
+// healthCheckConcurrency the probes running at once
+const healthCheckConcurrency = 32
+
+// HealthCheckSpec how an endpoint is probed
+type HealthCheckSpec struct {
+	Type           string
+	Path           string
+	ExpectedStatus string
+}
+
+// HealthCheckStatus the state of a probed endpoint
+type HealthCheckStatus struct {
+	ServiceName   string
+	Server        string
+	Spec          HealthCheckSpec
+	Healthy       bool
+	LastCheckAt   time.Time
+	LastError     string
+	FailureCount  int
+	SuccessCount  int
+	LastChangedAt time.Time
+}
+
+// HealthChecker probes the discovered endpoints on a schedule, like nginx plus would. An endpoint only changes
+// state after HealthyThreshold or UnhealthyThreshold consecutive results, so that a flapping task can't make
+// nginx reload on every round. Endpoints start healthy, trusting the ECS health check until proven otherwise.
+type HealthChecker struct {
+	cfg     *shared.Config
+	metrics *shared.Metrics
+
+	lock      sync.Mutex
+	targetMap map[string]*HealthCheckStatus
+	changes   chan struct{}
+}
+
+// NewHealthChecker Creates a new health checker
+func NewHealthChecker(cfg *shared.Config, metrics *shared.Metrics) *HealthChecker {
+
+	ret := &HealthChecker{
+		cfg:       cfg,
+		metrics:   metrics,
+		targetMap: make(map[string]*HealthCheckStatus),
+		changes:   make(chan struct{}, 1),
+	}
+
+	return ret
+}
+
+// Enabled returns true when endpoints are probed
+func (h *HealthChecker) Enabled() bool {
+	return h.cfg.HealthCheck.Enabled
+}
+
+// Start probes the endpoints until the end of time
+func (h *HealthChecker) Start() {
+
+	if !h.Enabled() {
+		return
+	}
+
+	log.Info().Msgf("Active health checks ENABLED (%v)", h.cfg.HealthCheck.Type)
+
+	// the interval can be changed by a config reload
+	for ; ; time.Sleep(h.cfg.Current().HealthCheck.Interval) {
+		h.CheckAll()
+	}
+}
+
+// Changes is signaled after a round in which endpoints changed state
+func (h *HealthChecker) Changes() <-chan struct{} {
+	return h.changes
+}
+
+// SetTargets replaces the probed endpoints with those of the discovered services. Endpoints already probed
+// with the same spec keep their state.
+func (h *HealthChecker) SetTargets(descrMap map[string]EcsServiceDescr, addressFamily string) {
+
+	if !h.Enabled() {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	targetMap := make(map[string]*HealthCheckStatus)
+
+	// nginx connects to the address of the selected family, so do we
+	for serviceName, descr := range SelectAddresses(descrMap, addressFamily) {
+
+		spec := h.serviceSpec(descr)
+
+		if spec.Type == HealthCheckNone {
+			continue
+		}
+
+		locationList := append([]EcsServiceIPPort{}, descr.LocationList...)
+
+		for _, taskSet := range descr.TaskSetList {
+			locationList = append(locationList, taskSet.LocationList...)
+		}
+
+		for _, location := range locationList {
+
+			key := healthCheckKey(serviceName, location)
+
+			if previous, found := h.targetMap[key]; found && previous.Spec == spec {
+				targetMap[key] = previous
+				continue
+			}
+
+			targetMap[key] = &HealthCheckStatus{
+				ServiceName: serviceName,
+				Server:      location.Server(),
+				Spec:        spec,
+				Healthy:     true,
+			}
+		}
+	}
+
+	h.targetMap = targetMap
+
+	h.updateGauges()
+}
+
+// CheckAll probes every endpoint once and applies the thresholds
+func (h *HealthChecker) CheckAll() {
+
+	settings := h.cfg.Current().HealthCheck
+
+	h.lock.Lock()
+
+	targetList := make([]HealthCheckStatus, 0, len(h.targetMap))
+
+	for _, target := range h.targetMap {
+		targetList = append(targetList, *target)
+	}
+
+	h.lock.Unlock()
+
+	errorList := make([]error, len(targetList))
+	semaphore := make(chan struct{}, healthCheckConcurrency)
+
+	var waitGroup sync.WaitGroup
+
+	for i := range targetList {
+
+		waitGroup.Add(1)
+		semaphore <- struct{}{}
+
+		go func(i int) {
+			defer waitGroup.Done()
+			defer func() { <-semaphore }()
+
+			errorList[i] = probe(targetList[i].Server, targetList[i].Spec, settings.Timeout)
+		}(i)
+	}
+
+	waitGroup.Wait()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	changed := false
+	now := time.Now()
+
+	for i, probed := range targetList {
+
+		// the endpoint may be gone, or probed differently, since
+		target, found := h.targetMap[healthCheckKeyOf(probed.ServiceName, probed.Server)]
+
+		if !found || target.Spec != probed.Spec {
+			continue
+		}
+
+		target.LastCheckAt = now
+
+		if err := errorList[i]; err != nil {
+			target.LastError = err.Error()
+			target.FailureCount++
+			target.SuccessCount = 0
+		} else {
+			target.LastError = ""
+			target.SuccessCount++
+			target.FailureCount = 0
+		}
+
+		if target.Healthy && target.FailureCount >= settings.UnhealthyThreshold {
+			log.Warn().Msgf("Endpoint %v of service '%v' is now UNHEALTHY: %v", target.Server, target.ServiceName, target.LastError)
+			h.setHealthy(target, false, now)
+			changed = true
+		}
+
+		if !target.Healthy && target.SuccessCount >= settings.HealthyThreshold {
+			log.Info().Msgf("Endpoint %v of service '%v' is HEALTHY again", target.Server, target.ServiceName)
+			h.setHealthy(target, true, now)
+			changed = true
+		}
+	}
+
+	h.updateGauges()
+
+	if !changed {
+		return
+	}
+
+	// a single pending signal is enough, the next render reads every state
+	select {
+	case h.changes <- struct{}{}:
+	default:
+	}
+}
+
+// DownSet returns the endpoints to render as down, keyed by service and server
+func (h *HealthChecker) DownSet() map[string]bool {
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	retMap := make(map[string]bool)
+
+	for key, target := range h.targetMap {
+		if !target.Healthy {
+			retMap[key] = true
+		}
+	}
+
+	return retMap
+}
+
+// Status returns a copy of the state of every probed endpoint, sorted by service and server
+func (h *HealthChecker) Status() []HealthCheckStatus {
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	retList := make([]HealthCheckStatus, 0, len(h.targetMap))
+
+	for _, target := range h.targetMap {
+		retList = append(retList, *target)
+	}
+
+	sort.Slice(retList, func(i, j int) bool {
+		if retList[i].ServiceName != retList[j].ServiceName {
+			return retList[i].ServiceName < retList[j].ServiceName
+		}
+
+		return retList[i].Server < retList[j].Server
+	})
+
+	return retList
+}
+
+func (h *HealthChecker) setHealthy(target *HealthCheckStatus, healthy bool, now time.Time) {
+
+	target.Healthy = healthy
+	target.LastChangedAt = now
+
+	state := "healthy"
+
+	if !healthy {
+		state = "unhealthy"
+	}
+
+	h.metrics.HealthCheckTransitions.WithLabelValues(state).Inc()
+}
+
+// updateGauges the lock must be held
+func (h *HealthChecker) updateGauges() {
+
+	healthy := 0
+
+	for _, target := range h.targetMap {
+		if target.Healthy {
+			healthy++
+		}
+	}
+
+	h.metrics.HealthCheckEndpoints.WithLabelValues("healthy").Set(float64(healthy))
+	h.metrics.HealthCheckEndpoints.WithLabelValues("unhealthy").Set(float64(len(h.targetMap) - healthy))
+}
+
+// serviceSpec the configured spec, overridden by the service tags
+func (h *HealthChecker) serviceSpec(descr EcsServiceDescr) HealthCheckSpec {
+
+	spec := HealthCheckSpec{
+		Type:           h.cfg.HealthCheck.Type,
+		Path:           h.cfg.HealthCheck.Path,
+		ExpectedStatus: h.cfg.HealthCheck.ExpectedStatus,
+	}
+
+	if value, found := descr.Tags[TagHealthCheckType]; found {
+
+		switch value {
+		case HealthCheckHTTP, HealthCheckTCP, HealthCheckGRPC, HealthCheckNone:
+			spec.Type = value
+		default:
+			log.Warn().Msgf("Invalid %v tag '%v' on service '%v'. Using %v", TagHealthCheckType, value, descr.ServiceName, spec.Type)
+		}
+	}
+
+	if value, found := descr.Tags[TagHealthCheckPath]; found {
+
+		if path, ok := normalizeHealthCheckPath(value); ok {
+			spec.Path = path
+		} else {
+			log.Warn().Msgf("Invalid %v tag '%v' on service '%v'. Using %v", TagHealthCheckPath, value, descr.ServiceName, spec.Path)
+		}
+	}
+
+	if value, found := descr.Tags[TagHealthCheckExpectedStatus]; found {
+
+		if _, err := shared.ParseStatusRanges(value); err != nil {
+			log.Warn().Msgf("Invalid %v tag '%v' on service '%v'. Using %v", TagHealthCheckExpectedStatus, value, descr.ServiceName, spec.ExpectedStatus)
+		} else {
+			spec.ExpectedStatus = value
+		}
+	}
+
+	return spec
+}
+
+// normalizeHealthCheckPath adds the leading '/' often left out of tags. Returns false if it's not a request path.
+func normalizeHealthCheckPath(path string) (string, bool) {
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	if strings.ContainsAny(path, " \t\r\n#") {
+		return "", false
+	}
+
+	if _, err := url.ParseRequestURI(path); err != nil {
+		return "", false
+	}
+
+	return path, true
+}
+
+// MarkDown flags the locations failing their health checks as down. The discovered services are left untouched.
+func MarkDown(descrMap map[string]EcsServiceDescr, downSet map[string]bool) map[string]EcsServiceDescr {
+
+	if len(downSet) == 0 {
+		return descrMap
+	}
+
+	markList := func(serviceName string, locationList []EcsServiceIPPort) []EcsServiceIPPort {
+
+		retList := make([]EcsServiceIPPort, 0, len(locationList))
+		downCount := 0
+
+		for _, location := range locationList {
+
+			location.Down = downSet[healthCheckKey(serviceName, location)]
+
+			if location.Down {
+				downCount++
+			}
+
+			retList = append(retList, location)
+		}
+
+		// like an ALB, we fail open: a wrong check path must not take a whole service down
+		if downCount > 0 && downCount == len(retList) {
+
+			log.Warn().Msgf("Every endpoint of service '%v' fails its health check. Sending traffic to all of them", serviceName)
+
+			for i := range retList {
+				retList[i].Down = false
+			}
+		}
+
+		return retList
+	}
+
+	retMap := make(map[string]EcsServiceDescr)
+
+	for serviceName, descr := range descrMap {
+
+		descr.LocationList = markList(serviceName, descr.LocationList)
+
+		taskSetList := make([]EcsTaskSetDescr, 0, len(descr.TaskSetList))
+
+		for _, taskSet := range descr.TaskSetList {
+			taskSet.LocationList = markList(serviceName, taskSet.LocationList)
+			taskSetList = append(taskSetList, taskSet)
+		}
+
+		descr.TaskSetList = taskSetList
+		retMap[serviceName] = descr
+	}
+
+	return retMap
+}
+
+func healthCheckKey(serviceName string, location EcsServiceIPPort) string {
+	return healthCheckKeyOf(serviceName, location.Server())
+}
+
+func healthCheckKeyOf(serviceName string, server string) string {
+	return serviceName + "/" + server
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func newTestHealthChecker() *HealthChecker {
+
+	cfg := &shared.Config{}
+	cfg.HealthCheck.Enabled = true
+	cfg.HealthCheck.Type = HealthCheckHTTP
+	cfg.HealthCheck.Path = "/health"
+	cfg.HealthCheck.ExpectedStatus = "200-399"
+	cfg.HealthCheck.Timeout = time.Second
+	cfg.HealthCheck.HealthyThreshold = 2
+	cfg.HealthCheck.UnhealthyThreshold = 3
+
+	return NewHealthChecker(cfg, shared.NewMetrics(cfg))
+}
+
+// serverLocation the location of a test server
+func serverLocation(t *testing.T, server *httptest.Server) EcsServiceIPPort {
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	portNumber, err := strconv.ParseInt(port, 10, 64)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return EcsServiceIPPort{PrivateIPAddress: host, Port: portNumber}
+}
+
+func TestHealthChecker(t *testing.T) {
+
+	healthy := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		if req.URL.Path != "/health" || !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+
+	defer server.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+
+	defer good.Close()
+
+	descrMap := map[string]EcsServiceDescr{
+		"web": {ServiceName: "web", LocationList: []EcsServiceIPPort{serverLocation(t, server), serverLocation(t, good)}},
+		// not probed
+		"db": {ServiceName: "db", Tags: map[string]string{TagHealthCheckType: HealthCheckNone}, LocationList: []EcsServiceIPPort{{PrivateIPAddress: "127.0.0.1", Port: 1}}},
+	}
+
+	healthChecker := newTestHealthChecker()
+	healthChecker.SetTargets(descrMap, AddressFamilyIPv4)
+
+	if status := healthChecker.Status(); len(status) != 2 {
+		t.Fatalf("expected 2 probed endpoints, got %+v", status)
+	}
+
+	healthChecker.CheckAll()
+
+	if len(healthChecker.DownSet()) != 0 {
+		t.Fatal("healthy endpoints marked down")
+	}
+
+	healthy = false
+
+	// down after the third failure only
+	for i := 0; i < 2; i++ {
+		healthChecker.CheckAll()
+	}
+
+	if len(healthChecker.DownSet()) != 0 {
+		t.Fatal("endpoint down before the unhealthy threshold")
+	}
+
+	healthChecker.CheckAll()
+
+	downSet := healthChecker.DownSet()
+
+	if len(downSet) != 1 {
+		t.Fatalf("expected one endpoint down, got %v", downSet)
+	}
+
+	select {
+	case <-healthChecker.Changes():
+	default:
+		t.Error("expected a change signal")
+	}
+
+	// rediscovering the same endpoints keeps their state
+	healthChecker.SetTargets(descrMap, AddressFamilyIPv4)
+
+	buffer, err := RenderUpstreams("../data/upstreams.conf.tmpl", descrMap, UpstreamOptions{DownSet: healthChecker.DownSet()})
+
+	if err != nil {
+		t.Fatalf("RenderUpstreams failed: %v", err)
+	}
+
+	if rendered := buffer.String(); !strings.Contains(rendered, "server "+serverLocation(t, server).Server()+" down;") || !strings.Contains(rendered, "server "+serverLocation(t, good).Server()+";") {
+		t.Errorf("unexpected upstreams:\n%v", rendered)
+	}
+
+	healthy = true
+
+	healthChecker.CheckAll()
+
+	if len(healthChecker.DownSet()) != 1 {
+		t.Fatal("endpoint up before the healthy threshold")
+	}
+
+	healthChecker.CheckAll()
+
+	if len(healthChecker.DownSet()) != 0 {
+		t.Fatal("endpoint still down after the healthy threshold")
+	}
+}
+
+func TestMarkDownFailsOpen(t *testing.T) {
+
+	descrMap := map[string]EcsServiceDescr{
+		"web": {ServiceName: "web", LocationList: []EcsServiceIPPort{{PrivateIPAddress: "10.0.0.1", Port: 80}, {PrivateIPAddress: "10.0.0.2", Port: 80}}},
+	}
+
+	upstreamMap := MarkDown(descrMap, map[string]bool{"web/10.0.0.1:80": true})
+
+	if !upstreamMap["web"].LocationList[0].Down || upstreamMap["web"].LocationList[1].Down || descrMap["web"].LocationList[0].Down {
+		t.Errorf("unexpected locations %+v", upstreamMap["web"].LocationList)
+	}
+
+	upstreamMap = MarkDown(descrMap, map[string]bool{"web/10.0.0.1:80": true, "web/10.0.0.2:80": true})
+
+	for _, location := range upstreamMap["web"].LocationList {
+		if location.Down {
+			t.Errorf("expected every endpoint up when all fail, got %+v", location)
+		}
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+
+	// a gRPC health service answering SERVING, over cleartext HTTP/2
+	grpcHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		if req.URL.Path != "/grpc.health.v1.Health/Check" || req.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, grpcServing})
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	grpcServer := httptest.NewServer(h2c.NewHandler(grpcHandler, &http2.Server{}))
+
+	defer grpcServer.Close()
+
+	grpcAddress := strings.TrimPrefix(grpcServer.URL, "http://")
+
+	if err := probe(grpcAddress, HealthCheckSpec{Type: HealthCheckGRPC}, time.Second); err != nil {
+		t.Errorf("gRPC probe failed: %v", err)
+	}
+
+	if err := probe(grpcAddress, HealthCheckSpec{Type: HealthCheckTCP}, time.Second); err != nil {
+		t.Errorf("TCP probe failed: %v", err)
+	}
+
+	if err := probe(grpcAddress, HealthCheckSpec{Type: HealthCheckHTTP, Path: "/", ExpectedStatus: "200"}, time.Second); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected the HTTP probe to fail with a 404, got %v", err)
+	}
+
+	grpcServer.Close()
+
+	if err := probe(grpcAddress, HealthCheckSpec{Type: HealthCheckTCP}, time.Second); err == nil {
+		t.Error("expected the TCP probe of a closed port to fail")
+	}
+}
+
+func TestHealthCheckPathTag(t *testing.T) {
+
+	healthChecker := newTestHealthChecker()
+
+	tests := []struct {
+		tag      string
+		expected string
+	}{
+		{"/ready", "/ready"},
+		{"ready", "/ready"},
+		{"status/ready?full=1", "/status/ready?full=1"},
+		{"/bad path", "/health"},
+		{"/ready#fragment", "/health"},
+		{"/%zz", "/health"},
+	}
+
+	for _, test := range tests {
+
+		spec := healthChecker.serviceSpec(EcsServiceDescr{ServiceName: "web", Tags: map[string]string{TagHealthCheckPath: test.tag}})
+
+		if spec.Path != test.expected {
+			t.Errorf("tag %q: expected path %q, got %q", test.tag, test.expected, spec.Path)
+		}
+	}
+}
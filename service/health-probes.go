@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"golang.org/x/net/http2"
+)
+
+// grpcServing the SERVING status of grpc.health.v1.HealthCheckResponse
+const grpcServing = 1
+
+// probe checks an endpoint once, returning why it failed
+func probe(server string, spec HealthCheckSpec, timeout time.Duration) error {
+
+	switch spec.Type {
+	case HealthCheckTCP:
+		return probeTCP(server, timeout)
+	case HealthCheckGRPC:
+		return probeGRPC(server, timeout)
+	default:
+		return probeHTTP(server, spec, timeout)
+	}
+}
+
+func probeTCP(server string, timeout time.Duration) error {
+
+	conn, err := net.DialTimeout("tcp", server, timeout)
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func probeHTTP(server string, spec HealthCheckSpec, timeout time.Duration) error {
+
+	expectedStatus, err := shared.ParseStatusRanges(spec.ExpectedStatus)
+
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{
+		Timeout: timeout,
+		// a redirect is an answer, judged by its status
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		// no keep-alive, every probe tells whether a new connection works
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+
+	resp, err := httpClient.Get("http://" + server + spec.Path)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if !expectedStatus.Contains(resp.StatusCode) {
+		return fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// probeGRPC calls grpc.health.v1.Health/Check over cleartext HTTP/2, without depending on a gRPC library
+func probeGRPC(server string, timeout time.Duration) error {
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, timeout)
+		},
+	}
+
+	defer transport.CloseIdleConnections()
+
+	httpClient := &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+
+	// an empty HealthCheckRequest, checking the whole server: uncompressed and 0 bytes long
+	req, err := http.NewRequest("POST", "http://"+server+"/grpc.health.v1.Health/Check", bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if err != nil {
+		return err
+	}
+
+	// trailers-only responses carry the status in the headers
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+	}
+
+	if resp.StatusCode != http.StatusOK || grpcStatus != "0" {
+		return fmt.Errorf("gRPC health check failed with status %v, grpc-status '%v'", resp.StatusCode, grpcStatus)
+	}
+
+	// the response message is field 1, the status enum, after the 5 bytes prefix
+	if len(body) < 7 || body[5] != 0x08 || body[6] != grpcServing {
+		return fmt.Errorf("gRPC health check reports NOT_SERVING")
+	}
+
+	return nil
+}
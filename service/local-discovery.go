@@ -0,0 +1,197 @@
+package service
+
+import (
+	"sort"
+
+	"bitbucket.org/nnnco/rev-proxy/util"
+)
+
+// labels the ECS agent sets on the containers it starts
+const (
+	ecsLabelCluster = "com.amazonaws.ecs.cluster"
+	ecsLabelTaskArn = "com.amazonaws.ecs.task-arn"
+	ecsLabelFamily  = "com.amazonaws.ecs.task-definition-family"
+)
+
+// AgentDiscovery finds the tasks running on this host through the ECS agent introspection API.
+// Neither the agent nor docker know about ECS services, so tasks are grouped by task definition family.
+type AgentDiscovery struct {
+	agentClient *util.EcsAgentClient
+	hostAddress string
+}
+
+// NewAgentDiscovery Creates a new agent discovery
+func NewAgentDiscovery(agentURL string, hostAddress string) *AgentDiscovery {
+
+	ret := &AgentDiscovery{
+		agentClient: util.NewEcsAgentClient(agentURL),
+		hostAddress: hostAddress,
+	}
+
+	return ret
+}
+
+// GetServicesAndPorts returns the tasks running on this host grouped by family
+func (a *AgentDiscovery) GetServicesAndPorts(clusterName string) (map[string]EcsServiceDescr, error) {
+
+	taskList, err := a.agentClient.ListTasks()
+
+	if err != nil {
+		return nil, err
+	}
+
+	retMap := make(map[string]EcsServiceDescr)
+
+	for _, task := range taskList {
+
+		if task.KnownStatus != "RUNNING" || task.DesiredStatus != "RUNNING" {
+			continue
+		}
+
+		location, found := a.taskLocation(task)
+
+		if !found {
+			continue
+		}
+
+		addLocation(retMap, clusterName, task.Family, location)
+	}
+
+	sortLocations(retMap)
+
+	return retMap, nil
+}
+
+// taskLocation the first container port reachable from this host, like the ECS discovery does
+func (a *AgentDiscovery) taskLocation(task util.EcsAgentTask) (EcsServiceIPPort, bool) {
+
+	for _, container := range task.Containers {
+
+		for _, port := range container.Ports {
+
+			// awsvpc tasks have their own addresses, possibly IPv6 only. The agent reports
+			// HostPort equal to ContainerPort for them, which isn't published on the host.
+			for _, network := range container.Networks {
+
+				if network.NetworkMode != "awsvpc" {
+					continue
+				}
+
+				location := EcsServiceIPPort{TaskArn: task.Arn, Port: port.ContainerPort}
+
+				if len(network.IPv4Addresses) > 0 {
+					location.PrivateIPAddress = network.IPv4Addresses[0]
+				}
+
+				if len(network.IPv6Addresses) > 0 {
+					location.IPv6Address = network.IPv6Addresses[0]
+				}
+
+				if location.PrivateIPAddress != "" || location.IPv6Address != "" {
+					return location, true
+				}
+			}
+
+			// bridge and host networking publish on the host
+			if port.HostPort > 0 {
+				return EcsServiceIPPort{TaskArn: task.Arn, PrivateIPAddress: a.hostAddress, Port: port.HostPort}, true
+			}
+		}
+	}
+
+	return EcsServiceIPPort{}, false
+}
+
+// DockerDiscovery finds the ECS tasks running on this host through the Docker Engine API labels.
+// Only ports published on the host are discovered.
+type DockerDiscovery struct {
+	dockerHost  string
+	hostAddress string
+}
+
+// NewDockerDiscovery Creates a new docker discovery
+func NewDockerDiscovery(dockerHost string, hostAddress string) *DockerDiscovery {
+
+	ret := &DockerDiscovery{
+		dockerHost:  dockerHost,
+		hostAddress: hostAddress,
+	}
+
+	return ret
+}
+
+// GetServicesAndPorts returns the tasks running on this host grouped by family
+func (d *DockerDiscovery) GetServicesAndPorts(clusterName string) (map[string]EcsServiceDescr, error) {
+
+	dockerClient, err := util.NewDockerClient(d.dockerHost)
+
+	if err != nil {
+		return nil, err
+	}
+
+	containerList, err := dockerClient.ListContainers(ecsLabelCluster + "=" + clusterName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// containers are listed newest first, we keep a single location per task
+	seenTaskArns := make(map[string]bool)
+	retMap := make(map[string]EcsServiceDescr)
+
+	for _, container := range containerList {
+
+		taskArn := container.Labels[ecsLabelTaskArn]
+
+		if taskArn == "" || seenTaskArns[taskArn] {
+			continue
+		}
+
+		for _, port := range container.Ports {
+
+			if port.PublicPort == 0 {
+				continue
+			}
+
+			seenTaskArns[taskArn] = true
+
+			addLocation(retMap, clusterName, container.Labels[ecsLabelFamily], EcsServiceIPPort{
+				TaskArn:          taskArn,
+				PrivateIPAddress: d.hostAddress,
+				Port:             port.PublicPort,
+			})
+
+			break
+		}
+	}
+
+	sortLocations(retMap)
+
+	return retMap, nil
+}
+
+func addLocation(descrMap map[string]EcsServiceDescr, clusterName string, serviceName string, location EcsServiceIPPort) {
+
+	descr, found := descrMap[serviceName]
+
+	if !found {
+		descr = EcsServiceDescr{
+			ClusterName:  clusterName,
+			ServiceName:  serviceName,
+			LocationList: make([]EcsServiceIPPort, 0),
+		}
+	}
+
+	descr.LocationList = append(descr.LocationList, location)
+	descrMap[serviceName] = descr
+}
+
+// sortLocations keeps the rendered upstreams stable, local APIs don't guarantee any order
+func sortLocations(descrMap map[string]EcsServiceDescr) {
+
+	for _, descr := range descrMap {
+		sort.Slice(descr.LocationList, func(i, j int) bool {
+			return descr.LocationList[i].TaskArn < descr.LocationList[j].TaskArn
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const agentTasksReply = `{"Tasks": [
+	{"Arn": "arn:task/b", "DesiredStatus": "RUNNING", "KnownStatus": "RUNNING", "Family": "web", "Version": "3",
+	 "Containers": [{"DockerId": "1", "Name": "web", "Ports": [{"ContainerPort": 80, "HostPort": 32769, "Protocol": "tcp"}]}]},
+	{"Arn": "arn:task/a", "DesiredStatus": "RUNNING", "KnownStatus": "RUNNING", "Family": "web", "Version": "3",
+	 "Containers": [{"DockerId": "2", "Name": "web", "Ports": [{"ContainerPort": 80, "HostPort": 32768, "Protocol": "tcp"}],
+	   "Networks": [{"NetworkMode": "bridge", "IPv4Addresses": ["172.17.0.2"]}]}]},
+	{"Arn": "arn:task/c", "DesiredStatus": "RUNNING", "KnownStatus": "RUNNING", "Family": "api", "Version": "1",
+	 "Containers": [{"DockerId": "3", "Name": "api", "Ports": [{"ContainerPort": 8080, "HostPort": 8080, "Protocol": "tcp"}],
+	   "Networks": [{"NetworkMode": "awsvpc", "IPv4Addresses": ["172.31.0.10"]}]}]},
+	{"Arn": "arn:task/e", "DesiredStatus": "RUNNING", "KnownStatus": "RUNNING", "Family": "grpc", "Version": "1",
+	 "Containers": [{"DockerId": "5", "Name": "grpc", "Ports": [{"ContainerPort": 50051, "HostPort": 50051, "Protocol": "tcp"}],
+	   "Networks": [{"NetworkMode": "awsvpc", "IPv6Addresses": ["2600:1f18::10"]}]}]},
+	{"Arn": "arn:task/d", "DesiredStatus": "STOPPED", "KnownStatus": "RUNNING", "Family": "web", "Version": "2",
+	 "Containers": [{"DockerId": "4", "Name": "web", "Ports": [{"ContainerPort": 80, "HostPort": 32760, "Protocol": "tcp"}]}]}
+]}`
+
+const dockerContainersReply = `[
+	{"Id": "1", "State": "running", "Labels": {"com.amazonaws.ecs.task-arn": "arn:task/a", "com.amazonaws.ecs.task-definition-family": "web"},
+	 "Ports": [{"IP": "0.0.0.0", "PrivatePort": 80, "PublicPort": 32768, "Type": "tcp"}]},
+	{"Id": "2", "State": "running", "Labels": {"com.amazonaws.ecs.task-arn": "arn:task/a", "com.amazonaws.ecs.task-definition-family": "web"},
+	 "Ports": [{"IP": "0.0.0.0", "PrivatePort": 9000, "PublicPort": 32700, "Type": "tcp"}]},
+	{"Id": "3", "State": "running", "Labels": {"com.amazonaws.ecs.task-arn": "arn:task/b", "com.amazonaws.ecs.task-definition-family": "worker"},
+	 "Ports": [{"PrivatePort": 80, "Type": "tcp"}]}
+]`
+
+func TestAgentDiscovery(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		if req.URL.Path != "/v1/tasks" {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Write([]byte(agentTasksReply))
+	}))
+
+	defer server.Close()
+
+	descrMap, err := NewAgentDiscovery(server.URL, "127.0.0.1").GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	web := descrMap["web"]
+
+	// sorted by task and without the stopping task
+	if len(web.LocationList) != 2 || web.LocationList[0].Port != 32768 || web.LocationList[1].Port != 32769 || web.LocationList[0].PrivateIPAddress != "127.0.0.1" {
+		t.Errorf("unexpected web locations %+v", web.LocationList)
+	}
+
+	if api := descrMap["api"]; len(api.LocationList) != 1 || api.LocationList[0].PrivateIPAddress != "172.31.0.10" || api.LocationList[0].Port != 8080 {
+		t.Errorf("unexpected awsvpc locations %+v", api.LocationList)
+	}
+
+	if grpc := descrMap["grpc"]; len(grpc.LocationList) != 1 || grpc.LocationList[0].IPv6Address != "2600:1f18::10" {
+		t.Errorf("unexpected IPv6-only locations %+v", grpc.LocationList)
+	}
+}
+
+func TestDockerDiscovery(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		if req.URL.Path != "/containers/json" || !strings.Contains(req.URL.Query().Get("filters"), "com.amazonaws.ecs.cluster=prod") {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Write([]byte(dockerContainersReply))
+	}))
+
+	defer server.Close()
+
+	dockerHost := strings.Replace(server.URL, "http://", "tcp://", 1)
+
+	descrMap, err := NewDockerDiscovery(dockerHost, "10.0.0.1").GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	if web := descrMap["web"]; len(web.LocationList) != 1 || web.LocationList[0].Port != 32768 || web.LocationList[0].PrivateIPAddress != "10.0.0.1" {
+		t.Errorf("unexpected web locations %+v", web.LocationList)
+	}
+
+	if _, found := descrMap["worker"]; found {
+		t.Error("unpublished ports must not be discovered")
+	}
+}
@@ -1,25 +1,26 @@
 package service
 
 import (
-	"os"
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"syscall"
 
 	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
 	"github.com/rs/zerolog/log"
 )
 
-// NginxMonitor simplified client to access ECS resources on AWS
+// NginxMonitor runs nginx and hands it its configuration
 type NginxMonitor struct {
-	cfg *shared.Config
+	*proxyProcess
 }
 
-// NewNginxMonitor Creates a new rev proxy service
-func NewNginxMonitor(cfg *shared.Config) *NginxMonitor {
+// NewNginxMonitor Creates a new nginx monitor
+func NewNginxMonitor(cfg *shared.Config, metrics *shared.Metrics, notifier *Notifier) *NginxMonitor {
 
 	ret := &NginxMonitor{
-		cfg: cfg,
+		proxyProcess: newProxyProcess(cfg, metrics, notifier, "Nginx"),
 	}
 
 	return ret
@@ -30,48 +31,33 @@ func (n *NginxMonitor) Start(wg *sync.WaitGroup) {
 
 	log.Info().Msg("Nginx Monitor START")
 
-	// log.Info().Str("errorMsg", response.ErrorMsg).Int("numReadings", len(response.ReadingList)).Float32("durationMs", response.DurationMs).Msg("")
-
 	mainConfPath := filepath.Join(n.cfg.Nginx.ConfigFolder, n.cfg.Nginx.MainConfigFile)
 
-	// we start nginx
-	log.Info().Msgf("Starting nginx executable with config '%v'", mainConfPath)
-
-	mainCmd := exec.Command("nginx", "-c", mainConfPath, "-g", "daemon off;")
-
-	// we redirect stdout and err to ourself
-	mainCmd.Stdout = os.Stdout
-	mainCmd.Stderr = os.Stderr
-
-	// we run the executable (in the main thread)
-	exitErr := mainCmd.Run()
-
-	if exitErr != nil {
-		log.Error().Msgf("Nginx exited WITH ERROR: %v", exitErr)
-	} else {
-		log.Warn().Msg("Nginx exited without error")
-	}
+	n.run(wg, n.cfg.Nginx.Binary, "-c", mainConfPath, "-g", "daemon off;")
+}
 
-	wg.Done()
+// Stop shuts nginx down gracefully
+func (n *NginxMonitor) Stop() {
+	n.stop(syscall.SIGQUIT)
 }
 
 // Reload reloads Nginx config
 func (n *NginxMonitor) Reload() {
 	log.Info().Msg("Sending reload message to NGINX")
-	mainCmd := exec.Command("nginx", "-s", "reload")
-	mainCmd.Run()
-	log.Info().Msg("Reload sent")
+	n.reloaded(exec.Command(n.cfg.Nginx.Binary, "-s", "reload").Run())
 }
 
 // TestConfig Tests the Nginx configuration
 func (n *NginxMonitor) TestConfig() (string, error) {
+	return n.TestConfigFile(filepath.Join(n.cfg.Nginx.ConfigFolder, n.cfg.Nginx.MainConfigFile))
+}
 
-	mainConfPath := filepath.Join(n.cfg.Nginx.ConfigFolder, n.cfg.Nginx.MainConfigFile)
-
-	mainCmd := exec.Command("nginx", "-c", mainConfPath, "-t")
-	outputBytes, err := mainCmd.CombinedOutput()
-
-	output := string(outputBytes)
+// TestConfigFile Tests an Nginx configuration that is not necessarily the live one
+func (n *NginxMonitor) TestConfigFile(mainConfPath string) (string, error) {
+	return n.testConfig(n.cfg.Nginx.Binary, "-c", mainConfPath, "-t")
+}
 
-	return output, err
+// UpstreamAPI returns the client of the configured apply strategy
+func (n *NginxMonitor) UpstreamAPI() util.UpstreamAPI {
+	return NewUpstreamAPI(n.cfg)
 }
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"github.com/rs/zerolog/log"
+)
+
+// notification event types
+const (
+	EventBundleApplied  = "bundle_applied"
+	EventBundleRejected = "bundle_rejected"
+	EventServiceDown    = "service_lost_all_endpoints"
+	EventServiceUp      = "service_gained_endpoints"
+	EventNginxRestarted = "nginx_restarted"
+)
+
+const (
+	notifierQueueSize    = 100
+	notifierRateInterval = time.Minute
+)
+
+// NotifyEvent a single notification sent to every target
+type NotifyEvent struct {
+	Type     string
+	Subject  string
+	Message  string
+	Detail   string
+	Cluster  string
+	Host     string
+	Time     time.Time
+	DedupKey string
+}
+
+// Notifier sends config change and failure events to Slack and generic webhooks
+type Notifier struct {
+	cfg           *shared.Config
+	gossipService *GossipService
+	host          string
+	queue         chan NotifyEvent
+	pending       sync.WaitGroup
+
+	lock     sync.Mutex
+	lastSent map[string]time.Time
+	sentLog  []time.Time
+}
+
+// NewNotifier Creates a new notifier
+func NewNotifier(cfg *shared.Config, gossipService *GossipService) *Notifier {
+
+	host, _ := os.Hostname()
+
+	ret := &Notifier{
+		cfg:           cfg,
+		gossipService: gossipService,
+		host:          host,
+		queue:         make(chan NotifyEvent, notifierQueueSize),
+		lastSent:      make(map[string]time.Time),
+	}
+
+	return ret
+}
+
+// Enabled returns true when at least one target is configured
+func (n *Notifier) Enabled() bool {
+	notify := n.cfg.Current().Notify
+
+	return len(notify.SlackWebhookURLs) > 0 || len(notify.WebhookURLs) > 0
+}
+
+// Notify queues an event without ever blocking the caller.
+// Identical events are deduplicated within the configured window.
+func (n *Notifier) Notify(eventType string, subject string, message string, detail string) {
+
+	if !n.Enabled() {
+		return
+	}
+
+	// every daemon sees the same cluster-wide events, only the leader reports them
+	if eventType != EventNginxRestarted && !n.gossipService.IsLeader() {
+		return
+	}
+
+	event := NotifyEvent{
+		Type:    eventType,
+		Subject: subject,
+		Message: message,
+		Detail:  detail,
+		Cluster: n.cfg.AWS.ClusterName,
+		Host:    n.host,
+		Time:    time.Now(),
+		// identical across hosts so receivers can collapse the same event from every daemon
+		DedupKey: util.HashString(fmt.Sprintf("%v|%v|%v|%v", n.cfg.AWS.ClusterName, eventType, subject, detail)),
+	}
+
+	n.pending.Add(1)
+
+	select {
+	case n.queue <- event:
+	default:
+		n.pending.Done()
+		log.Warn().Str("type", eventType).Msg("Notification queue full. Dropping event")
+	}
+}
+
+// Start sends the queued events forever
+func (n *Notifier) Start() {
+
+	log.Info().Msg("Notifier START")
+
+	for event := range n.queue {
+
+		if n.shouldSend(event, time.Now()) {
+			n.send(event)
+		}
+
+		n.pending.Done()
+	}
+}
+
+// Flush waits until the queued events are sent, at most timeout. Used before exiting.
+func (n *Notifier) Flush(timeout time.Duration) {
+
+	done := make(chan struct{})
+
+	go func() {
+		n.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warn().Msg("Notifications still pending. Exiting anyway")
+	}
+}
+
+// shouldSend applies deduplication and the global rate limit
+func (n *Notifier) shouldSend(event NotifyEvent, now time.Time) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	notify := n.cfg.Current().Notify
+
+	if lastSent, found := n.lastSent[event.DedupKey]; found && now.Sub(lastSent) < notify.DedupWindow {
+		log.Debug().Str("type", event.Type).Str("subject", event.Subject).Msg("Duplicate notification suppressed")
+		return false
+	}
+
+	// we only keep the sends within the rate interval
+	recent := n.sentLog[:0]
+
+	for _, sentAt := range n.sentLog {
+		if now.Sub(sentAt) < notifierRateInterval {
+			recent = append(recent, sentAt)
+		}
+	}
+
+	n.sentLog = recent
+
+	if len(n.sentLog) >= notify.MaxPerMinute {
+		log.Warn().Str("type", event.Type).Str("subject", event.Subject).Msg("Notification rate limit reached. Dropping event")
+		return false
+	}
+
+	n.sentLog = append(n.sentLog, now)
+	n.lastSent[event.DedupKey] = now
+
+	// old entries would otherwise grow forever
+	for key, sentAt := range n.lastSent {
+		if now.Sub(sentAt) >= notify.DedupWindow {
+			delete(n.lastSent, key)
+		}
+	}
+
+	return true
+}
+
+func (n *Notifier) send(event NotifyEvent) {
+
+	notify := n.cfg.Current().Notify
+
+	for _, url := range notify.SlackWebhookURLs {
+		if err := util.HTTPPostJSON(url, slackPayload(event)); err != nil {
+			log.Error().Err(err).Str("type", event.Type).Msg("Slack notification failed")
+		}
+	}
+
+	for _, url := range notify.WebhookURLs {
+		if err := util.HTTPPostJSON(url, event); err != nil {
+			log.Error().Err(err).Str("type", event.Type).Msg("Webhook notification failed")
+		}
+	}
+}
+
+// slackPayload formats an event for a Slack incoming webhook
+func slackPayload(event NotifyEvent) map[string]string {
+
+	text := fmt.Sprintf("*[%v]* %v (host `%v`)", event.Cluster, event.Message, event.Host)
+
+	if event.Detail != "" {
+		text += fmt.Sprintf("\n```%v```", event.Detail)
+	}
+
+	return map[string]string{"text": text}
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+)
+
+func TestNotifierShouldSend(t *testing.T) {
+
+	// a send at offset after the first one
+	type send struct {
+		dedupKey string
+		offset   time.Duration
+		expected bool
+	}
+
+	tests := []struct {
+		name     string
+		sendList []send
+	}{
+		{
+			name: "repeat inside the dedup window",
+			sendList: []send{
+				{dedupKey: "a", offset: 0, expected: true},
+				{dedupKey: "a", offset: 4 * time.Minute, expected: false},
+				{dedupKey: "b", offset: 4 * time.Minute, expected: true},
+			},
+		},
+		{
+			name: "repeat after the dedup window",
+			sendList: []send{
+				{dedupKey: "a", offset: 0, expected: true},
+				{dedupKey: "a", offset: 5 * time.Minute, expected: true},
+			},
+		},
+		{
+			name: "over the rate limit",
+			sendList: []send{
+				{dedupKey: "a", offset: 0, expected: true},
+				{dedupKey: "b", offset: time.Second, expected: true},
+				{dedupKey: "c", offset: 2 * time.Second, expected: true},
+				{dedupKey: "d", offset: 3 * time.Second, expected: false},
+				// a dropped event isn't deduplicated
+				{dedupKey: "d", offset: time.Minute, expected: true},
+			},
+		},
+	}
+
+	start := time.Now()
+
+	for _, test := range tests {
+
+		cfg := &shared.Config{}
+		cfg.Notify.DedupWindow = 5 * time.Minute
+		cfg.Notify.MaxPerMinute = 3
+
+		notifier := NewNotifier(cfg, nil)
+
+		for index, send := range test.sendList {
+			if sent := notifier.shouldSend(NotifyEvent{DedupKey: send.dedupKey}, start.Add(send.offset)); sent != send.expected {
+				t.Errorf("%v: send %v expected %v, got %v", test.name, index, send.expected, sent)
+			}
+		}
+	}
+}
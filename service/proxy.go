@@ -0,0 +1,197 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"github.com/rs/zerolog/log"
+)
+
+// the proxies the configuration can be handed to
+const (
+	ProxyTypeNginx   = "nginx"
+	ProxyTypeHAProxy = "haproxy"
+)
+
+// restartDelay the pause before the proxy is started again
+var restartDelay = time.Second
+
+// Proxy the reverse proxy process serving the rendered configuration
+type Proxy interface {
+	// Start runs the proxy, starting it again when it exits up to Nginx.MaxRestarts times. wg is done when it gives up.
+	Start(wg *sync.WaitGroup)
+	// Stop lets the proxy finish its connections and exit, Start returns then
+	Stop()
+	IsRunning() bool
+	TestConfig() (string, error)
+	TestConfigFile(mainConfPath string) (string, error)
+	Reload()
+	// UpstreamAPI updates the servers of the running proxy without a reload, nil when it can't
+	UpstreamAPI() util.UpstreamAPI
+}
+
+// NewProxy Creates the proxy of the configured type
+func NewProxy(cfg *shared.Config, metrics *shared.Metrics, notifier *Notifier) Proxy {
+
+	if cfg.Proxy.Type == ProxyTypeHAProxy {
+		return NewHAProxyMonitor(cfg, metrics, notifier)
+	}
+
+	return NewNginxMonitor(cfg, metrics, notifier)
+}
+
+// proxyProcess runs a proxy executable in the foreground, and starts it again when it exits
+type proxyProcess struct {
+	cfg      *shared.Config
+	metrics  *shared.Metrics
+	notifier *Notifier
+	name     string
+	lock     sync.RWMutex
+	process  *os.Process
+	stopping bool
+}
+
+func newProxyProcess(cfg *shared.Config, metrics *shared.Metrics, notifier *Notifier, name string) *proxyProcess {
+
+	ret := &proxyProcess{
+		cfg:      cfg,
+		metrics:  metrics,
+		notifier: notifier,
+		name:     name,
+	}
+
+	return ret
+}
+
+// run starts the executable until stopped, or until it exited more than Nginx.MaxRestarts times. We exit with it
+// then, so that ECS replaces the task.
+func (p *proxyProcess) run(wg *sync.WaitGroup, binary string, args ...string) {
+
+	defer wg.Done()
+
+	for restarts := 0; !p.isStopping(); restarts++ {
+
+		log.Info().Msgf("Starting %v: %v %v", p.name, binary, strings.Join(args, " "))
+
+		mainCmd := exec.Command(binary, args...)
+
+		// we redirect stdout and err to ourself
+		mainCmd.Stdout = os.Stdout
+		mainCmd.Stderr = os.Stderr
+
+		exitErr := mainCmd.Start()
+
+		if exitErr == nil {
+			p.setProcess(mainCmd.Process)
+			exitErr = mainCmd.Wait()
+			p.setProcess(nil)
+		}
+
+		if p.isStopping() {
+			log.Info().Msgf("%v stopped", p.name)
+			return
+		}
+
+		if exitErr != nil {
+			log.Error().Msgf("%v exited WITH ERROR: %v", p.name, exitErr)
+		} else {
+			log.Warn().Msgf("%v exited without error", p.name)
+		}
+
+		maxRestarts := p.cfg.Current().Nginx.MaxRestarts
+
+		if restarts >= maxRestarts {
+			log.Error().Msgf("%v exited %v times. Giving up", p.name, restarts+1)
+			p.notifier.Notify(EventNginxRestarted, strings.ToLower(p.name), fmt.Sprintf("%v exited, ECS Ingress exits with it so that ECS replaces the task", p.name), fmt.Sprintf("%v", exitErr))
+			return
+		}
+
+		p.metrics.ProxyRestarts.Inc()
+		p.notifier.Notify(EventNginxRestarted, strings.ToLower(p.name), fmt.Sprintf("%v exited and is being restarted (%v/%v)", p.name, restarts+1, maxRestarts), fmt.Sprintf("%v", exitErr))
+
+		// we give the old master a chance to release its sockets
+		time.Sleep(restartDelay)
+	}
+}
+
+// IsRunning returns true while the master process is alive
+func (p *proxyProcess) IsRunning() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.process != nil
+}
+
+func (p *proxyProcess) setProcess(process *os.Process) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.process = process
+}
+
+func (p *proxyProcess) isStopping() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.stopping
+}
+
+// signal sends sig to the master process
+func (p *proxyProcess) signal(sig os.Signal) error {
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if p.process == nil {
+		return fmt.Errorf("%v is not running", p.name)
+	}
+
+	return p.process.Signal(sig)
+}
+
+// stop sends sig to the master process, and keeps it from being started again
+func (p *proxyProcess) stop(sig os.Signal) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	log.Info().Msgf("Stopping %v", p.name)
+
+	p.stopping = true
+
+	if p.process != nil {
+		if err := p.process.Signal(sig); err != nil {
+			log.Error().Err(err).Msgf("Unable to stop %v", p.name)
+		}
+	}
+}
+
+// testConfig runs a configuration test, counting the results
+func (p *proxyProcess) testConfig(binary string, args ...string) (string, error) {
+
+	outputBytes, err := exec.Command(binary, args...).CombinedOutput()
+
+	if err != nil {
+		p.metrics.ProxyConfigTests.WithLabelValues("failure").Inc()
+	} else {
+		p.metrics.ProxyConfigTests.WithLabelValues("success").Inc()
+	}
+
+	return string(outputBytes), err
+}
+
+// reloaded counts a reload
+func (p *proxyProcess) reloaded(err error) {
+
+	if err != nil {
+		p.metrics.ProxyReloads.WithLabelValues("failure").Inc()
+		log.Error().Msgf("Reload failed: %v", err)
+		return
+	}
+
+	p.metrics.ProxyReloads.WithLabelValues("success").Inc()
+	log.Info().Msg("Reload sent")
+}
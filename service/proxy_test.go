@@ -0,0 +1,83 @@
+package service
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stubCrashingNginx records its runs and exits right away
+const stubCrashingNginx = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/calls.log"
+exit 1
+`
+
+func TestProxyRestarts(t *testing.T) {
+
+	defer func(delay time.Duration) { restartDelay = delay }(restartDelay)
+	restartDelay = 0
+
+	tests := []struct {
+		name        string
+		maxRestarts int
+		runs        int
+	}{
+		{name: "exits with the proxy", maxRestarts: 0, runs: 1},
+		{name: "restarts in place", maxRestarts: 2, runs: 3},
+	}
+
+	for _, test := range tests {
+
+		binFolder := t.TempDir()
+
+		if err := ioutil.WriteFile(filepath.Join(binFolder, "nginx"), []byte(stubCrashingNginx), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &shared.Config{}
+		cfg.Nginx.Binary = filepath.Join(binFolder, "nginx")
+		cfg.Nginx.ConfigFolder = "/app/nginx"
+		cfg.Nginx.MainConfigFile = "nginx.conf"
+		cfg.Nginx.MaxRestarts = test.maxRestarts
+		cfg.Notify.WebhookURLs = []string{"http://127.0.0.1:1/hook"}
+
+		// the notifier isn't started, the events stay queued
+		metrics := shared.NewMetrics(cfg)
+		notifier := NewNotifier(cfg, NewGossipService(cfg, nil))
+		proxy := NewProxy(cfg, metrics, notifier)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+
+		// Start returns once it gives up
+		proxy.Start(&wg)
+		wg.Wait()
+
+		content, _ := ioutil.ReadFile(filepath.Join(binFolder, "calls.log"))
+
+		if runs := strings.Count(string(content), "daemon off;"); runs != test.runs {
+			t.Errorf("%v: expected %v runs, got %v", test.name, test.runs, runs)
+		}
+
+		if restarts := testutil.ToFloat64(metrics.ProxyRestarts); restarts != float64(test.maxRestarts) {
+			t.Errorf("%v: expected %v restarts counted, got %v", test.name, test.maxRestarts, restarts)
+		}
+
+		// every exit is reported, the last one before we exit too
+		if len(notifier.queue) != test.runs {
+			t.Errorf("%v: expected %v notifications, got %v", test.name, test.runs, len(notifier.queue))
+		}
+
+		for len(notifier.queue) > 0 {
+			if event := <-notifier.queue; event.Type != EventNginxRestarted || event.Subject != "nginx" {
+				t.Errorf("%v: unexpected event %+v", test.name, event)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+)
+
+// reasons for applying a change, or for holding it back
+const (
+	reloadNow          = "now"
+	reloadFirst        = "first configuration"
+	reloadForced       = "forced"
+	reloadRemoval      = "service removed"
+	reloadMaxDelay     = "maximum delay reached"
+	reloadQuiet        = "quiet window elapsed"
+	reloadWaitQuiet    = "waiting for a quiet window"
+	reloadWaitInterval = "minimum interval between reloads"
+)
+
+// ReloadScheduler decides when a detected change is handed over to nginx. During a rolling deployment every poll
+// finds a change: rather than reloading each time, and piling up old workers holding long-lived connections, changes
+// are applied once they stop for Nginx.ReloadQuietWindow, at most every Nginx.ReloadMinInterval. A change waits no
+// longer than Nginx.ReloadMaxDelay for the quiet window, and removed services are applied right away.
+type ReloadScheduler struct {
+	cfg *shared.Config
+
+	lock            sync.Mutex
+	pendingHash     string
+	pendingReason   string
+	firstPendingAt  time.Time
+	lastChangeAt    time.Time
+	lastReloadAt    time.Time
+	appliedServices map[string]bool
+}
+
+// PendingChange a change held back by the scheduler
+type PendingChange struct {
+	Hash         string
+	Since        time.Time
+	LastChangeAt time.Time
+	Reason       string
+}
+
+// NewReloadScheduler Creates a new reload scheduler
+func NewReloadScheduler(cfg *shared.Config) *ReloadScheduler {
+
+	ret := &ReloadScheduler{
+		cfg: cfg,
+	}
+
+	return ret
+}
+
+// Decide records the change to hash and returns whether to apply it now, and why
+func (s *ReloadScheduler) Decide(now time.Time, hash string, descrMap map[string]EcsServiceDescr, force bool) (bool, string) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	apply, reason := s.decide(now, hash, descrMap, force)
+
+	s.pendingReason = reason
+
+	return apply, reason
+}
+
+// decide the lock must be held
+func (s *ReloadScheduler) decide(now time.Time, hash string, descrMap map[string]EcsServiceDescr, force bool) (bool, string) {
+
+	settings := s.cfg.Current().Nginx
+
+	if hash != s.pendingHash {
+
+		if s.pendingHash == "" {
+			s.firstPendingAt = now
+		}
+
+		s.pendingHash = hash
+		s.lastChangeAt = now
+	}
+
+	switch {
+	case force:
+		return true, reloadForced
+	case s.appliedServices == nil:
+		return true, reloadFirst
+	case s.hasRemovedService(descrMap):
+		return true, reloadRemoval
+	case settings.ReloadQuietWindow <= 0 && settings.ReloadMinInterval <= 0:
+		return true, reloadNow
+	case now.Sub(s.lastReloadAt) < settings.ReloadMinInterval:
+		return false, reloadWaitInterval
+	case settings.ReloadMaxDelay > 0 && now.Sub(s.firstPendingAt) >= settings.ReloadMaxDelay:
+		return true, reloadMaxDelay
+	case now.Sub(s.lastChangeAt) >= settings.ReloadQuietWindow:
+		return true, reloadQuiet
+	default:
+		return false, reloadWaitQuiet
+	}
+}
+
+// Applied records that the services in descrMap have been handed over to nginx
+func (s *ReloadScheduler) Applied(now time.Time, descrMap map[string]EcsServiceDescr) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pendingHash = ""
+	s.lastReloadAt = now
+	s.appliedServices = make(map[string]bool)
+
+	for serviceName := range descrMap {
+		s.appliedServices[serviceName] = true
+	}
+}
+
+// Cancel forgets the pending change, e.g. when the services went back to what nginx has
+func (s *ReloadScheduler) Cancel() {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pendingHash = ""
+}
+
+// Pending returns the change held back, if any
+func (s *ReloadScheduler) Pending() *PendingChange {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pendingHash == "" {
+		return nil
+	}
+
+	return &PendingChange{
+		Hash:         s.pendingHash,
+		Since:        s.firstPendingAt,
+		LastChangeAt: s.lastChangeAt,
+		Reason:       s.pendingReason,
+	}
+}
+
+// NextDue returns how long until the pending change may be applied, false when nothing is pending
+func (s *ReloadScheduler) NextDue(now time.Time) (time.Duration, bool) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pendingHash == "" {
+		return 0, false
+	}
+
+	settings := s.cfg.Current().Nginx
+
+	due := s.lastChangeAt.Add(settings.ReloadQuietWindow)
+
+	if settings.ReloadMaxDelay > 0 && s.firstPendingAt.Add(settings.ReloadMaxDelay).Before(due) {
+		due = s.firstPendingAt.Add(settings.ReloadMaxDelay)
+	}
+
+	if minIntervalDue := s.lastReloadAt.Add(settings.ReloadMinInterval); minIntervalDue.After(due) {
+		due = minIntervalDue
+	}
+
+	if wait := due.Sub(now); wait > 0 {
+		return wait, true
+	}
+
+	return 0, true
+}
+
+// hasRemovedService the lock must be held
+func (s *ReloadScheduler) hasRemovedService(descrMap map[string]EcsServiceDescr) bool {
+
+	for serviceName := range s.appliedServices {
+		if _, found := descrMap[serviceName]; !found {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+)
+
+func TestReloadScheduler(t *testing.T) {
+
+	cfg := &shared.Config{}
+	cfg.Nginx.ReloadQuietWindow = 30 * time.Second
+	cfg.Nginx.ReloadMinInterval = 60 * time.Second
+	cfg.Nginx.ReloadMaxDelay = 120 * time.Second
+
+	scheduler := NewReloadScheduler(cfg)
+	start := time.Now()
+
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	descrMap := map[string]EcsServiceDescr{"web": {}, "api": {}}
+
+	expect := func(now time.Time, hash string, descrMap map[string]EcsServiceDescr, expectedApply bool, expectedReason string) {
+		t.Helper()
+
+		if apply, reason := scheduler.Decide(now, hash, descrMap, false); apply != expectedApply || reason != expectedReason {
+			t.Errorf("%v at %v: expected %v (%v), got %v (%v)", hash, now.Sub(start), expectedApply, expectedReason, apply, reason)
+		}
+	}
+
+	expect(at(0), "a", descrMap, true, reloadFirst)
+	scheduler.Applied(at(0), descrMap)
+
+	// too soon after the last reload
+	expect(at(10), "b", descrMap, false, reloadWaitInterval)
+
+	// a rolling deployment keeps changing things
+	expect(at(60), "c", descrMap, false, reloadWaitQuiet)
+	expect(at(80), "c", descrMap, false, reloadWaitQuiet)
+
+	if due, pending := scheduler.NextDue(at(80)); !pending || due != 10*time.Second {
+		t.Errorf("expected the change due in 10s, got %v %v", due, pending)
+	}
+
+	expect(at(90), "c", descrMap, true, reloadQuiet)
+	scheduler.Applied(at(90), descrMap)
+
+	if _, pending := scheduler.NextDue(at(90)); pending {
+		t.Error("nothing must be pending after a reload")
+	}
+
+	// never quiet, applied after the maximum delay
+	for seconds := 150; seconds < 270; seconds += 10 {
+		expect(at(seconds), string(rune('d'+seconds/10)), descrMap, false, reloadWaitQuiet)
+	}
+
+	expect(at(270), "z", descrMap, true, reloadMaxDelay)
+	scheduler.Applied(at(270), descrMap)
+
+	// removed services don't wait
+	expect(at(275), "removed", map[string]EcsServiceDescr{"web": {}}, true, reloadRemoval)
+
+	if apply, reason := scheduler.Decide(at(276), "forced", descrMap, true); !apply || reason != reloadForced {
+		t.Errorf("expected a forced reload, got %v (%v)", apply, reason)
+	}
+}
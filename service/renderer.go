@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"path/filepath"
+
+	"bitbucket.org/nnnco/rev-proxy/util"
+)
+
+// minSpareSlots the spare server slots of an HAProxy backend, at least
+const minSpareSlots = 4
+
+// templateFuncs the functions available to the upstreams templates
+var templateFuncs = template.FuncMap{
+	"spareSlots":     spareSlots,
+	"haproxyWeights": haproxyWeights,
+}
+
+// UpstreamOptions how the discovered services are turned into upstreams
+type UpstreamOptions struct {
+	// LocalZone the availability zone of this host
+	LocalZone string
+	// ZoneMinHealthy the healthy servers needed in LocalZone before the other zones become backups. 0 disables it.
+	ZoneMinHealthy int
+	// AddressFamily the address family of the services without an ingress.address-family tag, ipv4 or ipv6
+	AddressFamily string
+	// DownSet the endpoints failing their active health checks, see HealthChecker.DownSet
+	DownSet map[string]bool
+}
+
+// BuildUpstreams turns the discovered services into the upstreams handed to the template
+func BuildUpstreams(descrMap map[string]EcsServiceDescr, options UpstreamOptions) map[string]EcsServiceDescr {
+
+	upstreamMap := GroupUpstreams(MarkDown(SelectAddresses(descrMap, options.AddressFamily), options.DownSet))
+
+	return PreferLocalZone(upstreamMap, options.LocalZone, options.ZoneMinHealthy)
+}
+
+// RenderUpstreams renders the upstreams template with the discovered services, grouped into upstreams
+func RenderUpstreams(templatePath string, descrMap map[string]EcsServiceDescr, options UpstreamOptions) (*bytes.Buffer, error) {
+	return RenderUpstreamMap(templatePath, BuildUpstreams(descrMap, options))
+}
+
+// RenderUpstreamMap renders the upstreams template with upstreams built by BuildUpstreams
+func RenderUpstreamMap(templatePath string, upstreamMap map[string]EcsServiceDescr) (*bytes.Buffer, error) {
+
+	tmpl, err := template.New(filepath.Base(templatePath)).Funcs(templateFuncs).ParseFiles(templatePath)
+
+	if err != nil {
+		return nil, fmt.Errorf("Template parsing failed: %v", err.Error())
+	}
+
+	templateBuffer := new(bytes.Buffer)
+
+	if err := tmpl.Execute(templateBuffer, upstreamMap); err != nil {
+		return nil, fmt.Errorf("Template rendering failed: %v", err.Error())
+	}
+
+	return templateBuffer, nil
+}
+
+// spareSlots returns the indexes of the spare server slots following locationList: as many as there are locations,
+// so that a rolling deployment fits without a reload
+func spareSlots(locationList []EcsServiceIPPort) []int {
+
+	count := len(locationList)
+
+	if count < minSpareSlots {
+		count = minSpareSlots
+	}
+
+	retList := make([]int, 0, count)
+
+	for index := len(locationList); index < len(locationList)+count; index++ {
+		retList = append(retList, index)
+	}
+
+	return retList
+}
+
+// haproxyWeights returns the weights of the servers, in the order of locationList, scaled within what HAProxy accepts.
+// The group weights go up to hundreds per task, see GroupUpstreams.
+func haproxyWeights(locationList []EcsServiceIPPort) []int64 {
+
+	weightList := make([]int64, len(locationList))
+
+	for index, location := range locationList {
+		weightList[index] = location.Weight
+	}
+
+	return util.ScaleWeights(weightList, util.HAProxyMaxWeight)
+}
@@ -1,11 +1,11 @@
 package service
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
-	"html/template"
 	"io/ioutil"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"bitbucket.org/nnnco/rev-proxy/shared"
@@ -15,82 +15,585 @@ import (
 
 // RevProxyService simplified client to access ECS resources on AWS
 type RevProxyService struct {
-	cfg          *shared.Config
-	ecsService   *EcsService
-	nginxMonitor *NginxMonitor
-	s3Client     *util.S3Client
-	latestHash   string
+	cfg           *shared.Config
+	discovery     Discovery
+	proxy         Proxy
+	s3Client      util.S3API
+	metrics       *shared.Metrics
+	notifier      *Notifier
+	gossipService *GossipService
+	stateStore    *StateStore
+	latestHash    string
+
+	configReloader  *shared.ConfigReloader
+	healthChecker   *HealthChecker
+	reloadScheduler *ReloadScheduler
+	upstreamAPI     util.UpstreamAPI
+	localZone       string
+
+	reconcileLock sync.Mutex
+
+	lock            sync.RWMutex
+	paused          bool
+	pinnedVersion   string
+	driftHash       string
+	firstAppliedAt  time.Time
+	lastSuccessAt   time.Time
+	lastErrorAt     time.Time
+	lastErrorString string
+	restoredAt      time.Time
+	discoveredAt    time.Time
+	descrMap        map[string]EcsServiceDescr
+	applied         *AppliedConfig
+	history         []ReconcileResult
 }
 
+// AppliedConfig what has last been handed over to nginx. StructureHash only changes with what the server list updates
+// of the apply strategy can't do without a reload.
+type AppliedConfig struct {
+	Hash            string
+	StructureHash   string
+	AppliedAt       time.Time
+	BundleHash      string
+	BundleVersionID string
+	BundleETag      string
+	BundleFileList  []string
+	Rendered        map[string]string
+}
+
+// ReconcileResult the outcome of a single QueryAndUpdate run
+type ReconcileResult struct {
+	StartedAt  time.Time
+	DurationMs float64
+	Result     string
+	Error      string
+}
+
+// RevProxyState a read-only dump of everything the controller currently knows
+type RevProxyState struct {
+	Status              SyncStatus
+	Paused              bool
+	PinnedBundleVersion string
+	DriftHash           string
+	LatestHash          string
+	DiscoveredAt        time.Time
+	Services            map[string]EcsServiceDescr
+	Applied             *AppliedConfig
+	History             []ReconcileResult
+	HealthChecks        []HealthCheckStatus
+	PendingChange       *PendingChange
+}
+
+// SyncStatus a snapshot of how the reconcile loop is doing
+type SyncStatus struct {
+	FirstAppliedAt time.Time
+	RestoredAt     time.Time
+	LastSuccessAt  time.Time
+	LastErrorAt    time.Time
+	LastError      string
+}
+
+// reconcile results, also used as metric labels
+const (
+	resultUnchanged = "unchanged"
+	resultApplied   = "applied"
+	resultDrift     = "drift"
+	resultDeferred  = "deferred"
+	resultError     = "error"
+)
+
 // NewRevProxyService Creates a new rev proxy service
-func NewRevProxyService(cfg *shared.Config, ecsService *EcsService, nginxMonitor *NginxMonitor, s3Client *util.S3Client) *RevProxyService {
+func NewRevProxyService(cfg *shared.Config, discovery Discovery, proxy Proxy, s3Client util.S3API, metrics *shared.Metrics, notifier *Notifier, gossipService *GossipService, stateStore *StateStore, configReloader *shared.ConfigReloader, healthChecker *HealthChecker) *RevProxyService {
 
 	ret := &RevProxyService{
-		cfg:          cfg,
-		ecsService:   ecsService,
-		nginxMonitor: nginxMonitor,
-		s3Client:     s3Client,
+		cfg:             cfg,
+		discovery:       discovery,
+		proxy:           proxy,
+		s3Client:        s3Client,
+		metrics:         metrics,
+		notifier:        notifier,
+		gossipService:   gossipService,
+		stateStore:      stateStore,
+		configReloader:  configReloader,
+		healthChecker:   healthChecker,
+		reloadScheduler: NewReloadScheduler(cfg),
+		upstreamAPI:     proxy.UpstreamAPI(),
 	}
 
 	return ret
 }
 
+// SetLocalZone sets the availability zone of this host, for the zone-local preference. Must be called before Start.
+func (r *RevProxyService) SetLocalZone(localZone string) {
+	r.localZone = localZone
+}
+
 // Start starts this
 func (r *RevProxyService) Start() {
 
-	for range time.Tick(10 * time.Second) {
+	for {
 
 		err := r.QueryAndUpdate(false)
 
 		if err != nil {
 			log.Error().Err(err).Send()
 		}
+
+		// the interval can be changed by a config reload
+		wait := r.cfg.Current().Discovery.PollInterval
+
+		// a deferred change is applied as soon as it's due
+		if due, pending := r.reloadScheduler.NextDue(time.Now()); pending && due < wait {
+			wait = due
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-r.healthChecker.Changes():
+			log.Info().Msg("Endpoint health changed. Updating the upstreams")
+		}
 	}
 }
 
-// QueryAndUpdate runs the main routine
+// QueryAndUpdate runs the main routine. Changes may be deferred by the reload scheduler.
 func (r *RevProxyService) QueryAndUpdate(verbose bool) error {
+	return r.reconcile(verbose, false)
+}
+
+// Resync runs the main routine and applies any change right away
+func (r *RevProxyService) Resync() error {
+	return r.reconcile(true, true)
+}
+
+func (r *RevProxyService) reconcile(verbose bool, force bool) error {
+
+	start := time.Now()
+
+	// manual resyncs must not interleave with the polling loop
+	r.reconcileLock.Lock()
+	defer r.reconcileLock.Unlock()
+
+	result, err := r.queryAndUpdate(verbose, force)
+
+	if err != nil {
+		result = resultError
+	} else if result == resultApplied {
+		r.metrics.LastApplyTimestamp.SetToCurrentTime()
+	}
+
+	r.recordResult(result == resultApplied, err)
+	r.recordHistory(start, result, err)
+
+	r.metrics.ReconcileDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// Status returns the current sync status
+func (r *RevProxyService) Status() SyncStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return SyncStatus{
+		FirstAppliedAt: r.firstAppliedAt,
+		RestoredAt:     r.restoredAt,
+		LastSuccessAt:  r.lastSuccessAt,
+		LastErrorAt:    r.lastErrorAt,
+		LastError:      r.lastErrorString,
+	}
+}
+
+func (r *RevProxyService) recordResult(applied bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+
+	if err != nil {
+		r.lastErrorAt = now
+		r.lastErrorString = err.Error()
+		return
+	}
+
+	r.lastSuccessAt = now
+
+	if applied && r.firstAppliedAt.IsZero() {
+		r.firstAppliedAt = now
+	}
+}
+
+// State returns a copy of the current discovery and apply state
+func (r *RevProxyService) State() RevProxyState {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	history := make([]ReconcileResult, len(r.history))
+	copy(history, r.history)
+
+	return RevProxyState{
+		Status: SyncStatus{
+			FirstAppliedAt: r.firstAppliedAt,
+			RestoredAt:     r.restoredAt,
+			LastSuccessAt:  r.lastSuccessAt,
+			LastErrorAt:    r.lastErrorAt,
+			LastError:      r.lastErrorString,
+		},
+		Paused:              r.paused,
+		PinnedBundleVersion: r.pinnedVersion,
+		DriftHash:           r.driftHash,
+		LatestHash:          r.latestHash,
+		DiscoveredAt:        r.discoveredAt,
+		Services:            r.descrMap,
+		Applied:             r.applied,
+		History:             history,
+		HealthChecks:        r.healthChecker.Status(),
+		PendingChange:       r.reloadScheduler.Pending(),
+	}
+}
+
+// SetPaused stops (or resumes) applying changes to nginx. Discovery keeps running.
+func (r *RevProxyService) SetPaused(paused bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.paused = paused
+}
+
+// IsPaused returns true when changes are not being applied
+func (r *RevProxyService) IsPaused() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.paused
+}
+
+// PinBundleVersion makes us download a specific S3 version of the bundle. An empty version unpins.
+func (r *RevProxyService) PinBundleVersion(versionID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pinnedVersion = versionID
+}
+
+// PinnedBundleVersion returns the pinned S3 version of the bundle, if any
+func (r *RevProxyService) PinnedBundleVersion() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.pinnedVersion
+}
+
+func (r *RevProxyService) setDrift(hash string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.driftHash = hash
+}
+
+func (r *RevProxyService) recordHistory(start time.Time, result string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry := ReconcileResult{
+		StartedAt:  start,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		Result:     result,
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	r.history = append(r.history, entry)
+
+	// we only keep the most recent entries
+	if extra := len(r.history) - r.cfg.Current().Admin.HistorySize; extra > 0 {
+		r.history = r.history[extra:]
+	}
+}
+
+func (r *RevProxyService) recordDiscovery(descrMap map[string]EcsServiceDescr) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// we notify about services losing or regaining all their endpoints
+	if r.descrMap != nil {
+		for serviceName, descr := range descrMap {
+
+			previous, found := r.descrMap[serviceName]
+
+			if !found {
+				continue
+			}
+
+			if len(previous.LocationList) > 0 && len(descr.LocationList) == 0 {
+				r.notifier.Notify(EventServiceDown, serviceName, fmt.Sprintf("Service '%v' lost all its endpoints", serviceName), "")
+			}
+
+			if len(previous.LocationList) == 0 && len(descr.LocationList) > 0 {
+				r.notifier.Notify(EventServiceUp, serviceName, fmt.Sprintf("Service '%v' has %v endpoints again", serviceName, len(descr.LocationList)), "")
+			}
+		}
+
+		// services gone from the cluster lost their endpoints too
+		for serviceName, previous := range r.descrMap {
+			if _, found := descrMap[serviceName]; !found && len(previous.LocationList) > 0 {
+				r.notifier.Notify(EventServiceDown, serviceName, fmt.Sprintf("Service '%v' is gone with all its endpoints", serviceName), "")
+			}
+		}
+	}
+
+	r.discoveredAt = time.Now()
+	r.descrMap = descrMap
+}
+
+func (r *RevProxyService) recordApplied(applied *AppliedConfig) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.applied = applied
+}
+
+func (r *RevProxyService) setLatestHash(hash string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.latestHash = hash
+}
+
+// WithReconcileLock runs change while no reconcile is testing or reloading the configuration
+func (r *RevProxyService) WithReconcileLock(change func() error) error {
+
+	r.reconcileLock.Lock()
+	defer r.reconcileLock.Unlock()
+
+	return change()
+}
+
+// TestAndReload reloads nginx if its current configuration on disk passes the test
+func (r *RevProxyService) TestAndReload() error {
+
+	r.reconcileLock.Lock()
+	defer r.reconcileLock.Unlock()
+
+	_, err := r.testAndReload()
+
+	return err
+}
+
+func (r *RevProxyService) testAndReload() (string, error) {
+
+	output, err := r.proxy.TestConfig()
+
+	if err != nil {
+		return output, fmt.Errorf("Error testing NGINX configuration: %v - Unable to proceed", output)
+	}
+
+	log.Info().Msg("NGINX configuration test SUCCESS. Sending reload message")
+
+	// we send a reload
+	r.proxy.Reload()
+
+	return output, nil
+}
+
+// RestoreLastKnownGood writes the last saved configuration back to the config folder so that nginx
+// can start without AWS. We stay not ready until a sync succeeds.
+func (r *RevProxyService) RestoreLastKnownGood() error {
+
+	r.reconcileLock.Lock()
+	defer r.reconcileLock.Unlock()
+
+	state, bundle, err := r.stateStore.Load()
+
+	if err != nil {
+		return err
+	}
+
+	log.Warn().Msgf("Restoring last known good state %v saved at %v", state.Hash, state.SavedAt)
+
+	for fileName, content := range state.Rendered {
+		if err := ioutil.WriteFile(filepath.Join(r.cfg.Nginx.ConfigFolder, fileName), []byte(content), 0644); err != nil {
+			return fmt.Errorf("Unable to restore '%v': %v", fileName, err)
+		}
+	}
+
+	fileList, err := util.UnzipFileFromMemory(bundle, r.cfg.Nginx.ConfigFolder)
+
+	if err != nil {
+		return fmt.Errorf("Unable to extract saved bundle: %v", err)
+	}
+
+	if output, err := r.proxy.TestConfig(); err != nil {
+		return fmt.Errorf("Saved configuration fails the test: %v", output)
+	}
+
+	r.recordDiscovery(state.Services)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// latestHash stays empty so that the first successful sync applies and marks us ready
+	r.restoredAt = time.Now()
+	r.applied = &AppliedConfig{
+		Hash:            state.Hash,
+		AppliedAt:       state.SavedAt,
+		BundleHash:      util.HashBytes(bundle),
+		BundleVersionID: state.BundleVersionID,
+		BundleFileList:  fileList,
+		Rendered:        state.Rendered,
+	}
+
+	return nil
+}
+
+// downloadBundle fetches the config bundle from S3, or from disk when a local bundle is configured
+func (r *RevProxyService) downloadBundle() (*util.S3Object, error) {
+
+	if r.cfg.Nginx.ConfigBundleFile == "" {
+		return r.s3Client.DownloadObjectInMemory(r.cfg.Nginx.ConfigBundleS3Bucket, r.cfg.Nginx.ConfigBundleS3Key, r.PinnedBundleVersion())
+	}
+
+	bundle, err := ioutil.ReadFile(r.cfg.Nginx.ConfigBundleFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &util.S3Object{Bytes: bundle}, nil
+}
+
+// applyBundleSettings hands the controller settings shipped in the bundle, if any, to the config reloader
+func (r *RevProxyService) applyBundleSettings(fileList []string) {
+
+	settingsFile := r.cfg.Nginx.BundleSettingsFile
+
+	if settingsFile == "" {
+		return
+	}
+
+	settingsPath := filepath.Join(r.cfg.Nginx.ConfigFolder, settingsFile)
+
+	for _, filePath := range fileList {
+
+		if filePath != settingsPath {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(settingsPath)
+
+		if err != nil {
+			log.Error().Err(err).Msgf("Unable to read bundle settings '%v'", settingsPath)
+			return
+		}
+
+		r.configReloader.SetBundleSettings(settingsFile, content)
+		return
+	}
+
+	// removed from the bundle
+	r.configReloader.SetBundleSettings(settingsFile, nil)
+}
+
+// queryAndUpdate returns whether a new configuration has been applied to nginx
+func (r *RevProxyService) queryAndUpdate(verbose bool, force bool) (string, error) {
 
 	if verbose {
 		log.Info().Msg("QueryAndUpdate START")
 	}
 
-	// we then describe all tasks
-	descrMap, err := r.ecsService.GetServicesAndPorts(r.cfg.AWS.ClusterName)
+	var descrMap map[string]EcsServiceDescr
 
-	if err != nil {
-		return fmt.Errorf("GetServicesAndPorts failed: %v", err.Error())
+	// the leader already did the AWS calls for us
+	if snapshot := r.gossipService.LatestSnapshot(time.Now()); snapshot != nil {
+
+		descrMap = snapshot.Services
+
+		if verbose {
+			log.Info().Msgf("Using discovery snapshot from leader '%v'", snapshot.From)
+		}
+
+	} else {
+
+		// we then describe all tasks
+		tmpDescrMap, err := r.discovery.GetServicesAndPorts(r.cfg.AWS.ClusterName)
+
+		if err != nil {
+			return resultError, fmt.Errorf("GetServicesAndPorts failed: %v", err.Error())
+		}
+
+		descrMap = tmpDescrMap
+
+		r.gossipService.PublishSnapshot(descrMap)
 	}
 
+	endpointCount := 0
+
+	for _, descr := range descrMap {
+		endpointCount += len(descr.LocationList)
+	}
+
+	r.metrics.DiscoveredServices.Set(float64(len(descrMap)))
+	r.metrics.DiscoveredEndpoints.Set(float64(endpointCount))
+
+	r.recordDiscovery(descrMap)
+
+	r.healthChecker.SetTargets(descrMap, r.cfg.Discovery.AddressFamily)
+
 	if verbose {
 		log.Info().Msgf("GetServicesAndPorts SUCCEEDED: %v services found", len(descrMap))
 	}
 
 	upstreamsTemplatePath := filepath.Join(r.cfg.Nginx.ConfigFolder, r.cfg.Nginx.UpstreamsTemplateFile)
-	upstreamsConfigPath := filepath.Join(r.cfg.Nginx.ConfigFolder, r.cfg.Nginx.UpstreamsConfigFile)
 
 	if verbose {
 		log.Info().Msgf("Reading template %v", upstreamsTemplatePath)
 	}
 
-	tmpl, err := template.ParseFiles(upstreamsTemplatePath)
+	upstreamMap := BuildUpstreams(descrMap, UpstreamOptions{
+		LocalZone:      r.localZone,
+		ZoneMinHealthy: r.cfg.Discovery.ZoneMinHealthy,
+		AddressFamily:  r.cfg.Discovery.AddressFamily,
+		DownSet:        r.healthChecker.DownSet(),
+	})
+
+	templateBuffer, err := RenderUpstreamMap(upstreamsTemplatePath, upstreamMap)
 
 	if err != nil {
-		return fmt.Errorf("Template parsing failed: %v", err.Error())
+		return resultError, err
 	}
 
-	templateBuffer := new(bytes.Buffer)
-	tmpl.Execute(templateBuffer, descrMap)
+	// the files written next to the bundle
+	rendered := map[string]string{
+		r.cfg.Nginx.UpstreamsConfigFile: templateBuffer.String(),
+	}
+
+	// the Lua module loads the server lists when nginx starts or reloads
+	if r.cfg.Nginx.ApplyStrategy == ApplyStrategyOpenResty {
+
+		serverSets, err := json.Marshal(UpstreamServerSets(upstreamMap))
+
+		if err != nil {
+			return resultError, fmt.Errorf("Unable to encode the server lists: %v", err)
+		}
+
+		rendered[DynamicUpstreamsFileName] = string(serverSets)
+	}
 
-	currentUpstreamHash := util.HashBuffer(templateBuffer)
+	currentUpstreamHash := util.HashBytes([]byte(templateBuffer.String() + rendered[DynamicUpstreamsFileName]))
 
 	// we download the nginx config file
-	nginxConfBundleBytes, err := r.s3Client.DownloadFileInMemory(r.cfg.Nginx.ConfigBundleS3Bucket, r.cfg.Nginx.ConfigBundleS3Key)
+	nginxConfBundle, err := r.downloadBundle()
 
 	if err != nil {
-		return fmt.Errorf("Unable to download NGINX config bundle: %v", err.Error())
+		r.metrics.BundleDownloadErrors.Inc()
+		return resultError, fmt.Errorf("Unable to download NGINX config bundle: %v", err.Error())
 	}
 
+	nginxConfBundleBytes := nginxConfBundle.Bytes
+
+	r.metrics.BundleDownloadBytes.Add(float64(len(nginxConfBundleBytes)))
+
 	if verbose {
 		log.Info().Msgf("Nginx config bundle downloaded: %v bytes", len(nginxConfBundleBytes))
 	}
@@ -100,36 +603,90 @@ func (r *RevProxyService) QueryAndUpdate(verbose bool) error {
 
 	// nothing has changed
 	if currentHash == r.latestHash {
-		return err
+		r.setDrift("")
+		r.reloadScheduler.Cancel()
+		return resultUnchanged, nil
+	}
+
+	// we keep discovering but leave nginx alone
+	if r.IsPaused() {
+		r.setDrift(currentHash)
+		log.Warn().Msgf("Change detected %v while updates are PAUSED. Not applying", currentHash)
+		return resultDrift, nil
+	}
+
+	r.setDrift("")
+
+	structureHash := ""
+
+	if r.upstreamAPI != nil {
+
+		skeletonBuffer, err := RenderUpstreamMap(upstreamsTemplatePath, StripServers(upstreamMap))
+
+		if err != nil {
+			return resultError, err
+		}
+
+		structureHash = fmt.Sprintf("%v-%v", util.HashBuffer(skeletonBuffer), currentNginxHash)
+
+		// only the server lists changed, the running nginx takes them without a reload
+		if previous := r.State().Applied; previous != nil && previous.StructureHash == structureHash {
+
+			if !templateTakesPushes(r.cfg.Nginx.ApplyStrategy, skeletonBuffer.Bytes()) {
+
+				log.Warn().Msgf("Template %v doesn't balance through the %v Lua module, pushed servers would be ignored. Reloading instead", upstreamsTemplatePath, OpenRestyModule)
+
+			} else if err := r.updateUpstreams(previous, upstreamMap, rendered, currentHash, structureHash); err != nil {
+
+				log.Warn().Err(err).Msg("Dynamic upstream update failed. Falling back to a reload")
+
+			} else {
+
+				r.saveState(r.State().Applied, descrMap, nginxConfBundleBytes)
+				return resultApplied, nil
+			}
+		}
+	}
+
+	// during deployments we wait for the changes to settle
+	apply, reason := r.reloadScheduler.Decide(time.Now(), currentHash, descrMap, force)
+
+	if !apply {
+		log.Info().Msgf("Change detected %v. Reload deferred: %v", currentHash, reason)
+		return resultDeferred, nil
+	}
+
+	if reason != reloadNow && reason != reloadFirst {
+		log.Info().Msgf("Applying change %v: %v", currentHash, reason)
 	}
 
 	// we store a reference
-	r.latestHash = currentHash
+	r.setLatestHash(currentHash)
 
 	log.Info().Msgf("Change detected %v. Nginx file size: %v bytes", r.latestHash, len(nginxConfBundleBytes))
 
 	// we update the upstreams file
-	err = ioutil.WriteFile(upstreamsConfigPath, templateBuffer.Bytes(), 0644)
+	err = r.writeRendered(rendered)
 
 	if verbose {
 		log.Info().Msgf("Upstreams config: %v", string(templateBuffer.Bytes()))
 	}
 
 	if err != nil {
-		return fmt.Errorf("Nginx upstream file update failed: %v", err)
+		return resultError, err
 	}
 
 	// we unzip the main config bundle into the config folder
 	fileList, err := util.UnzipFileFromMemory(nginxConfBundleBytes, r.cfg.Nginx.ConfigFolder)
 
 	if err != nil {
-		return fmt.Errorf("Unable to extract bundle: %v", err)
+		return resultError, fmt.Errorf("Unable to extract bundle: %v", err)
 	}
 
 	log.Info().Msgf("%v files extracted.", len(fileList))
 
 	if len(fileList) == 0 {
-		return fmt.Errorf("Bundle contained NO files")
+		return resultError, fmt.Errorf("Bundle contained NO files")
 	}
 
 	for _, filePath := range fileList {
@@ -140,24 +697,100 @@ func (r *RevProxyService) QueryAndUpdate(verbose bool) error {
 	mainConfigFile := filepath.Join(r.cfg.Nginx.ConfigFolder, r.cfg.Nginx.MainConfigFile)
 
 	if !util.FileExists(mainConfigFile) {
-		return fmt.Errorf("Nginx config file NOT found under '%v'", mainConfigFile)
+		return resultError, fmt.Errorf("Nginx config file NOT found under '%v'", mainConfigFile)
 	}
 
-	// we test the new configuration first
-	output, err := r.nginxMonitor.TestConfig()
+	// we test the new configuration first and reload
+	if output, err := r.testAndReload(); err != nil {
+		r.notifier.Notify(EventBundleRejected, currentNginxHash, fmt.Sprintf("Nginx rejected the new configuration (bundle version '%v')", nginxConfBundle.VersionID), output)
+		return resultError, err
+	}
 
-	if err != nil {
-		return fmt.Errorf("Error testing NGINX configuration: %v - Unable to proceed", output)
+	r.reloadScheduler.Applied(time.Now(), descrMap)
+
+	r.applyBundleSettings(fileList)
+
+	if previous := r.State().Applied; previous == nil || previous.BundleHash != currentNginxHash {
+		r.notifier.Notify(EventBundleApplied, currentNginxHash, fmt.Sprintf("Nginx config bundle applied (version '%v', %v files)", nginxConfBundle.VersionID, len(fileList)), "")
 	}
 
-	log.Info().Msg("NGINX configuration test SUCCESS. Sending reload message")
+	applied := &AppliedConfig{
+		Hash:            currentHash,
+		StructureHash:   structureHash,
+		AppliedAt:       time.Now(),
+		BundleHash:      currentNginxHash,
+		BundleVersionID: nginxConfBundle.VersionID,
+		BundleETag:      nginxConfBundle.ETag,
+		BundleFileList:  fileList,
+		Rendered:        rendered,
+	}
 
-	// we send a reload
-	r.nginxMonitor.Reload()
+	r.recordApplied(applied)
+
+	r.saveState(applied, descrMap, nginxConfBundleBytes)
 
 	if verbose {
 		log.Info().Msg("QueryAndUpdate SUCCESS")
 	}
 
+	return resultApplied, nil
+}
+
+// updateUpstreams pushes the server lists to the running nginx, and writes the rendered files for its next reload
+func (r *RevProxyService) updateUpstreams(previous *AppliedConfig, upstreamMap map[string]EcsServiceDescr, rendered map[string]string, currentHash string, structureHash string) error {
+
+	if err := r.upstreamAPI.UpdateUpstreams(UpstreamServerSets(upstreamMap)); err != nil {
+		r.metrics.DynamicUpdates.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	r.metrics.DynamicUpdates.WithLabelValues("success").Inc()
+
+	r.setLatestHash(currentHash)
+	r.reloadScheduler.Cancel()
+
+	log.Info().Msgf("Change detected %v. Server lists updated without a reload", currentHash)
+
+	// nginx already has the servers, the files only matter to its next reload
+	if err := r.writeRendered(rendered); err != nil {
+		log.Error().Err(err).Send()
+	}
+
+	applied := *previous
+	applied.Hash = currentHash
+	applied.StructureHash = structureHash
+	applied.AppliedAt = time.Now()
+	applied.Rendered = rendered
+
+	r.recordApplied(&applied)
+
 	return nil
 }
+
+// writeRendered writes the rendered files into the config folder
+func (r *RevProxyService) writeRendered(rendered map[string]string) error {
+
+	for fileName, content := range rendered {
+		if err := ioutil.WriteFile(filepath.Join(r.cfg.Nginx.ConfigFolder, fileName), []byte(content), 0644); err != nil {
+			return fmt.Errorf("Nginx upstream file update failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// saveState keeps what works in case AWS is unreachable at the next boot
+func (r *RevProxyService) saveState(applied *AppliedConfig, descrMap map[string]EcsServiceDescr, bundle []byte) {
+
+	err := r.stateStore.Save(&PersistedState{
+		SavedAt:         applied.AppliedAt,
+		Hash:            applied.Hash,
+		BundleVersionID: applied.BundleVersionID,
+		Services:        descrMap,
+		Rendered:        applied.Rendered,
+	}, bundle)
+
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to save last known good state")
+	}
+}
@@ -0,0 +1,377 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+)
+
+// stubNginx records its arguments and rejects any config containing "invalid_directive"
+const stubNginx = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/calls.log"
+if [ "$3" = "-t" ] && grep -q invalid_directive "$2"; then
+	echo "unknown directive \"invalid_directive\""
+	exit 1
+fi
+exit 0
+`
+
+const (
+	testBucket    = "config"
+	testBundleKey = "bundle.zip"
+)
+
+// revProxyFixture a rev proxy service wired to a fake cluster, a fake S3 and a stub nginx
+type revProxyFixture struct {
+	t               *testing.T
+	cfg             *shared.Config
+	cluster         *fakeaws.Cluster
+	s3              *fakeaws.S3
+	revProxyService *RevProxyService
+	binFolder       string
+}
+
+func newRevProxyFixture(t *testing.T) *revProxyFixture {
+
+	binFolder := t.TempDir()
+
+	if err := ioutil.WriteFile(filepath.Join(binFolder, "nginx"), []byte(stubNginx), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &shared.Config{}
+	cfg.AWS.ClusterName = "prod"
+	cfg.Nginx.Binary = filepath.Join(binFolder, "nginx")
+	cfg.Nginx.ConfigFolder = t.TempDir()
+	cfg.Nginx.UpstreamsTemplateFile = "upstreams.conf.tmpl"
+	cfg.Nginx.UpstreamsConfigFile = "upstreams.conf"
+	cfg.Nginx.MainConfigFile = "nginx.conf"
+	cfg.Nginx.ConfigBundleS3Bucket = testBucket
+	cfg.Nginx.ConfigBundleS3Key = testBundleKey
+	cfg.Admin.HistorySize = 10
+	cfg.State.Folder = t.TempDir()
+
+	cluster := fakeaws.NewCluster("prod")
+	fakeS3 := fakeaws.NewS3()
+	metrics := shared.NewMetrics(cfg)
+
+	s3Client := util.NewS3ClientFromAPI(cfg, fakeS3)
+	gossipService := NewGossipService(cfg, nil)
+	notifier := NewNotifier(cfg, gossipService)
+	nginxMonitor := NewNginxMonitor(cfg, metrics, notifier)
+	stateStore := NewStateStore(cfg, s3Client, gossipService)
+
+	ret := &revProxyFixture{
+		t:               t,
+		cfg:             cfg,
+		cluster:         cluster,
+		s3:              fakeS3,
+		revProxyService: NewRevProxyService(cfg, newFakeEcsService(cluster), nginxMonitor, s3Client, metrics, notifier, gossipService, stateStore, shared.NewConfigReloader(cfg, metrics), NewHealthChecker(cfg, metrics)),
+		binFolder:       binFolder,
+	}
+
+	ret.useTemplate("../data/upstreams.conf.tmpl")
+
+	return ret
+}
+
+// useTemplate replaces the stock upstreams template
+func (f *revProxyFixture) useTemplate(templatePath string) {
+
+	template, err := ioutil.ReadFile(templatePath)
+
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(f.cfg.Nginx.ConfigFolder, f.cfg.Nginx.UpstreamsTemplateFile), template, 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// putBundle uploads a bundle made of the given files and returns its version id
+func (f *revProxyFixture) putBundle(fileMap map[string]string) string {
+
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+
+	for name, content := range fileMap {
+
+		writer, err := zipWriter.Create(name)
+
+		if err != nil {
+			f.t.Fatal(err)
+		}
+
+		writer.Write([]byte(content))
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		f.t.Fatal(err)
+	}
+
+	return f.s3.Put(testBucket, testBundleKey, buf.Bytes())
+}
+
+func (f *revProxyFixture) readConfig(fileName string) string {
+
+	content, err := ioutil.ReadFile(filepath.Join(f.cfg.Nginx.ConfigFolder, fileName))
+
+	if err != nil {
+		f.t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+// nginxCalls returns how many times the stub was called with the given arguments
+func (f *revProxyFixture) nginxCalls(args string) int {
+
+	content, _ := ioutil.ReadFile(filepath.Join(f.binFolder, "calls.log"))
+
+	return strings.Count(string(content), args)
+}
+
+func TestQueryAndUpdate(t *testing.T) {
+
+	f := newRevProxyFixture(t)
+
+	instance := f.cluster.AddInstance("10.0.0.1", "")
+	f.cluster.AddService("web")
+	f.cluster.AddTask("web", instance, 32768, 80)
+
+	versionID := f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("first QueryAndUpdate failed: %v", err)
+	}
+
+	if upstreams := f.readConfig("upstreams.conf"); !strings.Contains(upstreams, "server 10.0.0.1:32768;") {
+		t.Errorf("unexpected upstreams:\n%v", upstreams)
+	}
+
+	if conf := f.readConfig("nginx.conf"); !strings.Contains(conf, "include upstreams.conf") {
+		t.Errorf("bundle not extracted, nginx.conf is:\n%v", conf)
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 1 {
+		t.Errorf("expected 1 reload, got %v", calls)
+	}
+
+	state := f.revProxyService.State()
+
+	if state.Applied == nil || state.Applied.BundleVersionID != versionID {
+		t.Errorf("expected bundle version %v to be applied, got %+v", versionID, state.Applied)
+	}
+
+	if !util.FileExists(filepath.Join(f.cfg.State.Folder, stateFileName)) {
+		t.Error("expected the last known good state to be saved")
+	}
+
+	// nothing changed
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("second QueryAndUpdate failed: %v", err)
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 1 {
+		t.Errorf("expected no reload without changes, got %v reloads", calls)
+	}
+
+	// a new task
+	f.cluster.AddTask("web", instance, 32769, 80)
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("QueryAndUpdate after a new task failed: %v", err)
+	}
+
+	if upstreams := f.readConfig("upstreams.conf"); !strings.Contains(upstreams, "server 10.0.0.1:32769;") {
+		t.Errorf("new task missing from upstreams:\n%v", upstreams)
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 2 {
+		t.Errorf("expected 2 reloads, got %v", calls)
+	}
+
+	history := f.revProxyService.State().History
+
+	if len(history) != 3 || history[0].Result != resultApplied || history[1].Result != resultUnchanged || history[2].Result != resultApplied {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestQueryAndUpdateRejectedBundle(t *testing.T) {
+
+	f := newRevProxyFixture(t)
+
+	f.cluster.AddService("web")
+	f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("first QueryAndUpdate failed: %v", err)
+	}
+
+	f.putBundle(map[string]string{"nginx.conf": "http { invalid_directive; }\n"})
+
+	if err := f.revProxyService.QueryAndUpdate(false); err == nil {
+		t.Fatal("expected the invalid bundle to be rejected")
+	}
+
+	if calls := f.nginxCalls("-s reload"); calls != 1 {
+		t.Errorf("expected no reload for the rejected bundle, got %v reloads", calls)
+	}
+
+	if status := f.revProxyService.Status(); !strings.Contains(status.LastError, "invalid_directive") {
+		t.Errorf("expected the nginx output in the last error, got '%v'", status.LastError)
+	}
+}
+
+func TestQueryAndUpdatePaused(t *testing.T) {
+
+	f := newRevProxyFixture(t)
+
+	instance := f.cluster.AddInstance("10.0.0.1", "")
+	f.cluster.AddService("web")
+	f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("first QueryAndUpdate failed: %v", err)
+	}
+
+	f.revProxyService.SetPaused(true)
+	f.cluster.AddTask("web", instance, 32768, 80)
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("paused QueryAndUpdate failed: %v", err)
+	}
+
+	if f.revProxyService.State().DriftHash == "" {
+		t.Error("expected a drift while paused")
+	}
+
+	if upstreams := f.readConfig("upstreams.conf"); strings.Contains(upstreams, "32768") {
+		t.Errorf("upstreams changed while paused:\n%v", upstreams)
+	}
+
+	f.revProxyService.SetPaused(false)
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("resumed QueryAndUpdate failed: %v", err)
+	}
+
+	if upstreams := f.readConfig("upstreams.conf"); !strings.Contains(upstreams, "32768") {
+		t.Errorf("upstreams not updated after resuming:\n%v", upstreams)
+	}
+}
+
+func TestRestoreLastKnownGood(t *testing.T) {
+
+	f := newRevProxyFixture(t)
+
+	instance := f.cluster.AddInstance("10.0.0.1", "")
+	f.cluster.AddService("web")
+	f.cluster.AddTask("web", instance, 32768, 80)
+	f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("QueryAndUpdate failed: %v", err)
+	}
+
+	// a fresh boot with an empty config folder and AWS down
+	for _, fileName := range []string{"upstreams.conf", "nginx.conf"} {
+		os.Remove(filepath.Join(f.cfg.Nginx.ConfigFolder, fileName))
+	}
+
+	f.cluster.Throttle("ListServices", 1)
+
+	if err := f.revProxyService.QueryAndUpdate(false); err == nil {
+		t.Fatal("expected the discovery to fail")
+	}
+
+	if err := f.revProxyService.RestoreLastKnownGood(); err != nil {
+		t.Fatalf("RestoreLastKnownGood failed: %v", err)
+	}
+
+	if upstreams := f.readConfig("upstreams.conf"); !strings.Contains(upstreams, "server 10.0.0.1:32768;") {
+		t.Errorf("unexpected restored upstreams:\n%v", upstreams)
+	}
+
+	if !util.FileExists(filepath.Join(f.cfg.Nginx.ConfigFolder, "nginx.conf")) {
+		t.Error("expected the saved bundle to be extracted")
+	}
+}
+
+func TestQueryAndUpdateDefersReloads(t *testing.T) {
+
+	f := newRevProxyFixture(t)
+	f.cfg.Nginx.ReloadQuietWindow = time.Hour
+
+	instance := f.cluster.AddInstance("10.0.0.1", "")
+	f.cluster.AddService("web")
+	f.cluster.AddTask("web", instance, 32768, 80)
+
+	f.putBundle(map[string]string{"nginx.conf": "http { include upstreams.conf; }\n"})
+
+	// the first configuration is never held back
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("first QueryAndUpdate failed: %v", err)
+	}
+
+	f.cluster.AddTask("web", instance, 32769, 80)
+
+	if err := f.revProxyService.QueryAndUpdate(false); err != nil {
+		t.Fatalf("QueryAndUpdate failed: %v", err)
+	}
+
+	state := f.revProxyService.State()
+
+	if calls := f.nginxCalls("-s reload"); calls != 1 || state.PendingChange == nil || state.History[1].Result != resultDeferred {
+		t.Errorf("expected the change to be deferred, got %v reloads and %+v", calls, state.PendingChange)
+	}
+
+	if err := f.revProxyService.Resync(); err != nil {
+		t.Fatalf("Resync failed: %v", err)
+	}
+
+	if upstreams := f.readConfig("upstreams.conf"); !strings.Contains(upstreams, "server 10.0.0.1:32769;") || f.revProxyService.State().PendingChange != nil {
+		t.Errorf("expected the resync to apply the change:\n%v", upstreams)
+	}
+}
+
+func TestRecordDiscoveryNotifies(t *testing.T) {
+
+	f := newRevProxyFixture(t)
+	f.cfg.Notify.WebhookURLs = []string{"http://127.0.0.1:1/hook"}
+
+	location := []EcsServiceIPPort{{PrivateIPAddress: "10.0.0.1", Port: 32768}}
+
+	f.revProxyService.recordDiscovery(map[string]EcsServiceDescr{
+		"web": {ServiceName: "web", LocationList: location},
+		"api": {ServiceName: "api", LocationList: location},
+		"job": {ServiceName: "job"},
+	})
+
+	// api loses its tasks, web is deleted, job has no endpoints to lose
+	f.revProxyService.recordDiscovery(map[string]EcsServiceDescr{
+		"api": {ServiceName: "api"},
+	})
+
+	eventMap := make(map[string]string)
+
+	for len(f.revProxyService.notifier.queue) > 0 {
+		event := <-f.revProxyService.notifier.queue
+		eventMap[event.Subject] = event.Type
+	}
+
+	if len(eventMap) != 2 || eventMap["api"] != EventServiceDown || eventMap["web"] != EventServiceDown {
+		t.Errorf("expected api and web down, got %v", eventMap)
+	}
+}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"github.com/rs/zerolog/log"
+)
+
+// route53 routing policies
+const (
+	RoutingPolicySimple     = "simple"
+	RoutingPolicyMultiValue = "multivalue"
+	RoutingPolicyWeighted   = "weighted"
+)
+
+// Route53Service keeps a DNS record set in sync with the instances running the ingress daemon
+type Route53Service struct {
+	cfg           *shared.Config
+	ecsService    *EcsService
+	route53Client util.Route53API
+	gossipService *GossipService
+}
+
+// NewRoute53Service Creates a new route53 service
+func NewRoute53Service(cfg *shared.Config, ecsService *EcsService, route53Client util.Route53API, gossipService *GossipService) *Route53Service {
+
+	ret := &Route53Service{
+		cfg:           cfg,
+		ecsService:    ecsService,
+		route53Client: route53Client,
+		gossipService: gossipService,
+	}
+
+	return ret
+}
+
+// Start syncs the record set forever
+func (r *Route53Service) Start() {
+
+	log.Info().Msgf("Route53 service START for '%v' in zone '%v'", r.cfg.Route53.RecordName, r.cfg.Route53.HostedZoneID)
+
+	for ; ; time.Sleep(r.cfg.Current().Route53.SyncInterval) {
+
+		// a single writer is enough
+		if !r.gossipService.IsLeader() {
+			continue
+		}
+
+		instanceList, err := r.ecsService.GetServiceInstances(r.cfg.AWS.ClusterName, r.cfg.AWS.DaemonServiceName)
+
+		if err == nil {
+			err = r.Sync(instanceList)
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msg("Route53 sync failed")
+		}
+	}
+}
+
+// Sync makes the record set (and its health checks) reflect the given instances
+func (r *Route53Service) Sync(instanceList []util.Ec2Instance) error {
+
+	zoneID := r.cfg.Route53.HostedZoneID
+	recordName := r.recordName()
+	recordType := r.cfg.Route53.RecordType
+
+	// instance id -> address
+	addressMap := make(map[string]string)
+
+	for _, instance := range instanceList {
+		if address := r.instanceAddress(instance); address != "" {
+			addressMap[instance.InstanceID] = address
+		}
+	}
+
+	// an empty record set would take the whole ingress off DNS
+	if len(addressMap) == 0 {
+		return fmt.Errorf("No %v address found for daemon service '%v' - leaving %v untouched", recordType, r.cfg.AWS.DaemonServiceName, recordName)
+	}
+
+	healthCheckMap, staleHealthCheckList, err := r.syncHealthChecks(addressMap)
+
+	if err != nil {
+		return err
+	}
+
+	desiredList := r.desiredRecords(recordName, addressMap, healthCheckMap)
+
+	currentList, err := r.route53Client.ListRecords(zoneID, recordName, recordType)
+
+	if err != nil {
+		return fmt.Errorf("Unable to list %v records for %v: %v", recordType, recordName, err)
+	}
+
+	upsertList, deleteList := diffRecords(currentList, desiredList)
+
+	if len(upsertList) > 0 || len(deleteList) > 0 {
+
+		log.Info().Msgf("Updating Route53 %v %v: %v upserts, %v deletes", recordType, recordName, len(upsertList), len(deleteList))
+
+		if err := r.route53Client.ChangeRecords(zoneID, upsertList, deleteList); err != nil {
+			return fmt.Errorf("Unable to update %v records for %v: %v", recordType, recordName, err)
+		}
+	}
+
+	// health checks can only go once no record references them
+	for _, healthCheck := range staleHealthCheckList {
+
+		log.Info().Msgf("Deleting Route53 health check %v for %v", healthCheck.HealthCheckID, healthCheck.IPAddress)
+
+		if err := r.route53Client.DeleteHealthCheck(healthCheck.HealthCheckID); err != nil {
+			log.Error().Err(err).Msgf("Unable to delete health check %v", healthCheck.HealthCheckID)
+		}
+	}
+
+	return nil
+}
+
+// syncHealthChecks creates missing health checks and returns the ones to delete
+func (r *Route53Service) syncHealthChecks(addressMap map[string]string) (map[string]string, []util.Route53HealthCheck, error) {
+
+	// address -> health check id
+	healthCheckMap := make(map[string]string)
+	staleList := make([]util.Route53HealthCheck, 0)
+
+	if r.cfg.Route53.HealthCheckPort == 0 {
+		return healthCheckMap, staleList, nil
+	}
+
+	existingList, err := r.route53Client.ListHealthChecks()
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to list health checks: %v", err)
+	}
+
+	wantedAddresses := make(map[string]bool)
+
+	// simple records take no health checks, the ones of another policy go
+	for _, address := range addressMap {
+		wantedAddresses[address] = r.cfg.Route53.RoutingPolicy != RoutingPolicySimple
+	}
+
+	prefix := r.callerReferencePrefix()
+
+	for _, healthCheck := range existingList {
+
+		// we only manage the ones we created
+		if !strings.HasPrefix(healthCheck.CallerReference, prefix) {
+			continue
+		}
+
+		if wantedAddresses[healthCheck.IPAddress] && healthCheck.Port == r.cfg.Route53.HealthCheckPort && healthCheck.Path == r.cfg.Route53.HealthCheckPath {
+			healthCheckMap[healthCheck.IPAddress] = healthCheck.HealthCheckID
+		} else {
+			staleList = append(staleList, healthCheck)
+		}
+	}
+
+	addressList := make([]string, 0, len(wantedAddresses))
+
+	for address := range wantedAddresses {
+		addressList = append(addressList, address)
+	}
+
+	// stable creation order, easier to follow in the logs
+	sort.Strings(addressList)
+
+	for _, address := range addressList {
+
+		if _, found := healthCheckMap[address]; found || !wantedAddresses[address] {
+			continue
+		}
+
+		callerReference := fmt.Sprintf("%v%v", prefix, time.Now().UnixNano())
+
+		healthCheckID, err := r.route53Client.CreateHealthCheck(callerReference, address, r.cfg.Route53.HealthCheckPort, r.cfg.Route53.HealthCheckPath)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to create health check for %v: %v", address, err)
+		}
+
+		log.Info().Msgf("Created Route53 health check %v for %v", healthCheckID, address)
+
+		healthCheckMap[address] = healthCheckID
+	}
+
+	return healthCheckMap, staleList, nil
+}
+
+// desiredRecords builds the record sets for the configured routing policy
+func (r *Route53Service) desiredRecords(recordName string, addressMap map[string]string, healthCheckMap map[string]string) []util.Route53Record {
+
+	retList := make([]util.Route53Record, 0)
+
+	if r.cfg.Route53.RoutingPolicy == RoutingPolicySimple {
+
+		valueList := make([]string, 0)
+
+		for _, address := range addressMap {
+			valueList = append(valueList, address)
+		}
+
+		sort.Strings(valueList)
+
+		return append(retList, util.Route53Record{
+			Name:   recordName,
+			Type:   r.cfg.Route53.RecordType,
+			TTL:    r.cfg.Route53.TTL,
+			Values: valueList,
+		})
+	}
+
+	// one record set per instance
+	for instanceID, address := range addressMap {
+
+		record := util.Route53Record{
+			Name:          recordName,
+			Type:          r.cfg.Route53.RecordType,
+			TTL:           r.cfg.Route53.TTL,
+			SetIdentifier: instanceID,
+			HealthCheckID: healthCheckMap[address],
+			Values:        []string{address},
+		}
+
+		if r.cfg.Route53.RoutingPolicy == RoutingPolicyWeighted {
+			record.Weight = r.cfg.Route53.Weight
+		} else {
+			record.MultiValue = true
+		}
+
+		retList = append(retList, record)
+	}
+
+	return retList
+}
+
+func (r *Route53Service) instanceAddress(instance util.Ec2Instance) string {
+
+	if r.cfg.Route53.RecordType == "AAAA" {
+		return instance.IPv6Address
+	}
+
+	if r.cfg.Route53.AddressType == "private" {
+		return instance.PrivateIPAddress
+	}
+
+	return instance.PublicIPAddress
+}
+
+// recordName returns the fully qualified name as route53 reports it
+func (r *Route53Service) recordName() string {
+
+	name := strings.ToLower(r.cfg.Route53.RecordName)
+
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return name
+}
+
+// callerReferencePrefix identifies the health checks created for this cluster and record
+func (r *Route53Service) callerReferencePrefix() string {
+	return fmt.Sprintf("ecs-ingress-%v-", util.HashString(r.cfg.AWS.ClusterName + "|" + r.recordName())[:10])
+}
+
+// diffRecords returns what to upsert and delete to go from the current to the desired record sets
+func diffRecords(currentList []util.Route53Record, desiredList []util.Route53Record) ([]util.Route53Record, []util.Route53Record) {
+
+	upsertList := make([]util.Route53Record, 0)
+	deleteList := make([]util.Route53Record, 0)
+
+	currentMap := make(map[string]util.Route53Record)
+
+	for _, record := range currentList {
+		sort.Strings(record.Values)
+		currentMap[record.SetIdentifier] = record
+	}
+
+	desiredMap := make(map[string]bool)
+
+	for _, record := range desiredList {
+
+		desiredMap[record.SetIdentifier] = true
+		sort.Strings(record.Values)
+
+		if current, found := currentMap[record.SetIdentifier]; found && reflect.DeepEqual(current, record) {
+			continue
+		}
+
+		upsertList = append(upsertList, record)
+	}
+
+	for _, record := range currentList {
+		if !desiredMap[record.SetIdentifier] {
+			deleteList = append(deleteList, record)
+		}
+	}
+
+	return upsertList, deleteList
+}
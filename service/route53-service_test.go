@@ -0,0 +1,214 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const testZoneID = "Z123"
+
+func newFakeRoute53Service(routingPolicy string, healthCheckPort int64) (*Route53Service, *fakeaws.Route53) {
+
+	cfg := &shared.Config{}
+	cfg.AWS.ClusterName = "prod"
+	cfg.AWS.DaemonServiceName = "ingress"
+	cfg.Route53.HostedZoneID = testZoneID
+	cfg.Route53.RecordName = "Ingress.Example.com"
+	cfg.Route53.RecordType = "A"
+	cfg.Route53.TTL = 60
+	cfg.Route53.RoutingPolicy = routingPolicy
+	cfg.Route53.Weight = 10
+	cfg.Route53.AddressType = "public"
+	cfg.Route53.HealthCheckPort = healthCheckPort
+	cfg.Route53.HealthCheckPath = "/readyz"
+
+	fakeRoute53 := fakeaws.NewRoute53()
+	fakeRoute53.PageSize = 2
+
+	return NewRoute53Service(cfg, nil, util.NewRoute53ClientFromAPI(cfg, fakeRoute53), nil), fakeRoute53
+}
+
+// recordSummary one line per record set: set identifier, weight, multivalue, health check and values
+func recordSummary(fakeRoute53 *fakeaws.Route53) string {
+
+	lineList := make([]string, 0)
+
+	for _, recordSet := range fakeRoute53.RecordSets(testZoneID) {
+
+		record := aws.StringValue(recordSet.Name) + " " + aws.StringValue(recordSet.SetIdentifier)
+
+		if recordSet.Weight != nil {
+			record += fmt.Sprintf(" weight=%v", aws.Int64Value(recordSet.Weight))
+		}
+
+		if aws.BoolValue(recordSet.MultiValueAnswer) {
+			record += " multivalue"
+		}
+
+		if recordSet.HealthCheckId != nil {
+			record += " " + aws.StringValue(recordSet.HealthCheckId)
+		}
+
+		for _, resourceRecord := range recordSet.ResourceRecords {
+			record += " " + aws.StringValue(resourceRecord.Value)
+		}
+
+		lineList = append(lineList, record)
+	}
+
+	return strings.Join(lineList, "\n")
+}
+
+var testInstanceList = []util.Ec2Instance{
+	{InstanceID: "i-1", PublicIPAddress: "54.0.0.1"},
+	{InstanceID: "i-2", PublicIPAddress: "54.0.0.2"},
+	{InstanceID: "i-3", PrivateIPAddress: "10.0.0.3"},
+}
+
+func TestRoute53SyncMultiValue(t *testing.T) {
+
+	route53Service, fakeRoute53 := newFakeRoute53Service(RoutingPolicyMultiValue, 8081)
+
+	// someone else's health check
+	foreignID := fakeRoute53.AddHealthCheck("terraform-1", "54.0.0.1", 8081, "/readyz")
+
+	if err := route53Service.Sync(testInstanceList); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// i-3 has no public address
+	expected := "ingress.example.com. i-1 multivalue hc-0002 54.0.0.1\ningress.example.com. i-2 multivalue hc-0003 54.0.0.2"
+
+	if summary := recordSummary(fakeRoute53); summary != expected {
+		t.Errorf("expected\n%v\ngot\n%v", expected, summary)
+	}
+
+	// nothing changed
+	if err := route53Service.Sync(testInstanceList); err != nil {
+		t.Fatalf("second Sync failed: %v", err)
+	}
+
+	if changes, healthChecks := fakeRoute53.ChangeCount(), len(fakeRoute53.HealthCheckIDs()); changes != 1 || healthChecks != 3 {
+		t.Errorf("expected a single change and 3 health checks, got %v and %v", changes, healthChecks)
+	}
+
+	if ids := strings.Join(fakeRoute53.HealthCheckIDs(), " "); !strings.Contains(ids, foreignID) {
+		t.Errorf("foreign health check deleted: %v", ids)
+	}
+}
+
+func TestRoute53SyncWeighted(t *testing.T) {
+
+	route53Service, fakeRoute53 := newFakeRoute53Service(RoutingPolicyWeighted, 0)
+
+	if err := route53Service.Sync(testInstanceList); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	expected := "ingress.example.com. i-1 weight=10 54.0.0.1\ningress.example.com. i-2 weight=10 54.0.0.2"
+
+	if summary := recordSummary(fakeRoute53); summary != expected {
+		t.Errorf("expected\n%v\ngot\n%v", expected, summary)
+	}
+
+	if healthChecks := fakeRoute53.HealthCheckIDs(); len(healthChecks) != 0 {
+		t.Errorf("expected no health checks without a port, got %v", healthChecks)
+	}
+}
+
+func TestRoute53SyncSwitchPolicy(t *testing.T) {
+
+	route53Service, fakeRoute53 := newFakeRoute53Service(RoutingPolicyMultiValue, 8081)
+
+	if err := route53Service.Sync(testInstanceList); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// simple records can't sit beside multivalue ones, the same batch must replace them
+	route53Service.cfg.Route53.RoutingPolicy = RoutingPolicySimple
+
+	if err := route53Service.Sync(testInstanceList); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	if summary := recordSummary(fakeRoute53); summary != "ingress.example.com.  54.0.0.1 54.0.0.2" {
+		t.Errorf("unexpected records:\n%v", summary)
+	}
+
+	if healthChecks := fakeRoute53.HealthCheckIDs(); len(healthChecks) != 0 {
+		t.Errorf("expected the health checks of the multivalue records deleted, got %v", healthChecks)
+	}
+}
+
+func TestRoute53SyncStaleHealthChecks(t *testing.T) {
+
+	route53Service, fakeRoute53 := newFakeRoute53Service(RoutingPolicyMultiValue, 8081)
+
+	if err := route53Service.Sync(testInstanceList); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// i-2 terminated, and the health checks move to another port
+	route53Service.cfg.Route53.HealthCheckPort = 9090
+
+	if err := route53Service.Sync(testInstanceList[:1]); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	if summary := recordSummary(fakeRoute53); summary != "ingress.example.com. i-1 multivalue hc-0003 54.0.0.1" {
+		t.Errorf("unexpected records:\n%v", summary)
+	}
+
+	if healthChecks := strings.Join(fakeRoute53.HealthCheckIDs(), " "); healthChecks != "hc-0003" {
+		t.Errorf("expected only the new health check left, got %v", healthChecks)
+	}
+}
+
+func TestRoute53SyncNoAddress(t *testing.T) {
+
+	route53Service, fakeRoute53 := newFakeRoute53Service(RoutingPolicyMultiValue, 0)
+
+	if err := route53Service.Sync(testInstanceList); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	// e.g. instances replaced by ones without public addresses
+	if err := route53Service.Sync(testInstanceList[2:]); err == nil {
+		t.Error("expected a sync without addresses to fail")
+	}
+
+	if changes, records := fakeRoute53.ChangeCount(), len(fakeRoute53.RecordSets(testZoneID)); changes != 1 || records != 2 {
+		t.Errorf("expected the records left untouched, got %v changes and %v records", changes, records)
+	}
+}
+
+func TestDiffRecords(t *testing.T) {
+
+	currentList := []util.Route53Record{
+		{SetIdentifier: "i-1", Values: []string{"54.0.0.2", "54.0.0.1"}},
+		{SetIdentifier: "i-2", Values: []string{"54.0.0.3"}},
+		{SetIdentifier: "i-3", Values: []string{"54.0.0.4"}},
+	}
+
+	desiredList := []util.Route53Record{
+		{SetIdentifier: "i-1", Values: []string{"54.0.0.1", "54.0.0.2"}},
+		{SetIdentifier: "i-2", Values: []string{"54.0.0.5"}},
+		{SetIdentifier: "i-4", Values: []string{"54.0.0.6"}},
+	}
+
+	upsertList, deleteList := diffRecords(currentList, desiredList)
+
+	if len(upsertList) != 2 || upsertList[0].SetIdentifier != "i-2" || upsertList[1].SetIdentifier != "i-4" {
+		t.Errorf("expected i-2 and i-4 upserted, got %+v", upsertList)
+	}
+
+	if len(deleteList) != 1 || deleteList[0].SetIdentifier != "i-3" {
+		t.Errorf("expected i-3 deleted, got %+v", deleteList)
+	}
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	stateFileName  = "state.json"
+	bundleFileName = "bundle.zip"
+)
+
+// PersistedState the last configuration successfully applied to nginx
+type PersistedState struct {
+	SavedAt         time.Time
+	Hash            string
+	BundleHash      string
+	BundleVersionID string
+	Services        map[string]EcsServiceDescr
+	Rendered        map[string]string
+}
+
+// StateStore saves the last known good state to disk and optionally S3 so that we can boot without AWS
+type StateStore struct {
+	cfg           *shared.Config
+	s3Client      util.S3API
+	gossipService *GossipService
+
+	// the bundles last saved, so that dynamic pushes don't write them again. Saves run under the reconcile lock.
+	localBundleHash string
+	s3BundleHash    string
+}
+
+// NewStateStore Creates a new state store
+func NewStateStore(cfg *shared.Config, s3Client util.S3API, gossipService *GossipService) *StateStore {
+
+	ret := &StateStore{
+		cfg:           cfg,
+		s3Client:      s3Client,
+		gossipService: gossipService,
+	}
+
+	return ret
+}
+
+// Save writes the state and the bundle it was applied with
+func (s *StateStore) Save(state *PersistedState, bundle []byte) error {
+
+	state.BundleHash = util.HashBytes(bundle)
+
+	stateBytes, err := json.Marshal(state)
+
+	if err != nil {
+		return err
+	}
+
+	if s.cfg.State.Folder != "" {
+
+		if err := os.MkdirAll(s.cfg.State.Folder, 0755); err != nil {
+			return fmt.Errorf("Unable to create state folder: %v", err)
+		}
+
+		// the bundle goes first, a state file always refers to a complete bundle
+		if state.BundleHash != s.localBundleHash {
+
+			if err := writeFileAtomically(filepath.Join(s.cfg.State.Folder, bundleFileName), bundle); err != nil {
+				return fmt.Errorf("Unable to save bundle: %v", err)
+			}
+
+			s.localBundleHash = state.BundleHash
+		}
+
+		if err := writeFileAtomically(filepath.Join(s.cfg.State.Folder, stateFileName), stateBytes); err != nil {
+			return fmt.Errorf("Unable to save state: %v", err)
+		}
+	}
+
+	// one copy per cluster is enough
+	if s.cfg.State.S3Bucket != "" && s.gossipService.IsLeader() {
+
+		if state.BundleHash != s.s3BundleHash {
+
+			if err := s.s3Client.UploadFileFromMemory(s.cfg.State.S3Bucket, s.s3Key(bundleFileName), bundle); err != nil {
+				return fmt.Errorf("Unable to upload bundle: %v", err)
+			}
+
+			s.s3BundleHash = state.BundleHash
+		}
+
+		if err := s.s3Client.UploadFileFromMemory(s.cfg.State.S3Bucket, s.s3Key(stateFileName), stateBytes); err != nil {
+			return fmt.Errorf("Unable to upload state: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Load reads the state from disk, falling back to S3
+func (s *StateStore) Load() (*PersistedState, []byte, error) {
+
+	if s.cfg.State.Folder != "" {
+
+		state, bundle, err := s.loadLocal()
+
+		if err == nil {
+			return state, bundle, nil
+		}
+
+		log.Warn().Err(err).Msg("Unable to load local state")
+	}
+
+	if s.cfg.State.S3Bucket != "" {
+		return s.loadS3()
+	}
+
+	return nil, nil, fmt.Errorf("No saved state available")
+}
+
+func (s *StateStore) loadLocal() (*PersistedState, []byte, error) {
+
+	stateBytes, err := ioutil.ReadFile(filepath.Join(s.cfg.State.Folder, stateFileName))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bundle, err := ioutil.ReadFile(filepath.Join(s.cfg.State.Folder, bundleFileName))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return decodeState(stateBytes, bundle)
+}
+
+func (s *StateStore) loadS3() (*PersistedState, []byte, error) {
+
+	stateObject, err := s.s3Client.DownloadObjectInMemory(s.cfg.State.S3Bucket, s.s3Key(stateFileName), "")
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to download state: %v", err)
+	}
+
+	bundleObject, err := s.s3Client.DownloadObjectInMemory(s.cfg.State.S3Bucket, s.s3Key(bundleFileName), "")
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to download bundle: %v", err)
+	}
+
+	return decodeState(stateObject.Bytes, bundleObject.Bytes)
+}
+
+func (s *StateStore) s3Key(fileName string) string {
+	return path.Join(s.cfg.State.S3Prefix, s.cfg.AWS.ClusterName, fileName)
+}
+
+func decodeState(stateBytes []byte, bundle []byte) (*PersistedState, []byte, error) {
+
+	state := &PersistedState{}
+
+	if err := json.Unmarshal(stateBytes, state); err != nil {
+		return nil, nil, fmt.Errorf("Invalid state: %v", err)
+	}
+
+	return state, bundle, nil
+}
+
+// writeFileAtomically never leaves a half written file behind
+func writeFileAtomically(filePath string, data []byte) error {
+
+	tmpPath := filePath + ".tmp"
+
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filePath)
+}
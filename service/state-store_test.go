@@ -0,0 +1,127 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"bitbucket.org/nnnco/rev-proxy/util"
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+)
+
+const testStateBucket = "state"
+
+// newTestStateStore returns a store saving to a temporary folder and, with s3 set, to a fake S3
+func newTestStateStore(t *testing.T, s3 bool) (*StateStore, *fakeaws.S3) {
+
+	cfg := &shared.Config{}
+	cfg.AWS.ClusterName = "prod"
+	cfg.State.Folder = t.TempDir()
+
+	if s3 {
+		cfg.State.S3Bucket = testStateBucket
+	}
+
+	fakeS3 := fakeaws.NewS3()
+
+	return NewStateStore(cfg, util.NewS3ClientFromAPI(cfg, fakeS3), NewGossipService(cfg, nil)), fakeS3
+}
+
+func testState(hash string) *PersistedState {
+	return &PersistedState{
+		SavedAt:  time.Now().UTC().Truncate(time.Second),
+		Hash:     hash,
+		Services: map[string]EcsServiceDescr{"web": {ServiceName: "web", LocationList: []EcsServiceIPPort{{PrivateIPAddress: "10.0.0.1", Port: 32768}}}},
+		Rendered: map[string]string{"upstreams.conf": "upstream web {}\n"},
+	}
+}
+
+func TestStateStoreRoundTrip(t *testing.T) {
+
+	for _, fromS3 := range []bool{false, true} {
+
+		store, _ := newTestStateStore(t, true)
+
+		if err := store.Save(testState("abc"), []byte("bundle")); err != nil {
+			t.Fatal(err)
+		}
+
+		// without the local copy we fall back to S3
+		if fromS3 {
+			os.RemoveAll(store.cfg.State.Folder)
+		}
+
+		state, bundle, err := store.Load()
+
+		if err != nil {
+			t.Fatalf("Load failed (from S3: %v): %v", fromS3, err)
+		}
+
+		if state.Hash != "abc" || state.BundleHash != util.HashBytes([]byte("bundle")) || string(bundle) != "bundle" || state.Services["web"].LocationList[0].Port != 32768 || state.Rendered["upstreams.conf"] == "" {
+			t.Errorf("unexpected state (from S3: %v) %+v with bundle '%v'", fromS3, state, string(bundle))
+		}
+	}
+}
+
+func TestStateStoreMissingBundle(t *testing.T) {
+
+	store, _ := newTestStateStore(t, false)
+
+	if err := store.Save(testState("abc"), []byte("bundle")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a state file pointing at a bundle that is gone can't be restored
+	if err := os.Remove(filepath.Join(store.cfg.State.Folder, bundleFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.Load(); err == nil || !strings.Contains(err.Error(), "No saved state available") {
+		t.Errorf("expected the state without its bundle to be rejected, got %v", err)
+	}
+}
+
+func TestStateStoreSkipsUnchangedBundle(t *testing.T) {
+
+	store, fakeS3 := newTestStateStore(t, true)
+
+	if err := store.Save(testState("abc"), []byte("bundle")); err != nil {
+		t.Fatal(err)
+	}
+
+	bundlePath := filepath.Join(store.cfg.State.Folder, bundleFileName)
+	before, _ := os.Stat(bundlePath)
+
+	// a dynamic push only changes the state
+	if err := store.Save(testState("def"), []byte("bundle")); err != nil {
+		t.Fatal(err)
+	}
+
+	if after, _ := os.Stat(bundlePath); !os.SameFile(before, after) {
+		t.Error("expected the unchanged bundle not to be written again")
+	}
+
+	if uploads := fakeS3.Calls("PutObject"); uploads != 3 {
+		t.Errorf("expected the state alone to be uploaded again, got %v uploads", uploads)
+	}
+
+	if string(fakeS3.Get(testStateBucket, "prod/"+bundleFileName)) != "bundle" || !strings.Contains(string(fakeS3.Get(testStateBucket, "prod/"+stateFileName)), `"Hash":"def"`) {
+		t.Error("unexpected S3 state")
+	}
+
+	// a new bundle is saved
+	if err := store.Save(testState("ghi"), []byte("new bundle")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, bundle, err := store.Load(); err != nil || string(bundle) != "new bundle" {
+		t.Errorf("expected the new bundle, got '%v' (%v)", string(bundle), err)
+	}
+
+	if uploads := fakeS3.Calls("PutObject"); uploads != 5 {
+		t.Errorf("expected the new bundle to be uploaded, got %v uploads", uploads)
+	}
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// service tags merging several services into one upstream, e.g. a canary beside the stable release
+const (
+	TagIngressGroup  = "ingress.group"
+	TagIngressWeight = "ingress.weight"
+)
+
+// TestUpstreamSuffix names the upstream of the ACTIVE task sets of a service. Upstreams are named after
+// services or groups, neither of which can contain a '.', so it never clashes with a real upstream.
+const TestUpstreamSuffix = ".test"
+
+// groupNameRegexp the characters of ECS service names, which group names are held to as well
+var groupNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// upstreamWeightScale the weight of a server getting its whole service share, high enough to keep rounding negligible
+const upstreamWeightScale = 100
+
+// GroupUpstreams merges the services sharing an ingress.group tag into one upstream named after the group.
+// A service without the tag is in the group of its own name. Within a merged upstream, ingress.weight is the
+// share of traffic of each service (default 1, 0 sends it none), spread over its tasks with nginx weights.
+// Services alone in their group are returned unchanged.
+func GroupUpstreams(descrMap map[string]EcsServiceDescr) map[string]EcsServiceDescr {
+
+	memberMap := make(map[string][]EcsServiceDescr)
+
+	for _, descr := range descrMap {
+
+		group := descr.Tags[TagIngressGroup]
+
+		if group != "" && !groupNameRegexp.MatchString(group) {
+			log.Warn().Msgf("Invalid %v tag '%v' on service '%v', only letters, digits, '-' and '_' are allowed. Ignoring it", TagIngressGroup, group, descr.ServiceName)
+			group = ""
+		}
+
+		if group == "" {
+			group = descr.ServiceName
+		}
+
+		memberMap[group] = append(memberMap[group], descr)
+	}
+
+	retMap := make(map[string]EcsServiceDescr)
+
+	for group, memberList := range memberMap {
+
+		if len(memberList) == 1 && memberList[0].ServiceName == group {
+			retMap[group] = memberList[0]
+			continue
+		}
+
+		// stable output, so that the rendered hash only changes with the services
+		sort.Slice(memberList, func(i, j int) bool {
+			return memberList[i].ServiceName < memberList[j].ServiceName
+		})
+
+		groupDescr := EcsServiceDescr{
+			ClusterName:  memberList[0].ClusterName,
+			ServiceName:  group,
+			LocationList: make([]EcsServiceIPPort, 0),
+		}
+
+		for _, member := range memberList {
+
+			// the task sets are not weighted, they serve the test upstream
+			groupDescr.TaskSetList = append(groupDescr.TaskSetList, member.TaskSetList...)
+
+			weight := serviceWeight(member)
+
+			if weight == 0 || len(member.LocationList) == 0 {
+				continue
+			}
+
+			// every task gets an equal part of the service share
+			serverWeight := int64(math.Round(float64(weight*upstreamWeightScale) / float64(len(member.LocationList))))
+
+			if serverWeight < 1 {
+				serverWeight = 1
+			}
+
+			for _, location := range member.LocationList {
+				location.Weight = serverWeight
+				groupDescr.LocationList = append(groupDescr.LocationList, location)
+			}
+		}
+
+		retMap[group] = groupDescr
+	}
+
+	return retMap
+}
+
+// serviceWeight reads the ingress.weight tag, 1 when missing or invalid
+func serviceWeight(descr EcsServiceDescr) int64 {
+
+	value, found := descr.Tags[TagIngressWeight]
+
+	if !found {
+		return 1
+	}
+
+	weight, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || weight < 0 {
+		log.Warn().Msgf("Invalid %v tag '%v' on service '%v'. Using 1", TagIngressWeight, value, descr.ServiceName)
+		return 1
+	}
+
+	return weight
+}
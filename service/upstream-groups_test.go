@@ -0,0 +1,120 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+)
+
+func TestGroupUpstreams(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instance := cluster.AddInstance("10.0.0.1", "")
+
+	cluster.AddService("api")
+	cluster.AddService("api-canary")
+	cluster.AddService("api-old")
+	cluster.TagService("api", TagIngressWeight, "90")
+	cluster.TagService("api-canary", TagIngressGroup, "api")
+	cluster.TagService("api-canary", TagIngressWeight, "10")
+	cluster.TagService("api-old", TagIngressGroup, "api")
+	cluster.TagService("api-old", TagIngressWeight, "0")
+
+	for i := 0; i < 3; i++ {
+		cluster.AddTask("api", instance, int64(32000+i), 8080)
+	}
+
+	cluster.AddTask("api-canary", instance, 32100, 8080)
+	cluster.AddTask("api-old", instance, 32200, 8080)
+
+	// enough services to need several DescribeServices calls
+	for i := 0; i < 12; i++ {
+		cluster.AddService(fmt.Sprintf("web-%02d", i))
+	}
+
+	descrMap, err := newFakeEcsService(cluster).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	if descrMap["api-canary"].Tags[TagIngressGroup] != "api" {
+		t.Fatalf("tags not discovered: %+v", descrMap["api-canary"].Tags)
+	}
+
+	upstreamMap := GroupUpstreams(descrMap)
+
+	if len(upstreamMap) != 13 {
+		t.Errorf("expected the api group and 12 web upstreams, got %v", len(upstreamMap))
+	}
+
+	api := upstreamMap["api"]
+
+	if len(api.LocationList) != 4 {
+		t.Fatalf("expected 3 api and 1 canary servers, got %+v", api.LocationList)
+	}
+
+	// 90% over 3 tasks, then 10% over 1 task
+	for i, expected := range []int64{3000, 3000, 3000, 1000} {
+		if api.LocationList[i].Weight != expected {
+			t.Errorf("server %v: expected weight %v, got %v", i, expected, api.LocationList[i].Weight)
+		}
+	}
+
+	if web := upstreamMap["web-00"]; web.ServiceArn == "" || len(web.LocationList) != 0 {
+		t.Errorf("ungrouped services must be unchanged, got %+v", web)
+	}
+
+	buffer, err := RenderUpstreams("../data/upstreams.conf.tmpl", descrMap, UpstreamOptions{})
+
+	if err != nil {
+		t.Fatalf("RenderUpstreams failed: %v", err)
+	}
+
+	if rendered := buffer.String(); !strings.Contains(rendered, "server 10.0.0.1:32100 weight=1000;") || strings.Contains(rendered, "upstream api-canary") {
+		t.Errorf("unexpected upstreams:\n%v", rendered)
+	}
+}
+
+func TestTestUpstreamNames(t *testing.T) {
+
+	location := []EcsServiceIPPort{{PrivateIPAddress: "10.0.0.1", Port: 32768}}
+	greenLocation := []EcsServiceIPPort{{PrivateIPAddress: "10.0.0.2", Port: 32769}}
+
+	descrMap := map[string]EcsServiceDescr{
+		"web": {ServiceName: "web", LocationList: location, TaskSetList: []EcsTaskSetDescr{
+			{ID: "ecs-svc/1", Status: TaskSetPrimary, LocationList: location},
+			{ID: "ecs-svc/2", Status: TaskSetActive, LocationList: greenLocation},
+		}},
+		// a real service named like the test upstream of web used to be
+		"web-test": {ServiceName: "web-test", LocationList: location},
+		// groups can't take the name of a test upstream either
+		"other": {ServiceName: "other", Tags: map[string]string{TagIngressGroup: "web.test"}, LocationList: location},
+	}
+
+	serverSets := UpstreamServerSets(GroupUpstreams(descrMap))
+
+	nameList := make([]string, 0)
+
+	for name := range serverSets {
+		nameList = append(nameList, name)
+	}
+
+	if len(serverSets) != 4 || serverSets["web.test"][0].Server != "10.0.0.2:32769" || serverSets["web-test"][0].Server != "10.0.0.1:32768" || serverSets["other"] == nil {
+		t.Errorf("unexpected upstreams %v", nameList)
+	}
+
+	buffer, err := RenderUpstreams("../data/upstreams.conf.tmpl", descrMap, UpstreamOptions{})
+
+	if err != nil {
+		t.Fatalf("RenderUpstreams failed: %v", err)
+	}
+
+	for _, upstream := range []string{"upstream web.test {", "upstream web-test {", "upstream other {"} {
+		if strings.Count(buffer.String(), upstream) != 1 {
+			t.Errorf("expected one '%v' in:\n%v", upstream, buffer.String())
+		}
+	}
+}
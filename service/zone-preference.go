@@ -0,0 +1,50 @@
+package service
+
+// HealthStatusUnhealthy the health status of a task failing its health check
+const HealthStatusUnhealthy = "UNHEALTHY"
+
+// PreferLocalZone marks the servers outside localZone as backups, so that nginx only crosses zones when the
+// local ones are down. Upstreams with fewer than minHealthy healthy servers in localZone are left alone.
+// Servers without a known zone count as remote.
+func PreferLocalZone(upstreamMap map[string]EcsServiceDescr, localZone string, minHealthy int) map[string]EcsServiceDescr {
+
+	if localZone == "" || minHealthy < 1 {
+		return upstreamMap
+	}
+
+	retMap := make(map[string]EcsServiceDescr)
+
+	for name, descr := range upstreamMap {
+
+		localHealthy := 0
+
+		for _, location := range descr.LocationList {
+			if inZone(location, localZone) && location.HealthStatus != HealthStatusUnhealthy && !location.Down {
+				localHealthy++
+			}
+		}
+
+		if localHealthy < minHealthy {
+			retMap[name] = descr
+			continue
+		}
+
+		// a copy, the discovered services are shared with the snapshots and the admin API
+		locationList := make([]EcsServiceIPPort, 0, len(descr.LocationList))
+
+		for _, location := range descr.LocationList {
+			location.Backup = !inZone(location, localZone)
+			locationList = append(locationList, location)
+		}
+
+		descr.LocationList = locationList
+		retMap[name] = descr
+	}
+
+	return retMap
+}
+
+// inZone returns true when a location is known to be in the zone
+func inZone(location EcsServiceIPPort, zone string) bool {
+	return location.AvailabilityZone == zone
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"bitbucket.org/nnnco/rev-proxy/util/fakeaws"
+)
+
+func TestPreferLocalZone(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instanceA := cluster.AddInstance("10.0.1.1", "")
+	instanceB := cluster.AddInstance("10.0.2.1", "")
+	cluster.SetInstanceZone(instanceA, "ap-southeast-2a", "subnet-a")
+	cluster.SetInstanceZone(instanceB, "ap-southeast-2b", "subnet-b")
+
+	cluster.AddService("web")
+	cluster.AddService("api")
+
+	cluster.AddTask("web", instanceA, 32768, 80)
+	cluster.AddTask("web", instanceA, 32769, 80)
+	cluster.AddTask("web", instanceB, 32768, 80)
+
+	// the only local api task is failing
+	cluster.AddTask("api", instanceA, 32770, 8080).HealthStatus = HealthStatusUnhealthy
+	cluster.AddTask("api", instanceB, 32770, 8080)
+
+	descrMap, err := newFakeEcsService(cluster).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	if location := descrMap["web"].LocationList[0]; location.AvailabilityZone != "ap-southeast-2a" || location.SubnetID != "subnet-a" {
+		t.Errorf("zone not discovered: %+v", location)
+	}
+
+	upstreamMap := PreferLocalZone(descrMap, "ap-southeast-2a", 2)
+
+	for _, location := range upstreamMap["web"].LocationList {
+		if location.Backup != (location.AvailabilityZone != "ap-southeast-2a") {
+			t.Errorf("only the other zones must be backups: %+v", location)
+		}
+	}
+
+	// not enough healthy local servers, every zone serves
+	for _, location := range upstreamMap["api"].LocationList {
+		if location.Backup {
+			t.Errorf("unexpected backup %+v", location)
+		}
+	}
+
+	// the discovered services are left untouched
+	for _, location := range descrMap["web"].LocationList {
+		if location.Backup {
+			t.Errorf("discovered location modified: %+v", location)
+		}
+	}
+
+	if upstreamMap := PreferLocalZone(descrMap, "ap-southeast-2a", 3); upstreamMap["web"].LocationList[2].Backup {
+		t.Error("expected no backup below the threshold")
+	}
+
+	buffer, err := RenderUpstreams("../data/upstreams.conf.tmpl", descrMap, UpstreamOptions{LocalZone: "ap-southeast-2b", ZoneMinHealthy: 1})
+
+	if err != nil {
+		t.Fatalf("RenderUpstreams failed: %v", err)
+	}
+
+	if rendered := buffer.String(); !strings.Contains(rendered, "server 10.0.1.1:32768 backup;") || !strings.Contains(rendered, "server 10.0.2.1:32768;") {
+		t.Errorf("unexpected upstreams:\n%v", rendered)
+	}
+}
+
+func TestPreferLocalZoneFargate(t *testing.T) {
+
+	cluster := fakeaws.NewCluster("prod")
+	instanceA := cluster.AddInstance("10.0.1.1", "")
+	cluster.SetInstanceZone(instanceA, "ap-southeast-2a", "subnet-a")
+
+	cluster.AddService("web")
+	cluster.AddTask("web", instanceA, 32768, 80)
+	cluster.AddFargateTask("web", "10.0.1.20", 8080, "ap-southeast-2a", "subnet-fargate-a")
+	cluster.AddFargateTask("web", "10.0.2.20", 8080, "ap-southeast-2b", "subnet-fargate-b")
+
+	descrMap, err := newFakeEcsService(cluster).GetServicesAndPorts("prod")
+
+	if err != nil {
+		t.Fatalf("GetServicesAndPorts failed: %v", err)
+	}
+
+	// the zone and subnet come from the task, not from an instance
+	if location := descrMap["web"].LocationList[2]; location.Server() != "10.0.2.20:8080" || location.AvailabilityZone != "ap-southeast-2b" || location.SubnetID != "subnet-fargate-b" {
+		t.Fatalf("Fargate zone not discovered: %+v", location)
+	}
+
+	// a server of unknown zone can't be told apart from a remote one
+	descr := descrMap["web"]
+	descr.LocationList = append(descr.LocationList, EcsServiceIPPort{PrivateIPAddress: "10.0.3.20", Port: 8080})
+	descrMap["web"] = descr
+
+	locationList := PreferLocalZone(descrMap, "ap-southeast-2a", 2)["web"].LocationList
+
+	for i, expected := range []bool{false, false, true, true} {
+		if locationList[i].Backup != expected {
+			t.Errorf("%v: expected backup %v, got %v", locationList[i].Server(), expected, locationList[i].Backup)
+		}
+	}
+}
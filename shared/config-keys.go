@@ -0,0 +1,158 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// configFileEnv the env variable pointing at the config file, when -config is not given
+const configFileEnv = "ECS_INGRESS_CONFIG"
+
+// envPrefixes our env variables start with one of these, so that typos can be reported. AWS_ is left out: the
+// SDK reads its own variables with it.
+var envPrefixes = []string{"ECS_INGRESS_", "NGINX_", "PROXY_", "HAPROXY_", "ADMIN_", "ACCESS_LOG_", "NOTIFY_", "ROUTE53_", "ACME_", "GOSSIP_", "DISCOVERY_", "HEALTH_CHECK_", "STATE_"}
+
+// configKey a leaf of the config, named as in the config file and the flags (e.g. nginx.configfolder)
+type configKey struct {
+	name   string
+	secret bool
+	live   bool
+	index  []int
+}
+
+// ConfigValue an effective config value, ready to be printed
+type ConfigValue struct {
+	Key   string
+	Value string
+}
+
+// configKeys lists the leaves of a config struct
+func configKeys(configType reflect.Type, prefix string) []configKey {
+
+	retList := make([]configKey, 0)
+
+	for i := 0; i < configType.NumField(); i++ {
+
+		field := configType.Field(i)
+		name := prefix + strings.ToLower(field.Name)
+
+		// not a setting
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+
+			for _, key := range configKeys(field.Type, name+".") {
+				key.index = append([]int{i}, key.index...)
+				retList = append(retList, key)
+			}
+
+			continue
+		}
+
+		retList = append(retList, configKey{
+			name:   name,
+			secret: field.Tag.Get("secret") == "true",
+			live:   field.Tag.Get("reload") == "live",
+			index:  []int{i},
+		})
+	}
+
+	return retList
+}
+
+// checkFileKeys rejects the config file keys that don't match any setting
+func checkFileKeys(configViper *viper.Viper) error {
+
+	knownKeys := make(map[string]bool)
+
+	for _, key := range configKeys(reflect.TypeOf(Config{}), "") {
+		knownKeys[key.name] = true
+	}
+
+	unknownList := make([]string, 0)
+
+	for _, key := range configViper.AllKeys() {
+		if !knownKeys[key] {
+			unknownList = append(unknownList, key)
+		}
+	}
+
+	if len(unknownList) > 0 {
+		return fmt.Errorf("unknown keys %v", strings.Join(unknownList, ", "))
+	}
+
+	return nil
+}
+
+// warnUnknownEnv reports the env variables that look like ours but don't set anything, usually typos
+func warnUnknownEnv() {
+
+	knownEnv := map[string]bool{configFileEnv: true}
+
+	for _, binding := range envBindings {
+		for _, env := range binding.envList {
+			knownEnv[env] = true
+		}
+	}
+
+	for _, entry := range os.Environ() {
+
+		name := strings.SplitN(entry, "=", 2)[0]
+
+		if !knownEnv[name] && hasEnvPrefix(name) {
+			log.Warn().Msgf("Ignoring unknown env variable %v", name)
+		}
+	}
+}
+
+// hasEnvPrefix returns true when the env variable looks like ours
+func hasEnvPrefix(name string) bool {
+
+	for _, prefix := range envPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Values returns the effective config, with the secrets redacted
+func (c *Config) Values() []ConfigValue {
+
+	retList := make([]ConfigValue, 0)
+	configValue := reflect.ValueOf(*c)
+
+	for _, key := range configKeys(configValue.Type(), "") {
+
+		fieldValue := configValue.FieldByIndex(key.index)
+		value := fmt.Sprintf("%v", fieldValue.Interface())
+
+		if fieldValue.Kind() == reflect.Slice {
+
+			itemList := make([]string, 0)
+
+			for i := 0; i < fieldValue.Len(); i++ {
+				itemList = append(itemList, fmt.Sprintf("%v", fieldValue.Index(i).Interface()))
+			}
+
+			value = strings.Join(itemList, ",")
+		}
+
+		if key.secret && value != "" {
+			value = "<redacted>"
+		}
+
+		retList = append(retList, ConfigValue{Key: key.name, Value: value})
+	}
+
+	return retList
+}
@@ -0,0 +1,157 @@
+package shared
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// config reload results
+const (
+	reloadApplied   = "applied"
+	reloadUnchanged = "unchanged"
+	reloadRejected  = "rejected"
+	reloadInvalid   = "invalid"
+)
+
+// liveLock guards the settings tagged reload:"live" while a reload changes them
+var liveLock sync.RWMutex
+
+// Current returns a copy of the config. The settings tagged reload:"live" must be read through it.
+func (c *Config) Current() Config {
+	liveLock.RLock()
+	defer liveLock.RUnlock()
+
+	return *c
+}
+
+// apply copies the live settings of newConfig, and returns the changed keys split between applied and needing a restart
+func (c *Config) apply(newConfig *Config) ([]string, []string) {
+	liveLock.Lock()
+	defer liveLock.Unlock()
+
+	appliedList := make([]string, 0)
+	restartList := make([]string, 0)
+
+	currentValue := reflect.ValueOf(c).Elem()
+	newValue := reflect.ValueOf(newConfig).Elem()
+
+	for _, key := range configKeys(currentValue.Type(), "") {
+
+		currentField := currentValue.FieldByIndex(key.index)
+		newField := newValue.FieldByIndex(key.index)
+
+		if reflect.DeepEqual(currentField.Interface(), newField.Interface()) {
+			continue
+		}
+
+		if !key.live {
+			restartList = append(restartList, key.name)
+			continue
+		}
+
+		currentField.Set(newField)
+		appliedList = append(appliedList, key.name)
+	}
+
+	return appliedList, restartList
+}
+
+// ConfigReloader applies the live settings again when the config file or the bundle settings change.
+// Changes of the other settings are logged and ignored until the next restart.
+type ConfigReloader struct {
+	cfg     *Config
+	metrics *Metrics
+
+	lock               sync.Mutex
+	bundleSettingsName string
+	bundleSettings     []byte
+}
+
+// NewConfigReloader Creates a new reloader
+func NewConfigReloader(cfg *Config, metrics *Metrics) *ConfigReloader {
+
+	ret := &ConfigReloader{
+		cfg:     cfg,
+		metrics: metrics,
+	}
+
+	return ret
+}
+
+// Start watches the config file, if any
+func (r *ConfigReloader) Start() {
+
+	if r.cfg.configFile == "" {
+		return
+	}
+
+	log.Info().Msgf("Watching config file '%v'", r.cfg.configFile)
+
+	// only used for its watcher, the layering is done again by loadConfig
+	watcher := viper.New()
+	watcher.SetConfigFile(r.cfg.configFile)
+	watcher.OnConfigChange(func(event fsnotify.Event) {
+		r.Reload("config file")
+	})
+
+	watcher.WatchConfig()
+}
+
+// SetBundleSettings reloads when the settings found in the config bundle change. Empty content removes them.
+func (r *ConfigReloader) SetBundleSettings(name string, content []byte) {
+	r.lock.Lock()
+
+	if name == r.bundleSettingsName && bytes.Equal(content, r.bundleSettings) {
+		r.lock.Unlock()
+		return
+	}
+
+	r.bundleSettingsName = name
+	r.bundleSettings = content
+	r.lock.Unlock()
+
+	r.Reload("bundle settings")
+}
+
+// Reload loads the settings again and applies the live ones. An invalid config is ignored as a whole.
+func (r *ConfigReloader) Reload(reason string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	newConfig, _, err := loadConfig(r.cfg.args, r.bundleSettingsName, r.bundleSettings)
+
+	if err == nil {
+		err = newConfig.Validate()
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("reason", reason).Msg("Config reload FAILED. Keeping the current settings")
+		r.metrics.ConfigReloads.WithLabelValues(reloadInvalid).Inc()
+		return reloadInvalid
+	}
+
+	appliedList, restartList := r.cfg.apply(newConfig)
+
+	for _, key := range restartList {
+		log.Warn().Str("reason", reason).Msgf("Config key '%v' changed but only applies after a restart. Ignoring it", key)
+	}
+
+	result := reloadUnchanged
+
+	if len(appliedList) > 0 {
+		log.Info().Str("reason", reason).Msgf("Config reloaded. Applied %v", strings.Join(appliedList, ", "))
+		result = reloadApplied
+	} else if len(restartList) > 0 {
+		result = reloadRejected
+	}
+
+	r.metrics.ConfigReloads.WithLabelValues(result).Inc()
+
+	return result
+}
@@ -0,0 +1,193 @@
+package shared
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// awsRegionRegexp matches ap-southeast-2, us-gov-west-1, cn-north-1 and the like
+var awsRegionRegexp = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// Validate returns every problem found in the config at once
+func (c *Config) Validate() error {
+
+	errorList := make([]string, 0)
+
+	fail := func(format string, args ...interface{}) {
+		errorList = append(errorList, fmt.Sprintf(format, args...))
+	}
+
+	oneOf := func(key string, value string, allowedList ...string) {
+		for _, allowed := range allowedList {
+			if value == allowed {
+				return
+			}
+		}
+
+		fail("%v must be one of %v, got '%v'", key, strings.Join(allowedList, ", "), value)
+	}
+
+	required := func(key string, value string) {
+		if value == "" {
+			fail("%v is required", key)
+		}
+	}
+
+	positive := func(key string, value time.Duration) {
+		if value <= 0 {
+			fail("%v must be a positive duration, got %v", key, value)
+		}
+	}
+
+	// AWS
+	required("aws.clustername", c.AWS.ClusterName)
+
+	if !awsRegionRegexp.MatchString(c.AWS.Region) {
+		fail("aws.region '%v' is not a valid AWS region", c.AWS.Region)
+	}
+
+	// nginx
+	required("nginx.binary", c.Nginx.Binary)
+	required("nginx.configfolder", c.Nginx.ConfigFolder)
+	required("nginx.upstreamstemplatefile", c.Nginx.UpstreamsTemplateFile)
+	required("nginx.upstreamsconfigfile", c.Nginx.UpstreamsConfigFile)
+	required("nginx.mainconfigfile", c.Nginx.MainConfigFile)
+
+	if c.Nginx.ConfigBundleFile == "" && (c.Nginx.ConfigBundleS3Bucket == "" || c.Nginx.ConfigBundleS3Key == "") {
+		fail("nginx.configbundles3bucket and nginx.configbundles3key are required, unless nginx.configbundlefile is set")
+	}
+
+	oneOf("nginx.applystrategy", c.Nginx.ApplyStrategy, "reload", "openresty", "nginx-plus")
+
+	if c.Nginx.ApplyStrategy != "reload" && c.Nginx.DynamicUpstreamsURL == "" {
+		fail("nginx.dynamicupstreamsurl is required with the %v apply strategy", c.Nginx.ApplyStrategy)
+	}
+
+	// proxy
+	oneOf("proxy.type", c.Proxy.Type, "nginx", "haproxy")
+
+	if c.Proxy.Type == "haproxy" {
+
+		required("proxy.haproxybinary", c.Proxy.HAProxyBinary)
+
+		// the runtime API takes the endpoint changes
+		if c.Nginx.ApplyStrategy != "reload" {
+			fail("nginx.applystrategy must be reload with haproxy, got '%v'. Set proxy.haproxyruntimesocket instead", c.Nginx.ApplyStrategy)
+		}
+	}
+
+	if c.Nginx.MaxRestarts < 0 {
+		fail("nginx.maxrestarts must not be negative, got %v", c.Nginx.MaxRestarts)
+	}
+
+	if c.Nginx.ReloadQuietWindow < 0 || c.Nginx.ReloadMinInterval < 0 || c.Nginx.ReloadMaxDelay < 0 {
+		fail("nginx.reloadquietwindow, nginx.reloadmininterval and nginx.reloadmaxdelay must not be negative")
+	}
+
+	// admin
+	positive("admin.readymaxstaleness", c.Admin.ReadyMaxStaleness)
+
+	if c.Admin.HistorySize < 1 {
+		fail("admin.historysize must be at least 1, got %v", c.Admin.HistorySize)
+	}
+
+	// access log
+	if listen := c.AccessLog.Listen; listen != "" && !strings.HasPrefix(listen, "unix:") && !strings.HasPrefix(listen, "udp:") && !strings.HasPrefix(listen, "fifo:") {
+		fail("accesslog.listen must start with unix:, udp: or fifo:, got '%v'", listen)
+	}
+
+	// notifications
+	positive("notify.dedupwindow", c.Notify.DedupWindow)
+
+	if c.Notify.MaxPerMinute < 1 {
+		fail("notify.maxperminute must be at least 1, got %v", c.Notify.MaxPerMinute)
+	}
+
+	// route53
+	if c.Route53.HostedZoneID != "" {
+
+		if c.Route53.RecordName == "" {
+			fail("route53.recordname is required with route53.hostedzoneid")
+		}
+
+		oneOf("route53.recordtype", c.Route53.RecordType, "A", "AAAA")
+		oneOf("route53.routingpolicy", c.Route53.RoutingPolicy, "simple", "multivalue", "weighted")
+		oneOf("route53.addresstype", c.Route53.AddressType, "public", "private")
+		positive("route53.syncinterval", c.Route53.SyncInterval)
+	}
+
+	// certificates
+	if len(c.Acme.Hostnames) > 0 {
+
+		oneOf("acme.challenge", c.Acme.Challenge, "http-01", "dns-01")
+
+		if c.Acme.Challenge == "dns-01" && c.Acme.HostedZoneID == "" {
+			fail("acme.hostedzoneid is required with the dns-01 challenge")
+		}
+
+		if c.Acme.S3Bucket == "" && c.Nginx.ConfigBundleS3Bucket == "" {
+			fail("acme.s3bucket is required when the bundle is not read from S3")
+		}
+
+		positive("acme.checkinterval", c.Acme.CheckInterval)
+	}
+
+	// gossip
+	if c.Gossip.Enabled {
+
+		// unencrypted gossip would accept discovery snapshots from anyone
+		secretKey, err := base64.StdEncoding.DecodeString(c.Gossip.SecretKey)
+
+		if err != nil || (len(secretKey) != 16 && len(secretKey) != 24 && len(secretKey) != 32) {
+			fail("gossip.secretkey must be a base64 encoded 16, 24 or 32 bytes key")
+		}
+
+		if c.Gossip.AdvertisePort < 0 || c.Gossip.AdvertisePort > 65535 {
+			fail("gossip.advertiseport must be a valid port, got %v", c.Gossip.AdvertisePort)
+		}
+
+		positive("gossip.joininterval", c.Gossip.JoinInterval)
+	}
+
+	// discovery
+	oneOf("discovery.provider", c.Discovery.Provider, "ecs", "file", "agent", "docker")
+	oneOf("discovery.addressfamily", c.Discovery.AddressFamily, "ipv4", "ipv6")
+	positive("discovery.pollinterval", c.Discovery.PollInterval)
+
+	if c.Discovery.ZoneMinHealthy < 0 {
+		fail("discovery.zoneminhealthy must not be negative, got %v", c.Discovery.ZoneMinHealthy)
+	}
+
+	if c.Discovery.Provider == "file" && c.Discovery.SnapshotFile == "" {
+		fail("discovery.snapshotfile is required with the file provider")
+	}
+
+	// active health checks
+	if c.HealthCheck.Enabled {
+
+		oneOf("healthcheck.type", c.HealthCheck.Type, "http", "tcp", "grpc")
+		positive("healthcheck.interval", c.HealthCheck.Interval)
+		positive("healthcheck.timeout", c.HealthCheck.Timeout)
+
+		if !strings.HasPrefix(c.HealthCheck.Path, "/") {
+			fail("healthcheck.path must start with '/', got '%v'", c.HealthCheck.Path)
+		}
+
+		if _, err := ParseStatusRanges(c.HealthCheck.ExpectedStatus); err != nil {
+			fail("healthcheck.expectedstatus: %v", err)
+		}
+
+		if c.HealthCheck.HealthyThreshold < 1 || c.HealthCheck.UnhealthyThreshold < 1 {
+			fail("healthcheck.healthythreshold and healthcheck.unhealthythreshold must be at least 1")
+		}
+	}
+
+	if len(errorList) > 0 {
+		return fmt.Errorf("Invalid config:\n - %v", strings.Join(errorList, "\n - "))
+	}
+
+	return nil
+}
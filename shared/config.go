@@ -1,67 +1,511 @@
 package shared
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
 // Config The shared goroutine-safe config object
 type Config struct {
-	AWS   configAWS
-	Nginx configNginx
+	AWS         configAWS
+	Nginx       configNginx
+	Proxy       configProxy
+	Admin       configAdmin
+	AccessLog   configAccessLog
+	Notify      configNotify
+	Route53     configRoute53
+	Acme        configAcme
+	Gossip      configGossip
+	Discovery   configDiscovery
+	HealthCheck configHealthCheck
+	State       configState
+
+	// where the settings come from, loaded again on reload
+	args       []string
+	configFile string
 }
 
 type configAWS struct {
-	ClusterName string
-	Region      string
+	ClusterName       string
+	Region            string
+	DaemonServiceName string
+	Endpoint          string
+	S3Endpoint        string
+	S3ForcePathStyle  bool
+	Discovery         configAssumeRole
+	Bundle            configAssumeRole
+}
+
+type configAssumeRole struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
 }
 
 type configNginx struct {
+	Binary                string
 	ConfigFolder          string
 	UpstreamsTemplateFile string
 	UpstreamsConfigFile   string
 	MainConfigFile        string
 	ConfigBundleS3Bucket  string
 	ConfigBundleS3Key     string
+	ConfigBundleFile      string
+	BundleSettingsFile    string
+	ApplyStrategy         string
+	DynamicUpstreamsURL   string
+	MaxRestarts           int           `reload:"live"`
+	ReloadQuietWindow     time.Duration `reload:"live"`
+	ReloadMinInterval     time.Duration `reload:"live"`
+	ReloadMaxDelay        time.Duration `reload:"live"`
+}
+
+type configProxy struct {
+	Type                 string
+	HAProxyBinary        string
+	HAProxyRuntimeSocket string
+}
+
+type configAdmin struct {
+	ListenAddress     string
+	ReadyMaxStaleness time.Duration `reload:"live"`
+	HistorySize       int           `reload:"live"`
+	Token             string        `secret:"true" reload:"live"`
+}
+
+type configAccessLog struct {
+	Listen string
+}
+
+type configRoute53 struct {
+	HostedZoneID    string
+	RecordName      string
+	RecordType      string
+	TTL             int64
+	RoutingPolicy   string
+	Weight          int64
+	AddressType     string
+	HealthCheckPort int64
+	HealthCheckPath string
+	SyncInterval    time.Duration `reload:"live"`
+}
+
+type configAcme struct {
+	Hostnames           []string
+	Email               string
+	DirectoryURL        string
+	Challenge           string
+	HostedZoneID        string
+	S3Bucket            string
+	S3Prefix            string
+	CertFolder          string
+	RenewBefore         time.Duration `reload:"live"`
+	CheckInterval       time.Duration `reload:"live"`
+	DNSPropagationDelay time.Duration
+	InsecureSkipVerify  bool
+}
+
+type configGossip struct {
+	Enabled        bool
+	BindPort       int
+	AdvertiseAddr  string
+	AdvertisePort  int
+	NodeName       string
+	SecretKey      string        `secret:"true"`
+	JoinInterval   time.Duration `reload:"live"`
+	SnapshotMaxAge time.Duration `reload:"live"`
+}
+
+type configDiscovery struct {
+	Provider       string
+	PollInterval   time.Duration `reload:"live"`
+	SnapshotFile   string
+	AgentURL       string
+	DockerHost     string
+	HostAddress    string
+	LocalZone      string
+	ZoneMinHealthy int
+	AddressFamily  string
 }
 
-// NewConfig is used to generate a configuration instance which will be passed around the codebase
-func NewConfig() (*Config, error) {
+type configHealthCheck struct {
+	Enabled            bool
+	Type               string
+	Path               string
+	ExpectedStatus     string
+	Interval           time.Duration `reload:"live"`
+	Timeout            time.Duration `reload:"live"`
+	HealthyThreshold   int           `reload:"live"`
+	UnhealthyThreshold int           `reload:"live"`
+}
+
+type configState struct {
+	Folder   string
+	S3Bucket string
+	S3Prefix string
+}
+
+type configNotify struct {
+	SlackWebhookURLs []string      `secret:"true" reload:"live"`
+	WebhookURLs      []string      `secret:"true" reload:"live"`
+	DedupWindow      time.Duration `reload:"live"`
+	MaxPerMinute     int           `reload:"live"`
+}
+
+// envBinding the env variables setting a config key, the first one set wins
+type envBinding struct {
+	key     string
+	envList []string
+}
+
+var envBindings = []envBinding{
+	{"AWS.Clustername", []string{"AWS_CLUSTER_NAME"}},
+	{"AWS.Region", []string{"AWS_REGION"}},
+	{"AWS.DaemonServiceName", []string{"AWS_DAEMON_SERVICE_NAME", "ROUTE53_DAEMON_SERVICE_NAME"}},
+	{"AWS.Endpoint", []string{"AWS_ENDPOINT"}},
+	{"AWS.S3Endpoint", []string{"AWS_S3_ENDPOINT"}},
+	{"AWS.S3ForcePathStyle", []string{"AWS_S3_FORCE_PATH_STYLE"}},
+	{"AWS.Discovery.RoleARN", []string{"AWS_DISCOVERY_ROLE_ARN"}},
+	{"AWS.Discovery.ExternalID", []string{"AWS_DISCOVERY_EXTERNAL_ID"}},
+	{"AWS.Discovery.SessionName", []string{"AWS_DISCOVERY_ROLE_SESSION_NAME"}},
+	{"AWS.Bundle.RoleARN", []string{"AWS_BUNDLE_ROLE_ARN"}},
+	{"AWS.Bundle.ExternalID", []string{"AWS_BUNDLE_EXTERNAL_ID"}},
+	{"AWS.Bundle.SessionName", []string{"AWS_BUNDLE_ROLE_SESSION_NAME"}},
+	{"Nginx.Binary", []string{"NGINX_BINARY"}},
+	{"Nginx.ConfigFolder", []string{"NGINX_CONFIG_FOLDER"}},
+	{"Nginx.UpstreamsTemplateFile", []string{"NGINX_UPSTREAMS_TEMPLATE_FILE"}},
+	{"Nginx.UpstreamsConfigFile", []string{"NGINX_UPSTREAMS_CONFIG_FILE"}},
+	{"Nginx.MainConfigFile", []string{"NGINX_CONFIG_FILE_NAME"}},
+	{"Nginx.ConfigBundleS3Bucket", []string{"NGINX_CONFIG_BUNDLE_S3_BUCKET"}},
+	{"Nginx.ConfigBundleS3Key", []string{"NGINX_CONFIG_BUNDLE_S3_KEY"}},
+	{"Nginx.ConfigBundleFile", []string{"NGINX_CONFIG_BUNDLE_FILE"}},
+	{"Nginx.BundleSettingsFile", []string{"NGINX_BUNDLE_SETTINGS_FILE"}},
+	{"Nginx.ApplyStrategy", []string{"NGINX_APPLY_STRATEGY"}},
+	{"Nginx.DynamicUpstreamsURL", []string{"NGINX_DYNAMIC_UPSTREAMS_URL"}},
+	{"Nginx.MaxRestarts", []string{"NGINX_MAX_RESTARTS"}},
+	{"Proxy.Type", []string{"PROXY_TYPE"}},
+	{"Proxy.HAProxyBinary", []string{"HAPROXY_BINARY"}},
+	{"Proxy.HAProxyRuntimeSocket", []string{"HAPROXY_RUNTIME_SOCKET"}},
+	{"Nginx.ReloadQuietWindow", []string{"NGINX_RELOAD_QUIET_WINDOW"}},
+	{"Nginx.ReloadMinInterval", []string{"NGINX_RELOAD_MIN_INTERVAL"}},
+	{"Nginx.ReloadMaxDelay", []string{"NGINX_RELOAD_MAX_DELAY"}},
+	{"Admin.ListenAddress", []string{"ADMIN_LISTEN_ADDRESS"}},
+	{"Admin.ReadyMaxStaleness", []string{"ADMIN_READY_MAX_STALENESS"}},
+	{"Admin.HistorySize", []string{"ADMIN_HISTORY_SIZE"}},
+	{"Admin.Token", []string{"ADMIN_TOKEN"}},
+	{"AccessLog.Listen", []string{"ACCESS_LOG_LISTEN"}},
+	{"Notify.SlackWebhookURLs", []string{"NOTIFY_SLACK_WEBHOOK_URLS"}},
+	{"Notify.WebhookURLs", []string{"NOTIFY_WEBHOOK_URLS"}},
+	{"Notify.DedupWindow", []string{"NOTIFY_DEDUP_WINDOW"}},
+	{"Notify.MaxPerMinute", []string{"NOTIFY_MAX_PER_MINUTE"}},
+	{"Route53.HostedZoneID", []string{"ROUTE53_HOSTED_ZONE_ID"}},
+	{"Route53.RecordName", []string{"ROUTE53_RECORD_NAME"}},
+	{"Route53.RecordType", []string{"ROUTE53_RECORD_TYPE"}},
+	{"Route53.TTL", []string{"ROUTE53_TTL"}},
+	{"Route53.RoutingPolicy", []string{"ROUTE53_ROUTING_POLICY"}},
+	{"Route53.Weight", []string{"ROUTE53_WEIGHT"}},
+	{"Route53.AddressType", []string{"ROUTE53_ADDRESS_TYPE"}},
+	{"Route53.HealthCheckPort", []string{"ROUTE53_HEALTH_CHECK_PORT"}},
+	{"Route53.HealthCheckPath", []string{"ROUTE53_HEALTH_CHECK_PATH"}},
+	{"Route53.SyncInterval", []string{"ROUTE53_SYNC_INTERVAL"}},
+	{"Acme.Hostnames", []string{"ACME_HOSTNAMES"}},
+	{"Acme.Email", []string{"ACME_EMAIL"}},
+	{"Acme.DirectoryURL", []string{"ACME_DIRECTORY_URL"}},
+	{"Acme.Challenge", []string{"ACME_CHALLENGE"}},
+	{"Acme.HostedZoneID", []string{"ACME_HOSTED_ZONE_ID"}},
+	{"Acme.S3Bucket", []string{"ACME_S3_BUCKET"}},
+	{"Acme.S3Prefix", []string{"ACME_S3_PREFIX"}},
+	{"Acme.RenewBefore", []string{"ACME_RENEW_BEFORE"}},
+	{"Acme.CheckInterval", []string{"ACME_CHECK_INTERVAL"}},
+	{"Acme.DNSPropagationDelay", []string{"ACME_DNS_PROPAGATION_DELAY"}},
+	{"Acme.InsecureSkipVerify", []string{"ACME_INSECURE_SKIP_VERIFY"}},
+	{"Gossip.Enabled", []string{"GOSSIP_ENABLED"}},
+	{"Gossip.BindPort", []string{"GOSSIP_BIND_PORT"}},
+	{"Gossip.AdvertiseAddr", []string{"GOSSIP_ADVERTISE_ADDR"}},
+	{"Gossip.AdvertisePort", []string{"GOSSIP_ADVERTISE_PORT"}},
+	{"Gossip.NodeName", []string{"GOSSIP_NODE_NAME"}},
+	{"Gossip.SecretKey", []string{"GOSSIP_SECRET_KEY"}},
+	{"Gossip.JoinInterval", []string{"GOSSIP_JOIN_INTERVAL"}},
+	{"Gossip.SnapshotMaxAge", []string{"GOSSIP_SNAPSHOT_MAX_AGE"}},
+	{"Discovery.Provider", []string{"DISCOVERY_PROVIDER"}},
+	{"Discovery.PollInterval", []string{"DISCOVERY_POLL_INTERVAL"}},
+	{"Discovery.SnapshotFile", []string{"DISCOVERY_SNAPSHOT_FILE"}},
+	{"Discovery.AgentURL", []string{"DISCOVERY_AGENT_URL"}},
+	{"Discovery.DockerHost", []string{"DISCOVERY_DOCKER_HOST"}},
+	{"Discovery.HostAddress", []string{"DISCOVERY_HOST_ADDRESS"}},
+	{"Discovery.LocalZone", []string{"DISCOVERY_LOCAL_ZONE"}},
+	{"Discovery.ZoneMinHealthy", []string{"DISCOVERY_ZONE_MIN_HEALTHY"}},
+	{"Discovery.AddressFamily", []string{"DISCOVERY_ADDRESS_FAMILY"}},
+	{"HealthCheck.Enabled", []string{"HEALTH_CHECK_ENABLED"}},
+	{"HealthCheck.Type", []string{"HEALTH_CHECK_TYPE"}},
+	{"HealthCheck.Path", []string{"HEALTH_CHECK_PATH"}},
+	{"HealthCheck.ExpectedStatus", []string{"HEALTH_CHECK_EXPECTED_STATUS"}},
+	{"HealthCheck.Interval", []string{"HEALTH_CHECK_INTERVAL"}},
+	{"HealthCheck.Timeout", []string{"HEALTH_CHECK_TIMEOUT"}},
+	{"HealthCheck.HealthyThreshold", []string{"HEALTH_CHECK_HEALTHY_THRESHOLD"}},
+	{"HealthCheck.UnhealthyThreshold", []string{"HEALTH_CHECK_UNHEALTHY_THRESHOLD"}},
+	{"State.Folder", []string{"STATE_FOLDER"}},
+	{"State.S3Bucket", []string{"STATE_S3_BUCKET"}},
+	{"State.S3Prefix", []string{"STATE_S3_PREFIX"}},
+}
 
-	// we create a default
-	config := Config{
+// defaultConfig the values used when nothing else sets them
+func defaultConfig() *Config {
+
+	return &Config{
 		AWS: configAWS{
-			ClusterName: "default",
-			Region:      "ap-southeast-2",
+			ClusterName:       "default",
+			Region:            "ap-southeast-2",
+			DaemonServiceName: "ecs-ingress",
+			Endpoint:          "",
+			S3Endpoint:        "",
+			S3ForcePathStyle:  false,
+			Discovery: configAssumeRole{
+				SessionName: "ecs-ingress-discovery",
+			},
+			Bundle: configAssumeRole{
+				SessionName: "ecs-ingress-bundle",
+			},
 		},
 		Nginx: configNginx{
+			Binary:                "nginx",
 			ConfigFolder:          "/app/nginx",
 			UpstreamsTemplateFile: "upstreams.conf.tmpl",
 			UpstreamsConfigFile:   "upstreams.conf",
 			MainConfigFile:        "nginx.conf",
 			ConfigBundleS3Bucket:  "",
 			ConfigBundleS3Key:     "",
+			ConfigBundleFile:      "",
+			BundleSettingsFile:    "",
+			ApplyStrategy:         "reload",
+			DynamicUpstreamsURL:   "",
+			MaxRestarts:           0,
+			ReloadQuietWindow:     0,
+			ReloadMinInterval:     0,
+			ReloadMaxDelay:        60 * time.Second,
+		},
+		Proxy: configProxy{
+			Type:                 "nginx",
+			HAProxyBinary:        "haproxy",
+			HAProxyRuntimeSocket: "",
+		},
+		Admin: configAdmin{
+			ListenAddress:     ":8081",
+			ReadyMaxStaleness: 60 * time.Second,
+			HistorySize:       20,
+		},
+		AccessLog: configAccessLog{
+			Listen: "",
+		},
+		Notify: configNotify{
+			SlackWebhookURLs: []string{},
+			WebhookURLs:      []string{},
+			DedupWindow:      10 * time.Minute,
+			MaxPerMinute:     10,
+		},
+		Route53: configRoute53{
+			HostedZoneID:    "",
+			RecordName:      "",
+			RecordType:      "A",
+			TTL:             60,
+			RoutingPolicy:   "multivalue",
+			Weight:          1,
+			AddressType:     "public",
+			HealthCheckPort: 0,
+			HealthCheckPath: "/readyz",
+			SyncInterval:    60 * time.Second,
+		},
+		Acme: configAcme{
+			Hostnames:           []string{},
+			Email:               "",
+			DirectoryURL:        "https://acme-v02.api.letsencrypt.org/directory",
+			Challenge:           "http-01",
+			HostedZoneID:        "",
+			S3Bucket:            "",
+			S3Prefix:            "acme",
+			CertFolder:          "certs",
+			RenewBefore:         30 * 24 * time.Hour,
+			CheckInterval:       12 * time.Hour,
+			DNSPropagationDelay: 30 * time.Second,
+			InsecureSkipVerify:  false,
+		},
+		Gossip: configGossip{
+			Enabled:        false,
+			BindPort:       7946,
+			AdvertiseAddr:  "",
+			AdvertisePort:  0,
+			NodeName:       "",
+			SecretKey:      "",
+			JoinInterval:   60 * time.Second,
+			SnapshotMaxAge: 30 * time.Second,
+		},
+		Discovery: configDiscovery{
+			Provider:       "ecs",
+			PollInterval:   10 * time.Second,
+			SnapshotFile:   "",
+			AgentURL:       "http://localhost:51678",
+			DockerHost:     "unix:///var/run/docker.sock",
+			HostAddress:    "127.0.0.1",
+			LocalZone:      "",
+			ZoneMinHealthy: 0,
+			AddressFamily:  "ipv4",
 		},
+		HealthCheck: configHealthCheck{
+			Enabled:            false,
+			Type:               "http",
+			Path:               "/",
+			ExpectedStatus:     "200-399",
+			Interval:           10 * time.Second,
+			Timeout:            2 * time.Second,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+		},
+		State: configState{
+			Folder:   "/app/state",
+			S3Bucket: "",
+			S3Prefix: "ecs-ingress-state",
+		},
+	}
+}
+
+// NewConfig is used to generate a configuration instance which will be passed around the codebase.
+// Defaults are overridden by the config file, then the env variables, then the command line flags.
+// It returns the arguments following the flags.
+func NewConfig(args []string) (*Config, []string, error) {
+
+	config, flagSet, err := loadConfig(args, "", nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	warnUnknownEnv()
+
+	return config, flagSet.Args(), nil
+}
+
+// loadConfig layers the settings. The bundle settings, if any, sit between the config file and the env variables.
+func loadConfig(args []string, bundleSettingsName string, bundleSettings []byte) (*Config, *flag.FlagSet, error) {
+
+	config := defaultConfig()
+	config.args = args
+
+	configViper := viper.New()
+
+	for _, binding := range envBindings {
+		configViper.BindEnv(append([]string{binding.key}, binding.envList...)...)
+	}
+
+	flagSet := flag.NewFlagSet("ecs-ingress", flag.ContinueOnError)
+	configFile := flagSet.String("config", os.Getenv(configFileEnv), "YAML, TOML or JSON config file")
+
+	for _, key := range configKeys(reflect.TypeOf(*config), "") {
+		flagSet.String(key.name, "", fmt.Sprintf("overrides the '%v' config key", key.name))
 	}
 
-	viper.BindEnv("AWS.Clustername", "AWS_CLUSTER_NAME")
-	viper.BindEnv("AWS.Region", "AWS_REGION")
-	viper.BindEnv("Nginx.MainConfigFile", "NGINX_CONFIG_FILE_NAME")
-	viper.BindEnv("Nginx.ConfigBundleS3Bucket", "NGINX_CONFIG_BUNDLE_S3_BUCKET")
-	viper.BindEnv("Nginx.ConfigBundleS3Key", "NGINX_CONFIG_BUNDLE_S3_KEY")
+	if err := flagSet.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	config.configFile = *configFile
+
+	if *configFile != "" {
+
+		configViper.SetConfigFile(*configFile)
+
+		if err := configViper.ReadInConfig(); err != nil {
+			return nil, nil, fmt.Errorf("Unable to read config file '%v': %v", *configFile, err)
+		}
+
+		if err := checkFileKeys(configViper); err != nil {
+			return nil, nil, fmt.Errorf("Invalid config file '%v': %v", *configFile, err)
+		}
+	}
+
+	if len(bundleSettings) > 0 {
+
+		bundleViper := viper.New()
+		bundleViper.SetConfigType(strings.TrimPrefix(filepath.Ext(bundleSettingsName), "."))
 
-	if err := viper.Unmarshal(&config); err != nil {
-		log.Panic().Msgf("Error unmarshaling config, %s", err)
+		if err := bundleViper.ReadConfig(bytes.NewReader(bundleSettings)); err != nil {
+			return nil, nil, fmt.Errorf("Unable to read bundle settings '%v': %v", bundleSettingsName, err)
+		}
+
+		if err := checkFileKeys(bundleViper); err != nil {
+			return nil, nil, fmt.Errorf("Invalid bundle settings '%v': %v", bundleSettingsName, err)
+		}
+
+		if err := configViper.MergeConfigMap(bundleViper.AllSettings()); err != nil {
+			return nil, nil, fmt.Errorf("Unable to merge bundle settings '%v': %v", bundleSettingsName, err)
+		}
+	}
+
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			configViper.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if err := configViper.Unmarshal(config); err != nil {
+		return nil, nil, fmt.Errorf("Invalid config value: %v", err)
 	}
 
+	return config, flagSet, nil
+}
+
+// Log prints the main settings
+func (c *Config) Log() {
+
 	log.Info().
-		Str("AWS Clustername", config.AWS.ClusterName).
-		Str("AWS Region", config.AWS.Region).
-		Str("NGINX ConfigFolder", config.Nginx.ConfigFolder).
-		Str("NGINX MainConfigFile", config.Nginx.MainConfigFile).
-		Str("NGINX ConfigBundleS3Bucket", config.Nginx.ConfigBundleS3Bucket).
-		Str("NGINX ConfigBundleS3Key", config.Nginx.ConfigBundleS3Key).
+		Str("AWS Clustername", c.AWS.ClusterName).
+		Str("AWS Region", c.AWS.Region).
+		Str("AWS DaemonServiceName", c.AWS.DaemonServiceName).
+		Str("AWS Endpoint", c.AWS.Endpoint).
+		Str("AWS Discovery RoleARN", c.AWS.Discovery.RoleARN).
+		Str("AWS Bundle RoleARN", c.AWS.Bundle.RoleARN).
+		Str("NGINX ConfigFolder", c.Nginx.ConfigFolder).
+		Str("NGINX MainConfigFile", c.Nginx.MainConfigFile).
+		Str("NGINX ConfigBundleS3Bucket", c.Nginx.ConfigBundleS3Bucket).
+		Str("NGINX ConfigBundleS3Key", c.Nginx.ConfigBundleS3Key).
+		Str("NGINX ConfigBundleFile", c.Nginx.ConfigBundleFile).
+		Str("NGINX ApplyStrategy", c.Nginx.ApplyStrategy).
+		Str("Proxy Type", c.Proxy.Type).
+		Str("Proxy HAProxyRuntimeSocket", c.Proxy.HAProxyRuntimeSocket).
+		Int("NGINX MaxRestarts", c.Nginx.MaxRestarts).
+		Dur("NGINX ReloadQuietWindow", c.Nginx.ReloadQuietWindow).
+		Dur("NGINX ReloadMinInterval", c.Nginx.ReloadMinInterval).
+		Str("Admin ListenAddress", c.Admin.ListenAddress).
+		Dur("Admin ReadyMaxStaleness", c.Admin.ReadyMaxStaleness).
+		Int("Admin HistorySize", c.Admin.HistorySize).
+		Bool("Admin Token set", c.Admin.Token != "").
+		Str("AccessLog Listen", c.AccessLog.Listen).
+		Int("Notify SlackWebhookURLs", len(c.Notify.SlackWebhookURLs)).
+		Int("Notify WebhookURLs", len(c.Notify.WebhookURLs)).
+		Str("Route53 HostedZoneID", c.Route53.HostedZoneID).
+		Str("Route53 RecordName", c.Route53.RecordName).
+		Str("Route53 RoutingPolicy", c.Route53.RoutingPolicy).
+		Strs("Acme Hostnames", c.Acme.Hostnames).
+		Str("Acme DirectoryURL", c.Acme.DirectoryURL).
+		Str("Acme Challenge", c.Acme.Challenge).
+		Bool("Gossip Enabled", c.Gossip.Enabled).
+		Int("Gossip BindPort", c.Gossip.BindPort).
+		Str("Gossip AdvertiseAddr", c.Gossip.AdvertiseAddr).
+		Int("Gossip AdvertisePort", c.Gossip.AdvertisePort).
+		Str("Discovery Provider", c.Discovery.Provider).
+		Int("Discovery ZoneMinHealthy", c.Discovery.ZoneMinHealthy).
+		Str("Discovery AddressFamily", c.Discovery.AddressFamily).
+		Bool("HealthCheck Enabled", c.HealthCheck.Enabled).
+		Str("HealthCheck Type", c.HealthCheck.Type).
+		Str("State Folder", c.State.Folder).
+		Str("State S3Bucket", c.State.S3Bucket).
 		Msgf("Config loaded successfully")
-
-	return &config, nil
 }
@@ -0,0 +1,178 @@
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewConfigLayers(t *testing.T) {
+
+	configFile := filepath.Join(t.TempDir(), "ecs-ingress.yaml")
+
+	content := "aws:\n  clustername: from-file\n  region: eu-west-1\nnginx:\n  configbundles3bucket: bucket\n  configbundles3key: from-file\n"
+
+	if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("NGINX_CONFIG_BUNDLE_S3_KEY", "from-env")
+	defer os.Unsetenv("NGINX_CONFIG_BUNDLE_S3_KEY")
+
+	config, args, err := NewConfig([]string{"-config", configFile, "-aws.clustername", "from-flag", "-admin.readymaxstaleness", "2m", "render", "-snapshot", "x"})
+
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+
+	if config.AWS.ClusterName != "from-flag" {
+		t.Errorf("flags must win over the file, got '%v'", config.AWS.ClusterName)
+	}
+
+	if config.Nginx.ConfigBundleS3Key != "from-env" {
+		t.Errorf("env must win over the file, got '%v'", config.Nginx.ConfigBundleS3Key)
+	}
+
+	if config.AWS.Region != "eu-west-1" {
+		t.Errorf("file must win over the defaults, got '%v'", config.AWS.Region)
+	}
+
+	if config.Nginx.ConfigFolder != "/app/nginx" || config.Admin.ReadyMaxStaleness != 2*time.Minute {
+		t.Errorf("unexpected values %v %v", config.Nginx.ConfigFolder, config.Admin.ReadyMaxStaleness)
+	}
+
+	if strings.Join(args, " ") != "render -snapshot x" {
+		t.Errorf("unexpected remaining args %v", args)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected a valid config, got %v", err)
+	}
+}
+
+func TestNewConfigUnknownFileKey(t *testing.T) {
+
+	configFile := filepath.Join(t.TempDir(), "ecs-ingress.yaml")
+
+	if err := ioutil.WriteFile(configFile, []byte("aws:\n  clustrname: prod\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := NewConfig([]string{"-config", configFile}); err == nil || !strings.Contains(err.Error(), "aws.clustrname") {
+		t.Errorf("expected the unknown key to be reported, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	config := defaultConfig()
+	config.AWS.Region = "sydney"
+	config.Discovery.Provider = "consul"
+	config.Proxy.Type = "haproxy"
+	config.Nginx.ApplyStrategy = "openresty"
+	config.Gossip.Enabled = true
+
+	err := config.Validate()
+
+	if err == nil {
+		t.Fatal("expected an invalid config")
+	}
+
+	for _, expected := range []string{"aws.region", "nginx.configbundles3bucket", "discovery.provider", "must be reload with haproxy", "gossip.secretkey"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected '%v' to be reported in:\n%v", expected, err)
+		}
+	}
+}
+
+func TestValuesRedactsSecrets(t *testing.T) {
+
+	config := defaultConfig()
+	config.Admin.Token = "s3cret"
+
+	for _, value := range config.Values() {
+
+		if strings.Contains(value.Value, "s3cret") {
+			t.Errorf("secret printed for %v", value.Key)
+		}
+
+		if value.Key == "admin.token" && value.Value != "<redacted>" {
+			t.Errorf("expected admin.token to be redacted, got '%v'", value.Value)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+
+	configFile := filepath.Join(t.TempDir(), "ecs-ingress.yaml")
+
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(configFile, []byte("aws:\n  clustername: prod\nnginx:\n  configbundlefile: /tmp/bundle.zip\n"+content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("discovery:\n  pollinterval: 10s\n")
+
+	config, _, err := NewConfig([]string{"-config", configFile, "-admin.historysize", "5"})
+
+	if err != nil {
+		t.Fatalf("NewConfig failed: %v", err)
+	}
+
+	reloader := NewConfigReloader(config, NewMetrics(config))
+
+	// live settings are applied, the others wait for a restart
+	writeConfig("discovery:\n  pollinterval: 30s\n  provider: file\n  snapshotfile: /tmp/snapshot.json\nnotify:\n  webhookurls: https://example.com/hook\n")
+
+	if result := reloader.Reload("test"); result != reloadApplied {
+		t.Errorf("expected %v, got %v", reloadApplied, result)
+	}
+
+	current := config.Current()
+
+	if current.Discovery.PollInterval != 30*time.Second || len(current.Notify.WebhookURLs) != 1 {
+		t.Errorf("live settings not applied: %v %v", current.Discovery.PollInterval, current.Notify.WebhookURLs)
+	}
+
+	if current.Discovery.Provider != "ecs" {
+		t.Errorf("restart-only setting applied: %v", current.Discovery.Provider)
+	}
+
+	// the bundle overrides the file, the flags still win
+	reloader.SetBundleSettings("settings.yaml", []byte("discovery:\n  pollinterval: 1m\nadmin:\n  historysize: 50\n"))
+
+	if current := config.Current(); current.Discovery.PollInterval != time.Minute || current.Admin.HistorySize != 5 {
+		t.Errorf("unexpected bundle layering: %v %v", current.Discovery.PollInterval, current.Admin.HistorySize)
+	}
+
+	// an invalid config is ignored as a whole
+	reloader.SetBundleSettings("settings.yaml", []byte("discovery:\n  pollinterval: -1s\n"))
+
+	if current := config.Current(); current.Discovery.PollInterval != time.Minute {
+		t.Errorf("invalid reload applied: %v", current.Discovery.PollInterval)
+	}
+
+	if result := reloader.Reload("test"); result != reloadInvalid {
+		t.Errorf("expected %v, got %v", reloadInvalid, result)
+	}
+}
+
+func TestEnvPrefixes(t *testing.T) {
+
+	// the env variables of every config key must be recognised, or their typos go unreported
+	for _, binding := range envBindings {
+		for _, env := range binding.envList {
+			if !strings.HasPrefix(env, "AWS_") && !hasEnvPrefix(env) {
+				t.Errorf("%v (%v) doesn't start with any of %v", env, binding.key, envPrefixes)
+			}
+		}
+	}
+
+	if hasEnvPrefix("AWS_ACCESS_KEY_ID") || hasEnvPrefix("HOME") {
+		t.Error("variables that aren't ours must not be reported")
+	}
+}
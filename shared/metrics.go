@@ -0,0 +1,189 @@
+package shared
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Metrics The shared prometheus collectors exposed on the admin endpoint
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	UpstreamRequests        *prometheus.CounterVec
+	UpstreamRequestDuration *prometheus.HistogramVec
+	UpstreamBytesSent       *prometheus.CounterVec
+	AccessLogLines          *prometheus.CounterVec
+
+	ReconcileDuration    *prometheus.HistogramVec
+	AWSAPICalls          *prometheus.CounterVec
+	AWSAPIErrors         *prometheus.CounterVec
+	DiscoveredServices   prometheus.Gauge
+	DiscoveredEndpoints  prometheus.Gauge
+	BundleDownloadBytes  prometheus.Counter
+	BundleDownloadErrors prometheus.Counter
+	ProxyConfigTests     *prometheus.CounterVec
+	ProxyReloads         *prometheus.CounterVec
+	ProxyRestarts        prometheus.Counter
+	LastApplyTimestamp   prometheus.Gauge
+	ConfigReloads        *prometheus.CounterVec
+	DynamicUpdates       *prometheus.CounterVec
+
+	HealthCheckEndpoints   *prometheus.GaugeVec
+	HealthCheckTransitions *prometheus.CounterVec
+}
+
+// NewMetrics creates and registers all the collectors in a dedicated registry
+func NewMetrics(cfg *Config) *Metrics {
+
+	// every series is labeled with the cluster we are serving
+	constLabels := prometheus.Labels{"cluster": cfg.AWS.ClusterName}
+
+	ret := &Metrics{
+		Registry: prometheus.NewRegistry(),
+
+		UpstreamRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "upstream_requests_total",
+			Help:      "Requests proxied to each upstream by status code class.",
+		}, []string{"upstream", "status"}),
+
+		UpstreamRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ecs_ingress",
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Request latency per upstream as seen by nginx.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"upstream"}),
+
+		UpstreamBytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "upstream_response_bytes_total",
+			Help:      "Bytes sent to clients per upstream.",
+		}, []string{"upstream"}),
+
+		AccessLogLines: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "access_log_lines_total",
+			Help:      "Access log lines received by result (parsed, invalid).",
+		}, []string{"result"}),
+
+		ReconcileDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "ecs_ingress",
+			Name:      "reconcile_duration_seconds",
+			Help:      "Duration of each discovery and apply loop by result (unchanged, applied, drift, error).",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"result"}),
+
+		AWSAPICalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "aws_api_calls_total",
+			Help:      "AWS API calls per service and operation.",
+		}, []string{"service", "operation"}),
+
+		AWSAPIErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "aws_api_errors_total",
+			Help:      "Failed AWS API calls per service and operation.",
+		}, []string{"service", "operation"}),
+
+		DiscoveredServices: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ecs_ingress",
+			Name:      "discovered_services",
+			Help:      "ECS services found by the last discovery.",
+		}),
+
+		DiscoveredEndpoints: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ecs_ingress",
+			Name:      "discovered_endpoints",
+			Help:      "Task endpoints found by the last discovery.",
+		}),
+
+		BundleDownloadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "bundle_download_bytes_total",
+			Help:      "Bytes downloaded from the S3 config bundle.",
+		}),
+
+		BundleDownloadErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "bundle_download_failures_total",
+			Help:      "Failed downloads of the S3 config bundle.",
+		}),
+
+		ProxyConfigTests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "proxy_config_tests_total",
+			Help:      "Proxy configuration tests (nginx -t, haproxy -c) by result (success, failure).",
+		}, []string{"result"}),
+
+		ProxyReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "proxy_reloads_total",
+			Help:      "Proxy reloads by result (success, failure).",
+		}, []string{"result"}),
+
+		ProxyRestarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "proxy_restarts_total",
+			Help:      "Times the proxy process exited and was started again.",
+		}),
+
+		LastApplyTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ecs_ingress",
+			Name:      "last_apply_timestamp_seconds",
+			Help:      "Unix time of the last configuration successfully applied to nginx.",
+		}),
+
+		ConfigReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "config_reloads_total",
+			Help:      "Settings reloads by result (applied, unchanged, rejected, invalid).",
+		}, []string{"result"}),
+
+		DynamicUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "dynamic_upstream_updates_total",
+			Help:      "Server lists pushed to nginx without a reload by result (success, failure).",
+		}, []string{"result"}),
+
+		HealthCheckEndpoints: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "ecs_ingress",
+			Name:      "health_check_endpoints",
+			Help:      "Endpoints probed by the active health checker by state (healthy, unhealthy).",
+		}, []string{"state"}),
+
+		HealthCheckTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "ecs_ingress",
+			Name:      "health_check_transitions_total",
+			Help:      "Endpoints changing state by the state they enter (healthy, unhealthy).",
+		}, []string{"state"}),
+	}
+
+	prometheus.WrapRegistererWith(constLabels, ret.Registry).MustRegister(
+		ret.UpstreamRequests,
+		ret.UpstreamRequestDuration,
+		ret.UpstreamBytesSent,
+		ret.AccessLogLines,
+		ret.ReconcileDuration,
+		ret.AWSAPICalls,
+		ret.AWSAPIErrors,
+		ret.DiscoveredServices,
+		ret.DiscoveredEndpoints,
+		ret.BundleDownloadBytes,
+		ret.BundleDownloadErrors,
+		ret.ProxyConfigTests,
+		ret.ProxyReloads,
+		ret.ProxyRestarts,
+		ret.LastApplyTimestamp,
+		ret.ConfigReloads,
+		ret.DynamicUpdates,
+		ret.HealthCheckEndpoints,
+		ret.HealthCheckTransitions,
+	)
+
+	ret.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return ret
+}
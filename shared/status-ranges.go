@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusRanges a list of HTTP status codes and ranges, e.g. "200-399" or "200,204"
+type StatusRanges [][2]int
+
+// ParseStatusRanges parses a comma separated list of status codes and ranges
+func ParseStatusRanges(value string) (StatusRanges, error) {
+
+	retList := make(StatusRanges, 0)
+
+	for _, part := range strings.Split(value, ",") {
+
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		low, err := strconv.Atoi(bounds[0])
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid status '%v'", part)
+		}
+
+		high := low
+
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid status range '%v'", part)
+			}
+		}
+
+		if low < 100 || high > 599 || low > high {
+			return nil, fmt.Errorf("invalid status range '%v'", part)
+		}
+
+		retList = append(retList, [2]int{low, high})
+	}
+
+	return retList, nil
+}
+
+// Contains returns true when the status code is in one of the ranges
+func (s StatusRanges) Contains(status int) bool {
+
+	for _, bounds := range s {
+		if status >= bounds[0] && status <= bounds[1] {
+			return true
+		}
+	}
+
+	return false
+}
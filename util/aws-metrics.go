@@ -0,0 +1,23 @@
+package util
+
+import (
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// instrumentSession counts every AWS API call (and its failures) made through the session
+func instrumentSession(mySession *session.Session, metrics *shared.Metrics) {
+
+	mySession.Handlers.Complete.PushBack(func(r *request.Request) {
+
+		serviceName := r.ClientInfo.ServiceName
+		operationName := r.Operation.Name
+
+		metrics.AWSAPICalls.WithLabelValues(serviceName, operationName).Inc()
+
+		if r.Error != nil {
+			metrics.AWSAPIErrors.WithLabelValues(serviceName, operationName).Inc()
+		}
+	})
+}
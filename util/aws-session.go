@@ -0,0 +1,109 @@
+package util
+
+import (
+	"sync"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// AWSSessions hands out one shared AWS session per purpose. Discovery and the config bundle can
+// each assume a role, e.g. to reach a cluster or a tooling bucket in another account.
+type AWSSessions struct {
+	cfg     *shared.Config
+	metrics *shared.Metrics
+
+	lock        sync.Mutex
+	baseSession *session.Session
+	roleMap     map[string]*session.Session
+}
+
+// NewAWSSessions Creates a new session provider. Sessions are created on first use.
+func NewAWSSessions(cfg *shared.Config, metrics *shared.Metrics) *AWSSessions {
+
+	ret := &AWSSessions{
+		cfg:     cfg,
+		metrics: metrics,
+		roleMap: make(map[string]*session.Session),
+	}
+
+	return ret
+}
+
+// Default the session for everything without a dedicated role (route53, state, certificates)
+func (a *AWSSessions) Default() *session.Session {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.base()
+}
+
+// Discovery the session for the ECS and EC2 calls
+func (a *AWSSessions) Discovery() *session.Session {
+	return a.withRole(a.cfg.AWS.Discovery.RoleARN, a.cfg.AWS.Discovery.ExternalID, a.cfg.AWS.Discovery.SessionName)
+}
+
+// Bundle the session for the config bundle download
+func (a *AWSSessions) Bundle() *session.Session {
+	return a.withRole(a.cfg.AWS.Bundle.RoleARN, a.cfg.AWS.Bundle.ExternalID, a.cfg.AWS.Bundle.SessionName)
+}
+
+// base creates the session of the default credential chain. The lock must be held.
+func (a *AWSSessions) base() *session.Session {
+
+	if a.baseSession != nil {
+		return a.baseSession
+	}
+
+	awsConfig := aws.Config{Region: aws.String(a.cfg.AWS.Region)}
+
+	// local stand-ins for tests
+	if a.cfg.AWS.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(a.cfg.AWS.Endpoint)
+	}
+
+	a.baseSession = session.Must(session.NewSessionWithOptions(session.Options{
+		Config: awsConfig,
+	}))
+
+	instrumentSession(a.baseSession, a.metrics)
+
+	return a.baseSession
+}
+
+// withRole returns the base session when no role is configured. Sessions sharing a role are reused,
+// so that the temporary credentials are cached and refreshed once.
+func (a *AWSSessions) withRole(roleARN string, externalID string, sessionName string) *session.Session {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	baseSession := a.base()
+
+	if roleARN == "" {
+		return baseSession
+	}
+
+	cacheKey := roleARN + "|" + externalID + "|" + sessionName
+
+	if roleSession, found := a.roleMap[cacheKey]; found {
+		return roleSession
+	}
+
+	credentials := stscreds.NewCredentials(baseSession, roleARN, func(provider *stscreds.AssumeRoleProvider) {
+
+		provider.RoleSessionName = sessionName
+
+		if externalID != "" {
+			provider.ExternalID = aws.String(externalID)
+		}
+	})
+
+	// the copy keeps the instrumentation handlers
+	roleSession := baseSession.Copy(&aws.Config{Credentials: credentials})
+
+	a.roleMap[cacheKey] = roleSession
+
+	return roleSession
+}
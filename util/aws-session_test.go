@@ -0,0 +1,91 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+)
+
+// assumeRoleResponse an STS AssumeRole answer
+const assumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASSUMED</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>%v</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+func TestAWSSessions(t *testing.T) {
+
+	// the default chain picks the static credentials up from the env
+	os.Setenv("AWS_ACCESS_KEY_ID", "BASE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	var lock sync.Mutex
+	assumedList := make([]url.Values, 0)
+
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+
+		lock.Lock()
+		assumedList = append(assumedList, req.PostForm)
+		lock.Unlock()
+
+		fmt.Fprintf(w, assumeRoleResponse, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+
+	defer sts.Close()
+
+	cfg := &shared.Config{}
+	cfg.AWS.Region = "ap-southeast-2"
+	cfg.AWS.Endpoint = sts.URL
+	cfg.AWS.Discovery.RoleARN = "arn:aws:iam::111111111111:role/discovery"
+	cfg.AWS.Discovery.ExternalID = "external"
+	cfg.AWS.Discovery.SessionName = "ecs-ingress"
+
+	sessions := NewAWSSessions(cfg, shared.NewMetrics(cfg))
+
+	// no bundle role, the bundle is downloaded with the default credentials
+	if sessions.Bundle() != sessions.Default() {
+		t.Error("expected the bundle session to fall back to the default one")
+	}
+
+	if credentials, err := sessions.Bundle().Config.Credentials.Get(); err != nil || credentials.AccessKeyID != "BASE" {
+		t.Errorf("expected the default credentials for the bundle, got %v (%v)", credentials.AccessKeyID, err)
+	}
+
+	discovery := sessions.Discovery()
+
+	if discovery == sessions.Default() || sessions.Discovery() != discovery {
+		t.Fatal("expected one dedicated session for the discovery role")
+	}
+
+	credentials, err := discovery.Config.Credentials.Get()
+
+	if err != nil || credentials.AccessKeyID != "ASSUMED" {
+		t.Fatalf("expected the assumed credentials, got %v (%v)", credentials.AccessKeyID, err)
+	}
+
+	if len(assumedList) != 1 || assumedList[0].Get("RoleArn") != cfg.AWS.Discovery.RoleARN || assumedList[0].Get("ExternalId") != "external" || assumedList[0].Get("RoleSessionName") != "ecs-ingress" {
+		t.Errorf("unexpected AssumeRole calls %v", assumedList)
+	}
+
+	// the same role is shared, with its cached credentials
+	cfg.AWS.Bundle = cfg.AWS.Discovery
+
+	if sessions.Bundle() != discovery {
+		t.Error("expected the bundle to share the discovery role session")
+	}
+}
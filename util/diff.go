@@ -0,0 +1,141 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContextLines = 3
+
+// LineDiff returns a unified style diff between two texts, or an empty string when they are equal.
+// It's a plain LCS diff meant for config files, not for large inputs.
+func LineDiff(fromName string, toName string, from string, to string) string {
+
+	if from == to {
+		return ""
+	}
+
+	fromLines := splitLines(from)
+	toLines := splitLines(to)
+
+	// lcs[i][j] is the length of the longest common subsequence of fromLines[i:] and toLines[j:]
+	lcs := make([][]int, len(fromLines)+1)
+
+	for i := range lcs {
+		lcs[i] = make([]int, len(toLines)+1)
+	}
+
+	for i := len(fromLines) - 1; i >= 0; i-- {
+		for j := len(toLines) - 1; j >= 0; j-- {
+			if fromLines[i] == toLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// we walk the table producing one prefixed line per input line, deletions before additions
+	opList := make([]string, 0)
+
+	i, j := 0, 0
+
+	for i < len(fromLines) || j < len(toLines) {
+		switch {
+		case i < len(fromLines) && j < len(toLines) && fromLines[i] == toLines[j]:
+			opList = append(opList, " "+fromLines[i])
+			i++
+			j++
+		case i < len(fromLines) && (j == len(toLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			opList = append(opList, "-"+fromLines[i])
+			i++
+		default:
+			opList = append(opList, "+"+toLines[j])
+			j++
+		}
+	}
+
+	builder := &strings.Builder{}
+
+	fmt.Fprintf(builder, "--- %v\n+++ %v\n", fromName, toName)
+
+	// we only print the changed lines with some context around them, as hunks with their line ranges
+	fromLine, toLine := 0, 0
+
+	for index := 0; index < len(opList); {
+
+		if !nearChange(opList, index) {
+			fromLine, toLine = countLine(opList[index], fromLine, toLine)
+			index++
+			continue
+		}
+
+		end := index
+		fromCount, toCount := 0, 0
+
+		for end < len(opList) && nearChange(opList, end) {
+			fromCount, toCount = countLine(opList[end], fromCount, toCount)
+			end++
+		}
+
+		fmt.Fprintf(builder, "@@ -%v +%v @@\n", hunkRange(fromLine, fromCount), hunkRange(toLine, toCount))
+
+		for _, op := range opList[index:end] {
+			builder.WriteString(op + "\n")
+		}
+
+		fromLine += fromCount
+		toLine += toCount
+		index = end
+	}
+
+	return builder.String()
+}
+
+// countLine adds an op to the number of lines seen on each side
+func countLine(op string, fromCount int, toCount int) (int, int) {
+
+	switch op[0] {
+	case '-':
+		return fromCount + 1, toCount
+	case '+':
+		return fromCount, toCount + 1
+	}
+
+	return fromCount + 1, toCount + 1
+}
+
+// hunkRange formats a side of a hunk header like diff -u: an empty range points at the line before it
+func hunkRange(before int, count int) string {
+
+	switch count {
+	case 0:
+		return fmt.Sprintf("%v,0", before)
+	case 1:
+		return fmt.Sprintf("%v", before+1)
+	}
+
+	return fmt.Sprintf("%v,%v", before+1, count)
+}
+
+func nearChange(opList []string, index int) bool {
+
+	for k := index - diffContextLines; k <= index+diffContextLines; k++ {
+		if k >= 0 && k < len(opList) && opList[k][0] != ' ' {
+			return true
+		}
+	}
+
+	return false
+}
+
+func splitLines(text string) []string {
+
+	if text == "" {
+		return []string{}
+	}
+
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
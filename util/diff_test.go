@@ -0,0 +1,56 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		from     string
+		to       string
+		expected string
+	}{
+		{
+			name:     "identical",
+			from:     "a\nb\n",
+			to:       "a\nb\n",
+			expected: "",
+		},
+		{
+			name:     "pure add",
+			from:     "",
+			to:       "x\ny\n",
+			expected: "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+x\n+y\n",
+		},
+		{
+			name:     "pure delete",
+			from:     "x\ny\n",
+			to:       "",
+			expected: "--- old\n+++ new\n@@ -1,2 +0,0 @@\n-x\n-y\n",
+		},
+		{
+			name:     "add in the middle",
+			from:     "a\nb\n",
+			to:       "a\nx\nb\n",
+			expected: "--- old\n+++ new\n@@ -1,2 +1,3 @@\n a\n+x\n b\n",
+		},
+		{
+			// checked against diff -u
+			name: "mixed hunks",
+			from: "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn\n",
+			to:   "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nn\nnew\n",
+			expected: "--- old\n+++ new\n" +
+				"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+				"@@ -10,5 +10,5 @@\n j\n k\n l\n-m\n n\n+new\n",
+		},
+	}
+
+	for _, test := range tests {
+
+		if diff := LineDiff("old", "new", test.from, test.to); diff != test.expected {
+			t.Errorf("%v: expected\n%v\ngot\n%v", test.name, test.expected, diff)
+		}
+	}
+}
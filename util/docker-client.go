@@ -0,0 +1,109 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DockerContainer a running container as reported by the Docker Engine API
+type DockerContainer struct {
+	ID              string `json:"Id"`
+	Names           []string
+	Labels          map[string]string
+	State           string
+	Ports           []DockerPort
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string
+		}
+	}
+}
+
+// DockerPort a port of a DockerContainer. PublicPort is 0 when not published on the host.
+type DockerPort struct {
+	IP          string
+	PrivatePort int64
+	PublicPort  int64
+	Type        string
+}
+
+// DockerClient a minimal Docker Engine API client
+type DockerClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewDockerClient Creates a new docker client for a host like unix:///var/run/docker.sock or tcp://127.0.0.1:2375
+func NewDockerClient(dockerHost string) (*DockerClient, error) {
+
+	hostURL, err := url.Parse(dockerHost)
+
+	if err != nil {
+		return nil, fmt.Errorf("Invalid docker host '%v': %v", dockerHost, err)
+	}
+
+	ret := &DockerClient{
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	switch hostURL.Scheme {
+	case "unix":
+
+		socketPath := hostURL.Path
+		dialer := &net.Dialer{}
+
+		ret.baseURL = "http://docker"
+		ret.httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		}
+
+	case "tcp", "http":
+		ret.baseURL = "http://" + hostURL.Host
+
+	default:
+		return nil, fmt.Errorf("Unsupported docker host '%v'", dockerHost)
+	}
+
+	return ret, nil
+}
+
+// ListContainers returns the running containers carrying the given label
+func (d *DockerClient) ListContainers(label string) ([]DockerContainer, error) {
+
+	filters, _ := json.Marshal(map[string][]string{"label": {label}})
+
+	resp, err := d.httpClient.Get(d.baseURL + "/containers/json?filters=" + url.QueryEscape(string(filters)))
+
+	if err != nil {
+		return nil, fmt.Errorf("Docker call failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("Docker call failed: %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Docker call failed with code %v: %v", resp.StatusCode, strings.TrimSpace(string(buf)))
+	}
+
+	retList := make([]DockerContainer, 0)
+
+	if err := json.Unmarshal(buf, &retList); err != nil {
+		return nil, fmt.Errorf("Invalid docker reply: %v", err)
+	}
+
+	return retList, nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
 // Ec2Instance a ecs container instance cut down view
@@ -15,28 +16,34 @@ type Ec2Instance struct {
 	PrivateIPAddress string
 	PrivateDNSName   string
 	PublicIPAddress  string
+	IPv6Address      string
+	AvailabilityZone string
+	SubnetID         string
+}
+
+// Ec2API the ec2 operations we rely on, so that they can be faked in tests
+type Ec2API interface {
+	DescribeInstances(instanceIDList []string) ([]Ec2Instance, error)
+	DescribeInstance(instanceID string) (*Ec2Instance, error)
 }
 
 // Ec2Client simplified client to access ECS resources on AWS
 type Ec2Client struct {
-	cfg     *shared.Config
-	session *session.Session
-	ec2Svc  *ec2.EC2
+	cfg    *shared.Config
+	ec2Svc ec2iface.EC2API
 }
 
-// NewEc2Client Creates a new ec2 client
-func NewEc2Client(cfg *shared.Config) *Ec2Client {
-
-	mySession := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{Region: aws.String(cfg.AWS.Region)},
-	}))
+// NewEc2Client Creates a new ec2 client from a shared session
+func NewEc2Client(cfg *shared.Config, mySession *session.Session) *Ec2Client {
+	return NewEc2ClientFromAPI(cfg, ec2.New(mySession))
+}
 
-	// Create a EC2/ECS clients from just a session
+// NewEc2ClientFromAPI Creates a new ec2 client on top of any EC2 API implementation
+func NewEc2ClientFromAPI(cfg *shared.Config, ec2Svc ec2iface.EC2API) *Ec2Client {
 
 	ret := &Ec2Client{
-		cfg:     cfg,
-		session: mySession,
-		ec2Svc:  ec2.New(mySession),
+		cfg:    cfg,
+		ec2Svc: ec2Svc,
 	}
 
 	return ret
@@ -66,12 +73,29 @@ func (e *Ec2Client) DescribeInstances(instanceIDList []string) ([]Ec2Instance, e
 
 		for _, instance := range reservation.Instances {
 
-			retList = append(retList, Ec2Instance{
+			ipv6Address := ""
+
+			// the first IPv6 address of the primary network interface, if any
+			for _, networkInterface := range instance.NetworkInterfaces {
+				if networkInterface.Attachment != nil && aws.Int64Value(networkInterface.Attachment.DeviceIndex) == 0 && len(networkInterface.Ipv6Addresses) > 0 {
+					ipv6Address = aws.StringValue(networkInterface.Ipv6Addresses[0].Ipv6Address)
+				}
+			}
+
+			ec2Instance := Ec2Instance{
 				InstanceID:       aws.StringValue(instance.InstanceId),
 				PrivateIPAddress: aws.StringValue(instance.PrivateIpAddress),
 				PrivateDNSName:   aws.StringValue(instance.PrivateDnsName),
 				PublicIPAddress:  aws.StringValue(instance.PublicIpAddress),
-			})
+				IPv6Address:      ipv6Address,
+				SubnetID:         aws.StringValue(instance.SubnetId),
+			}
+
+			if instance.Placement != nil {
+				ec2Instance.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+			}
+
+			retList = append(retList, ec2Instance)
 		}
 
 	}
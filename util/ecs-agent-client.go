@@ -0,0 +1,91 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EcsAgentTask a task as reported by the local ECS agent introspection API
+type EcsAgentTask struct {
+	Arn           string
+	DesiredStatus string
+	KnownStatus   string
+	Family        string
+	Version       string
+	Containers    []EcsAgentContainer
+}
+
+// EcsAgentContainer a container of an EcsAgentTask
+type EcsAgentContainer struct {
+	DockerID string `json:"DockerId"`
+	Name     string
+	Ports    []EcsAgentPort
+	Networks []EcsAgentNetwork
+}
+
+// EcsAgentPort a port binding of an EcsAgentContainer
+type EcsAgentPort struct {
+	ContainerPort int64
+	HostPort      int64
+	Protocol      string
+}
+
+// EcsAgentNetwork the awsvpc network of an EcsAgentContainer
+type EcsAgentNetwork struct {
+	NetworkMode   string
+	IPv4Addresses []string
+	IPv6Addresses []string
+}
+
+// EcsAgentClient reads the ECS agent introspection API of this host. It needs no AWS credentials.
+type EcsAgentClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewEcsAgentClient Creates a new ecs agent client
+func NewEcsAgentClient(baseURL string) *EcsAgentClient {
+
+	ret := &EcsAgentClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	return ret
+}
+
+// ListTasks returns the tasks known to the agent
+func (e *EcsAgentClient) ListTasks() ([]EcsAgentTask, error) {
+
+	resp, err := e.httpClient.Get(e.baseURL + "/v1/tasks")
+
+	if err != nil {
+		return nil, fmt.Errorf("ECS agent call failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("ECS agent call failed: %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("ECS agent call failed with code %v", resp.StatusCode)
+	}
+
+	reply := struct {
+		Tasks []EcsAgentTask
+	}{}
+
+	if err := json.Unmarshal(buf, &reply); err != nil {
+		return nil, fmt.Errorf("Invalid ECS agent reply: %v", err)
+	}
+
+	return reply.Tasks, nil
+}
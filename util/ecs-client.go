@@ -6,16 +6,39 @@ import (
 	"bitbucket.org/nnnco/rev-proxy/shared"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 )
 
-// EcsTask an ecs task cut down view
+// EcsTask an ecs task cut down view. Tasks using awsvpc have no host port but addresses of their own.
 type EcsTask struct {
-	TaskArn       string
-	HostPort      int64
-	ContainerPort int64
-	InstanceArn   string
+	TaskArn            string
+	TaskDefinitionArn  string
+	HostPort           int64
+	ContainerPort      int64
+	InstanceArn        string
+	HealthStatus       string
+	StartedBy          string
+	PrivateIPv4Address string
+	IPv6Address        string
+	AvailabilityZone   string
+	// SubnetID the subnet of the ENI of awsvpc tasks
+	SubnetID string
+}
+
+// EcsServiceInfo an ecs service cut down view
+type EcsServiceInfo struct {
+	ServiceArn  string
+	Tags        map[string]string
+	TaskSetList []EcsTaskSet
+}
+
+// EcsTaskSet an ecs task set cut down view. Scale is a percentage of the service desired count.
+type EcsTaskSet struct {
+	ID         string
+	TaskSetArn string
+	Status     string
+	Scale      float64
 }
 
 // EcsContainerInstance a ecs container instance cut down view
@@ -24,28 +47,36 @@ type EcsContainerInstance struct {
 	Ec2InstanceID           string
 }
 
+// EcsAPI the ecs operations we rely on, so that they can be faked in tests
+type EcsAPI interface {
+	ListServices(clusterName string) ([]string, error)
+	ListServiceTasks(clusterName string, serviceName string) ([]string, error)
+	DescribeTasks(clusterName string, taskArnList []string) ([]EcsTask, error)
+	DescribeTaskContainerInstances(clusterName string, taskArnList []string) ([]string, error)
+	DescribeTask(clusterName string, taskArn string) (*EcsTask, error)
+	DescribeContainerInstances(clusterName string, containerInstanceArnList []string) ([]EcsContainerInstance, error)
+	DescribeContainerInstance(clusterName string, containerInstanceArn string) (*EcsContainerInstance, error)
+	DescribeServices(clusterName string, serviceArnList []string) ([]EcsServiceInfo, error)
+	DescribeTaskDefinitionPort(taskDefinitionArn string) (int64, error)
+}
+
 // EcsClient simplified client to access ECS resources on AWS
 type EcsClient struct {
-	cfg     *shared.Config
-	session *session.Session
-	ecsSvc  *ecs.ECS
-	ec2Svc  *ec2.EC2
+	cfg    *shared.Config
+	ecsSvc ecsiface.ECSAPI
 }
 
-// NewEcsClient Creates a new ecs client
-func NewEcsClient(cfg *shared.Config) *EcsClient {
-
-	mySession := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{Region: aws.String(cfg.AWS.Region)},
-	}))
+// NewEcsClient Creates a new ecs client from a shared session
+func NewEcsClient(cfg *shared.Config, mySession *session.Session) *EcsClient {
+	return NewEcsClientFromAPI(cfg, ecs.New(mySession))
+}
 
-	// Create a EC2/ECS clients from just a session
+// NewEcsClientFromAPI Creates a new ecs client on top of any ECS API implementation
+func NewEcsClientFromAPI(cfg *shared.Config, ecsSvc ecsiface.ECSAPI) *EcsClient {
 
 	ret := &EcsClient{
-		cfg:     cfg,
-		session: mySession,
-		ecsSvc:  ecs.New(mySession),
-		ec2Svc:  ec2.New(mySession),
+		cfg:    cfg,
+		ecsSvc: ecsSvc,
 	}
 
 	return ret
@@ -149,19 +180,88 @@ func (e *EcsClient) DescribeTasks(clusterName string, taskArnList []string) ([]E
 
 		firstContainer := *task.Containers[0]
 
-		// if no network bindings in the task?
-		if len(firstContainer.NetworkBindings) < 1 {
+		ecsTask := EcsTask{
+			TaskArn:           taskArn,
+			TaskDefinitionArn: aws.StringValue(task.TaskDefinitionArn),
+			InstanceArn:       aws.StringValue(task.ContainerInstanceArn),
+			HealthStatus:      aws.StringValue(task.HealthStatus),
+			StartedBy:         aws.StringValue(task.StartedBy),
+			AvailabilityZone:  aws.StringValue(task.AvailabilityZone),
+			SubnetID:          taskSubnetID(task),
+		}
+
+		// awsvpc tasks are reached on their own ENI
+		if len(firstContainer.NetworkInterfaces) > 0 {
+			ecsTask.PrivateIPv4Address = aws.StringValue(firstContainer.NetworkInterfaces[0].PrivateIpv4Address)
+			ecsTask.IPv6Address = aws.StringValue(firstContainer.NetworkInterfaces[0].Ipv6Address)
+		}
+
+		if len(firstContainer.NetworkBindings) > 0 {
+
+			firstNetworkBinding := *firstContainer.NetworkBindings[0]
+
+			ecsTask.HostPort = aws.Int64Value(firstNetworkBinding.HostPort)
+			ecsTask.ContainerPort = aws.Int64Value(firstNetworkBinding.ContainerPort)
+
+		} else if ecsTask.PrivateIPv4Address == "" && ecsTask.IPv6Address == "" {
+
+			// if no network bindings nor interface in the task?
 			continue
 		}
 
-		firstNetworkBinding := *firstContainer.NetworkBindings[0]
+		retList = append(retList, ecsTask)
+	}
 
-		retList = append(retList, EcsTask{
-			TaskArn:       taskArn,
-			HostPort:      aws.Int64Value(firstNetworkBinding.HostPort),
-			ContainerPort: aws.Int64Value(firstNetworkBinding.ContainerPort),
-			InstanceArn:   aws.StringValue(task.ContainerInstanceArn),
-		})
+	return retList, nil
+}
+
+// taskSubnetID returns the subnet of the ENI attached to an awsvpc task
+func taskSubnetID(task *ecs.Task) string {
+
+	for _, attachment := range task.Attachments {
+
+		if aws.StringValue(attachment.Type) != "ElasticNetworkInterface" {
+			continue
+		}
+
+		for _, detail := range attachment.Details {
+			if aws.StringValue(detail.Name) == "subnetId" {
+				return aws.StringValue(detail.Value)
+			}
+		}
+	}
+
+	return ""
+}
+
+// DescribeTaskContainerInstances returns the container instance arns hosting up to 100 tasks
+func (e *EcsClient) DescribeTaskContainerInstances(clusterName string, taskArnList []string) ([]string, error) {
+
+	if len(taskArnList) > 100 {
+		return nil, fmt.Errorf("Unable to query more than 100 tasks at a time")
+	}
+
+	retList := make([]string, 0)
+
+	if len(taskArnList) == 0 {
+		return retList, nil
+	}
+
+	input := &ecs.DescribeTasksInput{
+		Cluster: &clusterName,
+		Tasks:   aws.StringSlice(taskArnList),
+	}
+
+	reply, err := e.ecsSvc.DescribeTasks(input)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, task := range reply.Tasks {
+		if task.ContainerInstanceArn != nil {
+			retList = append(retList, aws.StringValue(task.ContainerInstanceArn))
+		}
 	}
 
 	return retList, nil
@@ -231,3 +331,89 @@ func (e *EcsClient) DescribeContainerInstance(clusterName string, containerInsta
 
 	return &retList[0], nil
 }
+
+// DescribeServices describes up to 10 services with their tags and task sets
+func (e *EcsClient) DescribeServices(clusterName string, serviceArnList []string) ([]EcsServiceInfo, error) {
+
+	if len(serviceArnList) > 10 {
+		return nil, fmt.Errorf("Unable to query more than 10 services at a time")
+	}
+
+	retList := make([]EcsServiceInfo, 0)
+
+	if len(serviceArnList) == 0 {
+		return retList, nil
+	}
+
+	input := &ecs.DescribeServicesInput{
+		Cluster:  &clusterName,
+		Services: aws.StringSlice(serviceArnList),
+		Include:  aws.StringSlice([]string{ecs.ServiceFieldTags}),
+	}
+
+	reply, err := e.ecsSvc.DescribeServices(input)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// we sift through the data
+	for _, service := range reply.Services {
+
+		serviceInfo := EcsServiceInfo{
+			ServiceArn:  aws.StringValue(service.ServiceArn),
+			Tags:        make(map[string]string),
+			TaskSetList: make([]EcsTaskSet, 0),
+		}
+
+		for _, tag := range service.Tags {
+			serviceInfo.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+
+		// only services deployed by CodeDeploy or an external controller have task sets
+		for _, taskSet := range service.TaskSets {
+
+			ecsTaskSet := EcsTaskSet{
+				ID:         aws.StringValue(taskSet.Id),
+				TaskSetArn: aws.StringValue(taskSet.TaskSetArn),
+				Status:     aws.StringValue(taskSet.Status),
+			}
+
+			if taskSet.Scale != nil {
+				ecsTaskSet.Scale = aws.Float64Value(taskSet.Scale.Value)
+			}
+
+			serviceInfo.TaskSetList = append(serviceInfo.TaskSetList, ecsTaskSet)
+		}
+
+		retList = append(retList, serviceInfo)
+	}
+
+	return retList, nil
+}
+
+// DescribeTaskDefinitionPort returns the first container port of a task definition, awsvpc tasks don't report it
+func (e *EcsClient) DescribeTaskDefinitionPort(taskDefinitionArn string) (int64, error) {
+
+	input := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &taskDefinitionArn,
+	}
+
+	reply, err := e.ecsSvc.DescribeTaskDefinition(input)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if reply.TaskDefinition == nil || len(reply.TaskDefinition.ContainerDefinitions) < 1 {
+		return 0, nil
+	}
+
+	firstContainer := reply.TaskDefinition.ContainerDefinitions[0]
+
+	if len(firstContainer.PortMappings) < 1 {
+		return 0, nil
+	}
+
+	return aws.Int64Value(firstContainer.PortMappings[0].ContainerPort), nil
+}
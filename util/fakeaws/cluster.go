@@ -0,0 +1,327 @@
+// Package fakeaws is an in-memory model of an ECS cluster, its EC2 instances, S3 and Route53, implementing the
+// AWS SDK interfaces so that the real clients can run against it in tests
+package fakeaws
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// ErrCodeThrottling the error code AWS uses when rate limiting
+const ErrCodeThrottling = "ThrottlingException"
+
+// Instance a fake container instance and its EC2 instance
+type Instance struct {
+	ContainerInstanceArn string
+	InstanceID           string
+	PrivateIPAddress     string
+	PublicIPAddress      string
+	IPv6Address          string
+	AvailabilityZone     string
+	SubnetID             string
+}
+
+// Task a fake running task with a single port binding, or an ENI of its own for awsvpc tasks
+type Task struct {
+	TaskArn              string
+	TaskDefinitionArn    string
+	ServiceName          string
+	ContainerInstanceArn string
+	HostPort             int64
+	ContainerPort        int64
+	HealthStatus         string
+	StartedBy            string
+	PrivateIPv4Address   string
+	IPv6Address          string
+	// the zone and the ENI subnet of a Fargate task, the others report the ones of their instance
+	AvailabilityZone string
+	SubnetID         string
+
+	// how many DescribeTasks calls still miss the task
+	describeLag int
+}
+
+// TaskSet a fake task set of a service deployed by CodeDeploy or an external controller
+type TaskSet struct {
+	ID          string
+	TaskSetArn  string
+	ServiceName string
+	Status      string
+	Scale       float64
+}
+
+// Cluster an in-memory ECS cluster. All methods are goroutine safe.
+type Cluster struct {
+	Name string
+
+	// PageSize the page size of the List* operations
+	PageSize int
+
+	lock         sync.Mutex
+	serviceList  []string
+	serviceTags  map[string]map[string]string
+	instanceMap  map[string]*Instance
+	taskList     []*Task
+	taskSetList  []*TaskSet
+	describeLag  int
+	throttleMap  map[string]int
+	callCountMap map[string]int
+	sequence     int
+}
+
+// NewCluster Creates an empty cluster
+func NewCluster(name string) *Cluster {
+
+	ret := &Cluster{
+		Name:         name,
+		PageSize:     10,
+		serviceList:  make([]string, 0),
+		serviceTags:  make(map[string]map[string]string),
+		instanceMap:  make(map[string]*Instance),
+		taskList:     make([]*Task, 0),
+		taskSetList:  make([]*TaskSet, 0),
+		throttleMap:  make(map[string]int),
+		callCountMap: make(map[string]int),
+	}
+
+	return ret
+}
+
+// AddService adds a service and returns its arn
+func (c *Cluster) AddService(serviceName string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.serviceList = append(c.serviceList, serviceName)
+
+	return c.serviceArn(serviceName)
+}
+
+// TagService sets a tag on a service
+func (c *Cluster) TagService(serviceName string, key string, value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.serviceTags[serviceName] == nil {
+		c.serviceTags[serviceName] = make(map[string]string)
+	}
+
+	c.serviceTags[serviceName][key] = value
+}
+
+// AddInstance adds a container instance and returns it
+func (c *Cluster) AddInstance(privateIPAddress string, publicIPAddress string) *Instance {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := c.nextID()
+
+	instance := &Instance{
+		ContainerInstanceArn: fmt.Sprintf("arn:aws:ecs:ap-southeast-2:123456789012:container-instance/%v/%v", c.Name, id),
+		InstanceID:           "i-" + id,
+		PrivateIPAddress:     privateIPAddress,
+		PublicIPAddress:      publicIPAddress,
+	}
+
+	c.instanceMap[instance.ContainerInstanceArn] = instance
+
+	return instance
+}
+
+// SetInstanceZone places an instance in an availability zone and a subnet
+func (c *Cluster) SetInstanceZone(instance *Instance, availabilityZone string, subnetID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	instance.AvailabilityZone = availabilityZone
+	instance.SubnetID = subnetID
+}
+
+// AddTask starts a task of a service on an instance and returns it
+func (c *Cluster) AddTask(serviceName string, instance *Instance, hostPort int64, containerPort int64) *Task {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	task := &Task{
+		TaskArn:              fmt.Sprintf("arn:aws:ecs:ap-southeast-2:123456789012:task/%v/%v", c.Name, c.nextID()),
+		ServiceName:          serviceName,
+		ContainerInstanceArn: instance.ContainerInstanceArn,
+		HostPort:             hostPort,
+		ContainerPort:        containerPort,
+		HealthStatus:         "HEALTHY",
+		describeLag:          c.describeLag,
+	}
+
+	c.taskList = append(c.taskList, task)
+
+	return task
+}
+
+// AddAwsvpcTask starts an awsvpc task of a service on an instance and returns it. The task has no port
+// binding, its container port is only found in its task definition.
+func (c *Cluster) AddAwsvpcTask(serviceName string, instance *Instance, privateIPv4Address string, ipv6Address string, containerPort int64) *Task {
+
+	task := c.AddTask(serviceName, instance, 0, containerPort)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	task.TaskDefinitionArn = fmt.Sprintf("arn:aws:ecs:ap-southeast-2:123456789012:task-definition/%v:1", serviceName)
+	task.PrivateIPv4Address = privateIPv4Address
+	task.IPv6Address = ipv6Address
+
+	return task
+}
+
+// AddFargateTask starts an awsvpc task on no container instance, in a zone and a subnet, and returns it
+func (c *Cluster) AddFargateTask(serviceName string, privateIPv4Address string, containerPort int64, availabilityZone string, subnetID string) *Task {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	task := &Task{
+		TaskArn:            fmt.Sprintf("arn:aws:ecs:ap-southeast-2:123456789012:task/%v/%v", c.Name, c.nextID()),
+		TaskDefinitionArn:  fmt.Sprintf("arn:aws:ecs:ap-southeast-2:123456789012:task-definition/%v:1", serviceName),
+		ServiceName:        serviceName,
+		ContainerPort:      containerPort,
+		HealthStatus:       "HEALTHY",
+		PrivateIPv4Address: privateIPv4Address,
+		AvailabilityZone:   availabilityZone,
+		SubnetID:           subnetID,
+		describeLag:        c.describeLag,
+	}
+
+	c.taskList = append(c.taskList, task)
+
+	return task
+}
+
+// AddTaskSet adds a task set to a service and returns it. Scale is a percentage of the desired count.
+func (c *Cluster) AddTaskSet(serviceName string, status string, scale float64) *TaskSet {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	id := "ecs-svc/" + c.nextID()
+
+	taskSet := &TaskSet{
+		ID:          id,
+		TaskSetArn:  fmt.Sprintf("arn:aws:ecs:ap-southeast-2:123456789012:task-set/%v/%v/%v", c.Name, serviceName, id),
+		ServiceName: serviceName,
+		Status:      status,
+		Scale:       scale,
+	}
+
+	c.taskSetList = append(c.taskSetList, taskSet)
+
+	return taskSet
+}
+
+// AddTaskSetTask starts a task of a task set on an instance and returns it
+func (c *Cluster) AddTaskSetTask(taskSet *TaskSet, instance *Instance, hostPort int64, containerPort int64) *Task {
+
+	task := c.AddTask(taskSet.ServiceName, instance, hostPort, containerPort)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	task.StartedBy = taskSet.ID
+
+	return task
+}
+
+// SetTaskSetStatus changes the status of a task set, e.g. to PRIMARY when traffic is shifted
+func (c *Cluster) SetTaskSetStatus(taskSet *TaskSet, status string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	taskSet.Status = status
+}
+
+// StopTask removes a task
+func (c *Cluster) StopTask(taskArn string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for index, task := range c.taskList {
+		if task.TaskArn == taskArn {
+			c.taskList = append(c.taskList[:index], c.taskList[index+1:]...)
+			return
+		}
+	}
+}
+
+// SetDescribeLag makes the tasks added from now on visible to ListTasks but missing from the first
+// describeLag DescribeTasks calls, like ECS eventual consistency does
+func (c *Cluster) SetDescribeLag(describeLag int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.describeLag = describeLag
+}
+
+// Throttle makes the next count calls of an operation (e.g. "ListTasks") fail with a throttling error
+func (c *Cluster) Throttle(operation string, count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.throttleMap[operation] = count
+}
+
+// CallCount returns how many times an operation has been called
+func (c *Cluster) CallCount(operation string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.callCountMap[operation]
+}
+
+// call records an operation and returns the error it must fail with, if any. The lock must be held.
+func (c *Cluster) call(operation string) error {
+
+	c.callCountMap[operation]++
+
+	if c.throttleMap[operation] > 0 {
+		c.throttleMap[operation]--
+		return awserr.New(ErrCodeThrottling, "Rate exceeded", nil)
+	}
+
+	return nil
+}
+
+func (c *Cluster) serviceArn(serviceName string) string {
+	return fmt.Sprintf("arn:aws:ecs:ap-southeast-2:123456789012:service/%v/%v", c.Name, serviceName)
+}
+
+func (c *Cluster) nextID() string {
+	c.sequence++
+	return fmt.Sprintf("%08x", c.sequence)
+}
+
+// page returns a page of a list and the token of the next one
+func page(list []string, nextToken *string, pageSize int) ([]string, *string, error) {
+
+	start := 0
+
+	if nextToken != nil {
+
+		tokenStart, err := strconv.Atoi(*nextToken)
+
+		if err != nil || tokenStart > len(list) {
+			return nil, nil, awserr.New("InvalidParameterException", "Invalid nextToken", nil)
+		}
+
+		start = tokenStart
+	}
+
+	end := start + pageSize
+
+	if end >= len(list) {
+		return list[start:], nil, nil
+	}
+
+	token := strconv.Itoa(end)
+
+	return list[start:end], &token, nil
+}
@@ -0,0 +1,78 @@
+package fakeaws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// EC2 serves the instances of a fake cluster through the EC2 API. Operations we don't use panic.
+type EC2 struct {
+	ec2iface.EC2API
+	cluster *Cluster
+}
+
+// NewEC2 Creates a new fake EC2 API
+func NewEC2(cluster *Cluster) *EC2 {
+
+	ret := &EC2{
+		cluster: cluster,
+	}
+
+	return ret
+}
+
+// DescribeInstances ec2iface.EC2API
+func (e *EC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	c := e.cluster
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+
+	wantedIDs := make(map[string]bool)
+
+	for _, instanceID := range aws.StringValueSlice(input.InstanceIds) {
+		wantedIDs[instanceID] = true
+	}
+
+	reservation := &ec2.Reservation{}
+
+	for _, instance := range c.instanceMap {
+
+		if !wantedIDs[instance.InstanceID] {
+			continue
+		}
+
+		ec2Instance := &ec2.Instance{
+			InstanceId:       aws.String(instance.InstanceID),
+			PrivateIpAddress: aws.String(instance.PrivateIPAddress),
+		}
+
+		if instance.PublicIPAddress != "" {
+			ec2Instance.PublicIpAddress = aws.String(instance.PublicIPAddress)
+		}
+
+		if instance.AvailabilityZone != "" {
+			ec2Instance.Placement = &ec2.Placement{AvailabilityZone: aws.String(instance.AvailabilityZone)}
+			ec2Instance.SubnetId = aws.String(instance.SubnetID)
+		}
+
+		if instance.IPv6Address != "" {
+			ec2Instance.NetworkInterfaces = []*ec2.InstanceNetworkInterface{
+				{
+					Attachment:    &ec2.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int64(0)},
+					Ipv6Addresses: []*ec2.InstanceIpv6Address{{Ipv6Address: aws.String(instance.IPv6Address)}},
+				},
+			}
+		}
+
+		reservation.Instances = append(reservation.Instances, ec2Instance)
+	}
+
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{reservation},
+	}, nil
+}
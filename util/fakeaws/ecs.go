@@ -0,0 +1,344 @@
+package fakeaws
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// ECS serves a fake cluster through the ECS API. Operations we don't use panic.
+type ECS struct {
+	ecsiface.ECSAPI
+	cluster *Cluster
+}
+
+// NewECS Creates a new fake ECS API
+func NewECS(cluster *Cluster) *ECS {
+
+	ret := &ECS{
+		cluster: cluster,
+	}
+
+	return ret
+}
+
+// ListServices ecsiface.ECSAPI
+func (e *ECS) ListServices(input *ecs.ListServicesInput) (*ecs.ListServicesOutput, error) {
+	c := e.cluster
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := e.checkCluster("ListServices", input.Cluster); err != nil {
+		return nil, err
+	}
+
+	arnList := make([]string, 0)
+
+	for _, serviceName := range c.serviceList {
+		arnList = append(arnList, c.serviceArn(serviceName))
+	}
+
+	pageList, nextToken, err := page(arnList, input.NextToken, c.PageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecs.ListServicesOutput{
+		ServiceArns: aws.StringSlice(pageList),
+		NextToken:   nextToken,
+	}, nil
+}
+
+// ListTasks ecsiface.ECSAPI
+func (e *ECS) ListTasks(input *ecs.ListTasksInput) (*ecs.ListTasksOutput, error) {
+	c := e.cluster
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := e.checkCluster("ListTasks", input.Cluster); err != nil {
+		return nil, err
+	}
+
+	// services can be referenced by name or arn
+	serviceNameList := strings.Split(aws.StringValue(input.ServiceName), "/")
+	serviceName := serviceNameList[len(serviceNameList)-1]
+
+	arnList := make([]string, 0)
+
+	for _, task := range c.taskList {
+		if serviceName == "" || task.ServiceName == serviceName {
+			arnList = append(arnList, task.TaskArn)
+		}
+	}
+
+	pageList, nextToken, err := page(arnList, input.NextToken, c.PageSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecs.ListTasksOutput{
+		TaskArns:  aws.StringSlice(pageList),
+		NextToken: nextToken,
+	}, nil
+}
+
+// DescribeTasks ecsiface.ECSAPI
+func (e *ECS) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	c := e.cluster
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := e.checkCluster("DescribeTasks", input.Cluster); err != nil {
+		return nil, err
+	}
+
+	if len(input.Tasks) > 100 {
+		return nil, awserr.New("InvalidParameterException", "Too many tasks", nil)
+	}
+
+	ret := &ecs.DescribeTasksOutput{}
+
+	for _, taskArn := range aws.StringValueSlice(input.Tasks) {
+
+		task := c.findTask(taskArn)
+
+		if task == nil || task.describeLag > 0 {
+
+			if task != nil {
+				task.describeLag--
+			}
+
+			ret.Failures = append(ret.Failures, &ecs.Failure{Arn: aws.String(taskArn), Reason: aws.String("MISSING")})
+			continue
+		}
+
+		container := &ecs.Container{
+			HealthStatus: aws.String(task.HealthStatus),
+		}
+
+		// like ECS, awsvpc tasks report their ENI and no binding
+		if task.PrivateIPv4Address != "" || task.IPv6Address != "" {
+			networkInterface := &ecs.NetworkInterface{}
+
+			if task.PrivateIPv4Address != "" {
+				networkInterface.PrivateIpv4Address = aws.String(task.PrivateIPv4Address)
+			}
+
+			if task.IPv6Address != "" {
+				networkInterface.Ipv6Address = aws.String(task.IPv6Address)
+			}
+
+			container.NetworkInterfaces = []*ecs.NetworkInterface{networkInterface}
+		} else {
+			container.NetworkBindings = []*ecs.NetworkBinding{
+				{
+					HostPort:      aws.Int64(task.HostPort),
+					ContainerPort: aws.Int64(task.ContainerPort),
+				},
+			}
+		}
+
+		availabilityZone, subnetID := task.AvailabilityZone, task.SubnetID
+
+		if instance, found := c.instanceMap[task.ContainerInstanceArn]; found {
+			availabilityZone, subnetID = instance.AvailabilityZone, instance.SubnetID
+		}
+
+		ecsTask := &ecs.Task{
+			TaskArn:              aws.String(task.TaskArn),
+			TaskDefinitionArn:    aws.String(task.TaskDefinitionArn),
+			ClusterArn:           aws.String(c.Name),
+			ContainerInstanceArn: aws.String(task.ContainerInstanceArn),
+			HealthStatus:         aws.String(task.HealthStatus),
+			LastStatus:           aws.String("RUNNING"),
+			StartedBy:            aws.String(task.StartedBy),
+			Containers:           []*ecs.Container{container},
+		}
+
+		if availabilityZone != "" {
+			ecsTask.AvailabilityZone = aws.String(availabilityZone)
+		}
+
+		// like ECS, the ENI of awsvpc tasks is attached in a subnet
+		if container.NetworkInterfaces != nil && subnetID != "" {
+			ecsTask.Attachments = []*ecs.Attachment{{
+				Type:    aws.String("ElasticNetworkInterface"),
+				Details: []*ecs.KeyValuePair{{Name: aws.String("subnetId"), Value: aws.String(subnetID)}},
+			}}
+		}
+
+		ret.Tasks = append(ret.Tasks, ecsTask)
+	}
+
+	return ret, nil
+}
+
+// DescribeContainerInstances ecsiface.ECSAPI
+func (e *ECS) DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error) {
+	c := e.cluster
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := e.checkCluster("DescribeContainerInstances", input.Cluster); err != nil {
+		return nil, err
+	}
+
+	ret := &ecs.DescribeContainerInstancesOutput{}
+
+	for _, arn := range aws.StringValueSlice(input.ContainerInstances) {
+
+		instance, found := c.instanceMap[arn]
+
+		if !found {
+			ret.Failures = append(ret.Failures, &ecs.Failure{Arn: aws.String(arn), Reason: aws.String("MISSING")})
+			continue
+		}
+
+		ret.ContainerInstances = append(ret.ContainerInstances, &ecs.ContainerInstance{
+			ContainerInstanceArn: aws.String(instance.ContainerInstanceArn),
+			Ec2InstanceId:        aws.String(instance.InstanceID),
+			Status:               aws.String("ACTIVE"),
+		})
+	}
+
+	return ret, nil
+}
+
+// DescribeServices ecsiface.ECSAPI
+func (e *ECS) DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+	c := e.cluster
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := e.checkCluster("DescribeServices", input.Cluster); err != nil {
+		return nil, err
+	}
+
+	if len(input.Services) > 10 {
+		return nil, awserr.New("InvalidParameterException", "Too many services", nil)
+	}
+
+	includeTags := false
+
+	for _, field := range aws.StringValueSlice(input.Include) {
+		includeTags = includeTags || field == ecs.ServiceFieldTags
+	}
+
+	ret := &ecs.DescribeServicesOutput{}
+
+	for _, service := range aws.StringValueSlice(input.Services) {
+
+		// services can be referenced by name or arn
+		serviceNameList := strings.Split(service, "/")
+		serviceName := serviceNameList[len(serviceNameList)-1]
+
+		found := false
+
+		for _, name := range c.serviceList {
+			found = found || name == serviceName
+		}
+
+		if !found {
+			ret.Failures = append(ret.Failures, &ecs.Failure{Arn: aws.String(service), Reason: aws.String("MISSING")})
+			continue
+		}
+
+		ecsService := &ecs.Service{
+			ServiceArn:  aws.String(c.serviceArn(serviceName)),
+			ServiceName: aws.String(serviceName),
+			Status:      aws.String("ACTIVE"),
+		}
+
+		if includeTags {
+			for key, value := range c.serviceTags[serviceName] {
+				ecsService.Tags = append(ecsService.Tags, &ecs.Tag{Key: aws.String(key), Value: aws.String(value)})
+			}
+		}
+
+		for _, taskSet := range c.taskSetList {
+
+			if taskSet.ServiceName != serviceName {
+				continue
+			}
+
+			ecsService.TaskSets = append(ecsService.TaskSets, &ecs.TaskSet{
+				Id:         aws.String(taskSet.ID),
+				TaskSetArn: aws.String(taskSet.TaskSetArn),
+				Status:     aws.String(taskSet.Status),
+				Scale:      &ecs.Scale{Unit: aws.String(ecs.ScaleUnitPercent), Value: aws.Float64(taskSet.Scale)},
+			})
+		}
+
+		if len(ecsService.TaskSets) > 0 {
+			ecsService.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+		}
+
+		ret.Services = append(ret.Services, ecsService)
+	}
+
+	return ret, nil
+}
+
+// DescribeTaskDefinition ecsiface.ECSAPI, the container port of the first task using the definition
+func (e *ECS) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	c := e.cluster
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.call("DescribeTaskDefinition"); err != nil {
+		return nil, err
+	}
+
+	taskDefinitionArn := aws.StringValue(input.TaskDefinition)
+
+	for _, task := range c.taskList {
+
+		if task.TaskDefinitionArn != taskDefinitionArn {
+			continue
+		}
+
+		return &ecs.DescribeTaskDefinitionOutput{
+			TaskDefinition: &ecs.TaskDefinition{
+				TaskDefinitionArn: aws.String(taskDefinitionArn),
+				NetworkMode:       aws.String(ecs.NetworkModeAwsvpc),
+				ContainerDefinitions: []*ecs.ContainerDefinition{
+					{
+						PortMappings: []*ecs.PortMapping{{ContainerPort: aws.Int64(task.ContainerPort)}},
+					},
+				},
+			},
+		}, nil
+	}
+
+	return nil, awserr.New(ecs.ErrCodeClientException, "Unable to describe task definition.", nil)
+}
+
+// checkCluster records the call and fails for throttling or an unknown cluster. The lock must be held.
+func (e *ECS) checkCluster(operation string, clusterName *string) error {
+
+	if err := e.cluster.call(operation); err != nil {
+		return err
+	}
+
+	if aws.StringValue(clusterName) != e.cluster.Name {
+		return awserr.New(ecs.ErrCodeClusterNotFoundException, "Cluster not found.", nil)
+	}
+
+	return nil
+}
+
+func (c *Cluster) findTask(taskArn string) *Task {
+
+	for _, task := range c.taskList {
+		if task.TaskArn == taskArn {
+			return task
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package fakeaws
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// Route53 an in-memory Route53 holding the record sets of any zone, and health checks. Operations we don't use panic.
+type Route53 struct {
+	route53iface.Route53API
+
+	// PageSize the page size of the List* operations
+	PageSize int
+
+	lock           sync.Mutex
+	recordSetMap   map[string][]*route53.ResourceRecordSet
+	healthCheckMap map[string]*route53.HealthCheck
+	changeCount    int
+	sequence       int
+}
+
+// NewRoute53 Creates a new empty fake Route53 API
+func NewRoute53() *Route53 {
+
+	ret := &Route53{
+		PageSize:       100,
+		recordSetMap:   make(map[string][]*route53.ResourceRecordSet),
+		healthCheckMap: make(map[string]*route53.HealthCheck),
+	}
+
+	return ret
+}
+
+// RecordSets returns the record sets of a zone, sorted by name, type and set identifier
+func (r *Route53) RecordSets(zoneID string) []*route53.ResourceRecordSet {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]*route53.ResourceRecordSet{}, r.recordSetMap[zoneID]...)
+}
+
+// HealthCheckIDs returns the ids of the existing health checks, sorted
+func (r *Route53) HealthCheckIDs() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	retList := make([]string, 0, len(r.healthCheckMap))
+
+	for healthCheckID := range r.healthCheckMap {
+		retList = append(retList, healthCheckID)
+	}
+
+	sort.Strings(retList)
+
+	return retList
+}
+
+// ChangeCount returns how many ChangeResourceRecordSets calls succeeded
+func (r *Route53) ChangeCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.changeCount
+}
+
+// ListResourceRecordSets route53iface.Route53API
+func (r *Route53) ListResourceRecordSets(input *route53.ListResourceRecordSetsInput) (*route53.ListResourceRecordSetsOutput, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	startKey := recordSetKey(aws.StringValue(input.StartRecordName), aws.StringValue(input.StartRecordType), aws.StringValue(input.StartRecordIdentifier))
+
+	ret := &route53.ListResourceRecordSetsOutput{
+		ResourceRecordSets: make([]*route53.ResourceRecordSet, 0),
+		IsTruncated:        aws.Bool(false),
+	}
+
+	for _, recordSet := range r.recordSetMap[aws.StringValue(input.HostedZoneId)] {
+
+		if recordSetKey(aws.StringValue(recordSet.Name), aws.StringValue(recordSet.Type), aws.StringValue(recordSet.SetIdentifier)) < startKey {
+			continue
+		}
+
+		if len(ret.ResourceRecordSets) == r.PageSize {
+			ret.IsTruncated = aws.Bool(true)
+			ret.NextRecordName = recordSet.Name
+			ret.NextRecordType = recordSet.Type
+			ret.NextRecordIdentifier = recordSet.SetIdentifier
+			break
+		}
+
+		ret.ResourceRecordSets = append(ret.ResourceRecordSets, recordSet)
+	}
+
+	return ret, nil
+}
+
+// ChangeResourceRecordSets route53iface.Route53API. The batch is applied as a whole or not at all, deletes must
+// match the existing record set exactly, and a name can't mix simple and set identifier record sets.
+func (r *Route53) ChangeResourceRecordSets(input *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	zoneID := aws.StringValue(input.HostedZoneId)
+	recordSetList := append([]*route53.ResourceRecordSet{}, r.recordSetMap[zoneID]...)
+
+	for _, change := range input.ChangeBatch.Changes {
+
+		recordSet := change.ResourceRecordSet
+		key := recordSetKey(aws.StringValue(recordSet.Name), aws.StringValue(recordSet.Type), aws.StringValue(recordSet.SetIdentifier))
+		index := -1
+
+		for i, existing := range recordSetList {
+			if recordSetKey(aws.StringValue(existing.Name), aws.StringValue(existing.Type), aws.StringValue(existing.SetIdentifier)) == key {
+				index = i
+			}
+		}
+
+		if recordSet.HealthCheckId != nil && r.healthCheckMap[aws.StringValue(recordSet.HealthCheckId)] == nil {
+			return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, fmt.Sprintf("Unknown health check %v", aws.StringValue(recordSet.HealthCheckId)), nil)
+		}
+
+		switch aws.StringValue(change.Action) {
+		case route53.ChangeActionDelete:
+
+			if index < 0 || !reflect.DeepEqual(recordSetList[index], recordSet) {
+				return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, fmt.Sprintf("No record set matching %v", key), nil)
+			}
+
+			recordSetList = append(recordSetList[:index], recordSetList[index+1:]...)
+
+		case route53.ChangeActionUpsert:
+
+			if index < 0 {
+				recordSetList = append(recordSetList, recordSet)
+			} else {
+				recordSetList[index] = recordSet
+			}
+
+		default:
+			return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, fmt.Sprintf("Unsupported action %v", aws.StringValue(change.Action)), nil)
+		}
+	}
+
+	// name and type -> whether the record sets have set identifiers
+	routedMap := make(map[string]bool)
+
+	for _, recordSet := range recordSetList {
+
+		key := recordSetKey(aws.StringValue(recordSet.Name), aws.StringValue(recordSet.Type), "")
+		routed, found := routedMap[key]
+
+		if found && (!routed || recordSet.SetIdentifier == nil) {
+			return nil, awserr.New(route53.ErrCodeInvalidChangeBatch, fmt.Sprintf("%v mixes routing policies", key), nil)
+		}
+
+		routedMap[key] = recordSet.SetIdentifier != nil
+	}
+
+	sort.Slice(recordSetList, func(i, j int) bool {
+		return recordSetKey(aws.StringValue(recordSetList[i].Name), aws.StringValue(recordSetList[i].Type), aws.StringValue(recordSetList[i].SetIdentifier)) <
+			recordSetKey(aws.StringValue(recordSetList[j].Name), aws.StringValue(recordSetList[j].Type), aws.StringValue(recordSetList[j].SetIdentifier))
+	})
+
+	r.recordSetMap[zoneID] = recordSetList
+	r.changeCount++
+
+	return &route53.ChangeResourceRecordSetsOutput{}, nil
+}
+
+// ListHealthChecks route53iface.Route53API
+func (r *Route53) ListHealthChecks(input *route53.ListHealthChecksInput) (*route53.ListHealthChecksOutput, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	idList := make([]string, 0, len(r.healthCheckMap))
+
+	for healthCheckID := range r.healthCheckMap {
+		if healthCheckID >= aws.StringValue(input.Marker) {
+			idList = append(idList, healthCheckID)
+		}
+	}
+
+	sort.Strings(idList)
+
+	ret := &route53.ListHealthChecksOutput{
+		HealthChecks: make([]*route53.HealthCheck, 0),
+		IsTruncated:  aws.Bool(false),
+	}
+
+	for _, healthCheckID := range idList {
+
+		if len(ret.HealthChecks) == r.PageSize {
+			ret.IsTruncated = aws.Bool(true)
+			ret.NextMarker = aws.String(healthCheckID)
+			break
+		}
+
+		ret.HealthChecks = append(ret.HealthChecks, r.healthCheckMap[healthCheckID])
+	}
+
+	return ret, nil
+}
+
+// CreateHealthCheck route53iface.Route53API
+func (r *Route53) CreateHealthCheck(input *route53.CreateHealthCheckInput) (*route53.CreateHealthCheckOutput, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.sequence++
+
+	healthCheck := &route53.HealthCheck{
+		Id:                aws.String(fmt.Sprintf("hc-%04d", r.sequence)),
+		CallerReference:   input.CallerReference,
+		HealthCheckConfig: input.HealthCheckConfig,
+	}
+
+	r.healthCheckMap[*healthCheck.Id] = healthCheck
+
+	return &route53.CreateHealthCheckOutput{HealthCheck: healthCheck}, nil
+}
+
+// AddHealthCheck adds a health check created by someone else, and returns its id
+func (r *Route53) AddHealthCheck(callerReference string, ipAddress string, port int64, path string) string {
+
+	reply, _ := r.CreateHealthCheck(&route53.CreateHealthCheckInput{
+		CallerReference: aws.String(callerReference),
+		HealthCheckConfig: &route53.HealthCheckConfig{
+			Type:         aws.String(route53.HealthCheckTypeHttp),
+			IPAddress:    aws.String(ipAddress),
+			Port:         aws.Int64(port),
+			ResourcePath: aws.String(path),
+		},
+	})
+
+	return aws.StringValue(reply.HealthCheck.Id)
+}
+
+// DeleteHealthCheck route53iface.Route53API, failing while a record set references the health check
+func (r *Route53) DeleteHealthCheck(input *route53.DeleteHealthCheckInput) (*route53.DeleteHealthCheckOutput, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	healthCheckID := aws.StringValue(input.HealthCheckId)
+
+	if r.healthCheckMap[healthCheckID] == nil {
+		return nil, awserr.New(route53.ErrCodeNoSuchHealthCheck, fmt.Sprintf("No health check %v", healthCheckID), nil)
+	}
+
+	for _, recordSetList := range r.recordSetMap {
+		for _, recordSet := range recordSetList {
+			if aws.StringValue(recordSet.HealthCheckId) == healthCheckID {
+				return nil, awserr.New(route53.ErrCodeHealthCheckInUse, fmt.Sprintf("Health check %v is in use", healthCheckID), nil)
+			}
+		}
+	}
+
+	delete(r.healthCheckMap, healthCheckID)
+
+	return &route53.DeleteHealthCheckOutput{}, nil
+}
+
+// recordSetKey sorts like Route53 lists, by name then type then set identifier
+func recordSetKey(name string, recordType string, setIdentifier string) string {
+	return name + "\x00" + recordType + "\x00" + setIdentifier
+}
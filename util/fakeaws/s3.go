@@ -0,0 +1,212 @@
+package fakeaws
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// objectVersion a version of a fake s3 object
+type objectVersion struct {
+	versionID    string
+	data         []byte
+	lastModified time.Time
+}
+
+// S3 an in-memory versioned S3. Operations we don't use panic.
+type S3 struct {
+	s3iface.S3API
+
+	lock       sync.Mutex
+	objectMap  map[string][]objectVersion
+	throttle   map[string]int
+	callCount  map[string]int
+	versionSeq int
+}
+
+// NewS3 Creates a new empty fake S3 API
+func NewS3() *S3 {
+
+	ret := &S3{
+		objectMap: make(map[string][]objectVersion),
+		throttle:  make(map[string]int),
+		callCount: make(map[string]int),
+	}
+
+	return ret
+}
+
+// Put stores a new version of an object and returns its version id
+func (s *S3) Put(bucket string, key string, data []byte) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.versionSeq++
+
+	version := objectVersion{
+		versionID:    fmt.Sprintf("v%v", s.versionSeq),
+		data:         append([]byte{}, data...),
+		lastModified: time.Now(),
+	}
+
+	objectKey := bucket + "/" + key
+	s.objectMap[objectKey] = append(s.objectMap[objectKey], version)
+
+	return version.versionID
+}
+
+// Get returns the latest version of an object, nil if missing
+func (s *S3) Get(bucket string, key string) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	versionList := s.objectMap[bucket+"/"+key]
+
+	if len(versionList) == 0 {
+		return nil
+	}
+
+	return versionList[len(versionList)-1].data
+}
+
+// Throttle makes the next count calls of an operation (e.g. "GetObject") fail with a throttling error
+func (s *S3) Throttle(operation string, count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.throttle[operation] = count
+}
+
+// Calls returns how many times an operation (e.g. "GetObject") was called
+func (s *S3) Calls(operation string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.callCount[operation]
+}
+
+// GetObject s3iface.S3API
+func (s *S3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return s.GetObjectWithContext(aws.BackgroundContext(), input)
+}
+
+// GetObjectWithContext s3iface.S3API, used by the s3manager downloader
+func (s *S3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.call("GetObject"); err != nil {
+		return nil, err
+	}
+
+	versionList := s.objectMap[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+
+	if len(versionList) == 0 {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	version := versionList[len(versionList)-1]
+
+	if input.VersionId != nil {
+
+		found := false
+
+		for _, candidate := range versionList {
+			if candidate.versionID == *input.VersionId {
+				version = candidate
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, awserr.New("NoSuchVersion", "The specified version does not exist.", nil)
+		}
+	}
+
+	data := version.data
+	ret := &s3.GetObjectOutput{
+		VersionId:    aws.String(version.versionID),
+		ETag:         aws.String(fmt.Sprintf("\"%x\"", md5.Sum(version.data))),
+		LastModified: aws.Time(version.lastModified),
+	}
+
+	// the downloader asks for ranges
+	if input.Range != nil {
+
+		var start, end int64
+
+		if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, awserr.New("InvalidRange", err.Error(), nil)
+		}
+
+		if end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+
+		ret.ContentRange = aws.String(fmt.Sprintf("bytes %v-%v/%v", start, end, len(data)))
+		data = data[start : end+1]
+	}
+
+	ret.ContentLength = aws.Int64(int64(len(data)))
+	ret.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	return ret, nil
+}
+
+// PutObject s3iface.S3API
+func (s *S3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+
+	s.lock.Lock()
+	err := s.call("PutObject")
+	s.lock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(input.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	versionID := s.Put(aws.StringValue(input.Bucket), aws.StringValue(input.Key), data)
+
+	return &s3.PutObjectOutput{VersionId: aws.String(versionID)}, nil
+}
+
+// DeleteObject s3iface.S3API. Unlike a versioned bucket, the versions go with the object.
+func (s *S3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.call("DeleteObject"); err != nil {
+		return nil, err
+	}
+
+	delete(s.objectMap, aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key))
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// call returns the error an operation must fail with, if any. The lock must be held.
+func (s *S3) call(operation string) error {
+
+	s.callCount[operation]++
+
+	if s.throttle[operation] > 0 {
+		s.throttle[operation]--
+		return awserr.New(ErrCodeThrottling, "Rate exceeded", nil)
+	}
+
+	return nil
+}
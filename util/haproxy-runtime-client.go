@@ -0,0 +1,228 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAProxyServerSlot a server line of a backend, as listed by "show servers state". Slots named b<n> are backups.
+type HAProxyServerSlot struct {
+	Name    string
+	Address string
+	Port    int64
+}
+
+// HAProxyRuntimeClient moves the servers of the backends through the HAProxy Runtime API. Servers can't be added at
+// runtime: the backends are rendered with spare slots, which take the new servers.
+type HAProxyRuntimeClient struct {
+	socket  string
+	timeout time.Duration
+}
+
+// NewHAProxyRuntimeClient Creates a new runtime client, for a unix socket path or a host:port
+func NewHAProxyRuntimeClient(socket string) *HAProxyRuntimeClient {
+
+	ret := &HAProxyRuntimeClient{
+		socket:  socket,
+		timeout: 10 * time.Second,
+	}
+
+	return ret
+}
+
+// UpdateUpstreams assigns the servers of every backend to its slots, failing when a backend runs out of slots
+func (h *HAProxyRuntimeClient) UpdateUpstreams(upstreamMap map[string][]UpstreamServer) error {
+
+	commandMap := make(map[string][]string)
+
+	// we check that every backend has room before changing anything
+	for backendName, serverList := range upstreamMap {
+
+		slotList, err := h.ServerSlots(backendName)
+
+		if err != nil {
+			return err
+		}
+
+		if commandMap[backendName], err = assignSlots(backendName, slotList, haproxyServers(serverList)); err != nil {
+			return err
+		}
+	}
+
+	for _, commandList := range commandMap {
+		for _, command := range commandList {
+			if err := h.execute(command); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ServerSlots returns the server slots of a backend
+func (h *HAProxyRuntimeClient) ServerSlots(backendName string) ([]HAProxyServerSlot, error) {
+
+	reply, err := h.command("show servers state " + backendName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	slotList := make([]HAProxyServerSlot, 0)
+
+	for _, line := range strings.Split(reply, "\n") {
+
+		// be_id be_name srv_id srv_name srv_addr ... srv_port is the 19th field
+		fieldList := strings.Fields(line)
+
+		if len(fieldList) < 19 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		port, err := strconv.ParseInt(fieldList[18], 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid server state line '%v': %v", line, err)
+		}
+
+		slotList = append(slotList, HAProxyServerSlot{
+			Name:    fieldList[3],
+			Address: fieldList[4],
+			Port:    port,
+		})
+	}
+
+	if len(slotList) == 0 {
+		return nil, fmt.Errorf("No server slots in backend '%v': %v", backendName, strings.TrimSpace(reply))
+	}
+
+	return slotList, nil
+}
+
+// assignSlots returns the commands moving the servers into the slots. Servers stay in the slot they already have.
+func assignSlots(backendName string, slotList []HAProxyServerSlot, serverList []UpstreamServer) ([]string, error) {
+
+	assignedMap := make(map[string]UpstreamServer)
+	pendingList := make([]UpstreamServer, 0)
+
+	for _, server := range serverList {
+
+		found := false
+
+		for _, slot := range slotList {
+			if _, taken := assignedMap[slot.Name]; !taken && isBackupSlot(slot) == server.Backup && slot.Address == server.Address && slot.Port == server.Port {
+				assignedMap[slot.Name] = server
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			pendingList = append(pendingList, server)
+		}
+	}
+
+	for _, server := range pendingList {
+
+		found := false
+
+		for _, slot := range slotList {
+			if _, taken := assignedMap[slot.Name]; !taken && isBackupSlot(slot) == server.Backup {
+				assignedMap[slot.Name] = server
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("No free server slot left in backend '%v' for %v", backendName, server.Server)
+		}
+	}
+
+	commandList := make([]string, 0)
+
+	for _, slot := range slotList {
+
+		prefix := fmt.Sprintf("set server %v/%v", backendName, slot.Name)
+		server, assigned := assignedMap[slot.Name]
+
+		if !assigned {
+			commandList = append(commandList, prefix+" state maint")
+			continue
+		}
+
+		if slot.Address != server.Address || slot.Port != server.Port {
+			commandList = append(commandList, fmt.Sprintf("%v addr %v port %v", prefix, server.Address, server.Port))
+		}
+
+		commandList = append(commandList, fmt.Sprintf("%v weight %v", prefix, upstreamWeight(server)))
+
+		if server.Down {
+			commandList = append(commandList, prefix+" state maint")
+		} else {
+			commandList = append(commandList, prefix+" state ready")
+		}
+	}
+
+	return commandList, nil
+}
+
+func isBackupSlot(slot HAProxyServerSlot) bool {
+	return strings.HasPrefix(slot.Name, "b")
+}
+
+// execute runs a command changing the state, HAProxy answers nothing or a notice on success
+func (h *HAProxyRuntimeClient) execute(command string) error {
+
+	reply, err := h.command(command)
+
+	if err != nil {
+		return err
+	}
+
+	for _, failure := range []string{"No such", "Unknown", "Require", "Invalid", "failed"} {
+		if strings.Contains(reply, failure) {
+			return fmt.Errorf("HAProxy command '%v' failed: %v", command, strings.TrimSpace(reply))
+		}
+	}
+
+	return nil
+}
+
+// command sends a command over a new connection and returns the reply
+func (h *HAProxyRuntimeClient) command(command string) (string, error) {
+
+	network := "unix"
+
+	if !strings.HasPrefix(h.socket, "/") {
+		network = "tcp"
+	}
+
+	conn, err := net.DialTimeout(network, h.socket, h.timeout)
+
+	if err != nil {
+		return "", fmt.Errorf("Unable to reach the HAProxy runtime API: %v", err)
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(h.timeout))
+
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return "", fmt.Errorf("HAProxy command '%v' failed: %v", command, err)
+	}
+
+	// HAProxy closes the connection after answering a single command
+	reply, err := ioutil.ReadAll(conn)
+
+	if err != nil {
+		return "", fmt.Errorf("HAProxy command '%v' failed: %v", command, err)
+	}
+
+	return string(reply), nil
+}
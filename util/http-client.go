@@ -1,10 +1,13 @@
 package util
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // HTTPDownloadFile downloads a file via HTTP with an optional header specified
@@ -48,6 +51,32 @@ func HTTPDownloadFile(url string, header string) ([]byte, error) {
 	return buf, nil
 }
 
+// HTTPPostJSON posts a JSON payload and fails on any non 2xx reply
+func HTTPPostJSON(url string, payload interface{}) error {
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return fmt.Errorf("Invalid payload: %v", err)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return fmt.Errorf("Http Call failed %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Http Call failed with code %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
 // ParseHeader exported
 func ParseHeader(header string) ([]string, error) {
 
@@ -0,0 +1,32 @@
+package util
+
+import (
+	"fmt"
+
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// instanceMetadataEndpoint the instance metadata service, used when AWS.Endpoint points the APIs elsewhere
+const instanceMetadataEndpoint = "http://169.254.169.254"
+
+// LocalAvailabilityZone returns the availability zone of the instance we run on, from the instance metadata
+func LocalAvailabilityZone(cfg *shared.Config, mySession *session.Session) (string, error) {
+
+	metadataConfig := &aws.Config{}
+
+	// the custom endpoint would otherwise apply to the metadata too
+	if cfg.AWS.Endpoint != "" {
+		metadataConfig.Endpoint = aws.String(instanceMetadataEndpoint)
+	}
+
+	availabilityZone, err := ec2metadata.New(mySession, metadataConfig).GetMetadata("placement/availability-zone")
+
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the availability zone from the instance metadata: %v", err)
+	}
+
+	return availabilityZone, nil
+}
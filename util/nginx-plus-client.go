@@ -0,0 +1,178 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// NginxPlusServer a server as listed by the nginx Plus API
+type NginxPlusServer struct {
+	ID     int64  `json:"id,omitempty"`
+	Server string `json:"server"`
+	Weight int64  `json:"weight,omitempty"`
+	Backup bool   `json:"backup"`
+	Down   bool   `json:"down"`
+}
+
+// NginxPlusClient updates the upstreams through the nginx Plus API, e.g. http://127.0.0.1:8080/api/9.
+// The upstreams need a zone directive.
+type NginxPlusClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewNginxPlusClient Creates a new nginx plus client
+func NewNginxPlusClient(baseURL string) *NginxPlusClient {
+
+	ret := &NginxPlusClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	return ret
+}
+
+// UpdateUpstreams brings the servers of every upstream in line, adding the new servers before removing the old ones
+func (n *NginxPlusClient) UpdateUpstreams(upstreamMap map[string][]UpstreamServer) error {
+
+	for upstreamName, serverList := range upstreamMap {
+		if err := n.updateUpstream(upstreamName, serverList); err != nil {
+			return fmt.Errorf("Unable to update upstream '%v': %v", upstreamName, err)
+		}
+	}
+
+	return nil
+}
+
+func (n *NginxPlusClient) updateUpstream(upstreamName string, serverList []UpstreamServer) error {
+
+	serversURL := fmt.Sprintf("%v/http/upstreams/%v/servers", n.baseURL, url.PathEscape(upstreamName))
+
+	currentList := make([]NginxPlusServer, 0)
+
+	if err := n.call("GET", serversURL, nil, &currentList); err != nil {
+		return err
+	}
+
+	currentMap := make(map[string]NginxPlusServer)
+
+	for _, current := range currentList {
+		currentMap[current.Server] = current
+	}
+
+	desiredMap := make(map[string]bool)
+
+	for _, server := range serverList {
+
+		desiredMap[server.Server] = true
+
+		desired := NginxPlusServer{
+			Server: server.Server,
+			Weight: upstreamWeight(server),
+			Backup: server.Backup,
+			Down:   server.Down,
+		}
+
+		current, found := currentMap[server.Server]
+
+		// backup can't be patched
+		if found && current.Backup != desired.Backup {
+
+			if err := n.call("DELETE", fmt.Sprintf("%v/%v", serversURL, current.ID), nil, nil); err != nil {
+				return err
+			}
+
+			found = false
+		}
+
+		if !found {
+
+			if err := n.call("POST", serversURL, desired, nil); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if current.Weight != desired.Weight || current.Down != desired.Down {
+
+			patch := map[string]interface{}{"weight": desired.Weight, "down": desired.Down}
+
+			if err := n.call("PATCH", fmt.Sprintf("%v/%v", serversURL, current.ID), patch, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, current := range currentList {
+
+		if desiredMap[current.Server] {
+			continue
+		}
+
+		if err := n.call("DELETE", fmt.Sprintf("%v/%v", serversURL, current.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// call sends a JSON request and decodes the JSON reply into reply, if not nil
+func (n *NginxPlusClient) call(method string, callURL string, payload interface{}, reply interface{}) error {
+
+	var body []byte
+
+	if payload != nil {
+
+		var err error
+
+		if body, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("Invalid payload: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest(method, callURL, bytes.NewReader(body))
+
+	if err != nil {
+		return fmt.Errorf("Invalid URL: %v", err)
+	}
+
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := n.httpClient.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("nginx API call failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return fmt.Errorf("nginx API call failed: %v", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("nginx API %v %v failed with code %v: %v", method, callURL, resp.StatusCode, string(buf))
+	}
+
+	if reply == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(buf, reply); err != nil {
+		return fmt.Errorf("Invalid nginx API reply: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package util
+
+import (
+	"bitbucket.org/nnnco/rev-proxy/shared"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// Route53Record a route53 resource record set cut down view
+type Route53Record struct {
+	Name          string
+	Type          string
+	TTL           int64
+	SetIdentifier string
+	Weight        int64
+	MultiValue    bool
+	HealthCheckID string
+	Values        []string
+}
+
+// Route53HealthCheck a route53 health check cut down view
+type Route53HealthCheck struct {
+	HealthCheckID   string
+	CallerReference string
+	IPAddress       string
+	Port            int64
+	Path            string
+}
+
+// Route53API the route53 operations we rely on, so that they can be faked in tests
+type Route53API interface {
+	ListRecords(zoneID string, name string, recordType string) ([]Route53Record, error)
+	ChangeRecords(zoneID string, upsertList []Route53Record, deleteList []Route53Record) error
+	ListHealthChecks() ([]Route53HealthCheck, error)
+	CreateHealthCheck(callerReference string, ipAddress string, port int64, path string) (string, error)
+	DeleteHealthCheck(healthCheckID string) error
+}
+
+// Route53Client simplified client to access Route53 resources on AWS
+type Route53Client struct {
+	cfg        *shared.Config
+	route53Svc route53iface.Route53API
+}
+
+// NewRoute53Client Creates a new route53 client from a shared session
+func NewRoute53Client(cfg *shared.Config, mySession *session.Session) *Route53Client {
+	return NewRoute53ClientFromAPI(cfg, route53.New(mySession))
+}
+
+// NewRoute53ClientFromAPI Creates a new route53 client on top of any Route53 API implementation
+func NewRoute53ClientFromAPI(cfg *shared.Config, route53Svc route53iface.Route53API) *Route53Client {
+
+	ret := &Route53Client{
+		cfg:        cfg,
+		route53Svc: route53Svc,
+	}
+
+	return ret
+}
+
+// ListRecords returns all the record sets with the given name and type (one per set identifier)
+func (r *Route53Client) ListRecords(zoneID string, name string, recordType string) ([]Route53Record, error) {
+
+	retList := make([]Route53Record, 0)
+
+	input := &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(zoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String(recordType),
+	}
+
+	for {
+
+		reply, err := r.route53Svc.ListResourceRecordSets(input)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, recordSet := range reply.ResourceRecordSets {
+
+			// records are sorted by name and type so we can stop at the first mismatch
+			if aws.StringValue(recordSet.Name) != name || aws.StringValue(recordSet.Type) != recordType {
+				return retList, nil
+			}
+
+			retList = append(retList, fromResourceRecordSet(recordSet))
+		}
+
+		if !aws.BoolValue(reply.IsTruncated) {
+			break
+		}
+
+		input.StartRecordName = reply.NextRecordName
+		input.StartRecordType = reply.NextRecordType
+		input.StartRecordIdentifier = reply.NextRecordIdentifier
+	}
+
+	return retList, nil
+}
+
+// ChangeRecords upserts and deletes record sets in a single batch
+func (r *Route53Client) ChangeRecords(zoneID string, upsertList []Route53Record, deleteList []Route53Record) error {
+
+	changeList := make([]*route53.Change, 0)
+
+	for _, record := range deleteList {
+		changeList = append(changeList, &route53.Change{
+			Action:            aws.String(route53.ChangeActionDelete),
+			ResourceRecordSet: toResourceRecordSet(record),
+		})
+	}
+
+	for _, record := range upsertList {
+		changeList = append(changeList, &route53.Change{
+			Action:            aws.String(route53.ChangeActionUpsert),
+			ResourceRecordSet: toResourceRecordSet(record),
+		})
+	}
+
+	if len(changeList) == 0 {
+		return nil
+	}
+
+	_, err := r.route53Svc.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(zoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("ecs-ingress"),
+			Changes: changeList,
+		},
+	})
+
+	return err
+}
+
+// ListHealthChecks returns all the HTTP health checks in the account
+func (r *Route53Client) ListHealthChecks() ([]Route53HealthCheck, error) {
+
+	retList := make([]Route53HealthCheck, 0)
+
+	var marker *string = nil
+
+	for {
+
+		reply, err := r.route53Svc.ListHealthChecks(&route53.ListHealthChecksInput{
+			Marker: marker,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, healthCheck := range reply.HealthChecks {
+
+			healthCheckConfig := healthCheck.HealthCheckConfig
+
+			if healthCheckConfig == nil {
+				continue
+			}
+
+			retList = append(retList, Route53HealthCheck{
+				HealthCheckID:   aws.StringValue(healthCheck.Id),
+				CallerReference: aws.StringValue(healthCheck.CallerReference),
+				IPAddress:       aws.StringValue(healthCheckConfig.IPAddress),
+				Port:            aws.Int64Value(healthCheckConfig.Port),
+				Path:            aws.StringValue(healthCheckConfig.ResourcePath),
+			})
+		}
+
+		if !aws.BoolValue(reply.IsTruncated) {
+			break
+		}
+
+		marker = reply.NextMarker
+	}
+
+	return retList, nil
+}
+
+// CreateHealthCheck creates an HTTP health check against an IP address
+func (r *Route53Client) CreateHealthCheck(callerReference string, ipAddress string, port int64, path string) (string, error) {
+
+	reply, err := r.route53Svc.CreateHealthCheck(&route53.CreateHealthCheckInput{
+		CallerReference: aws.String(callerReference),
+		HealthCheckConfig: &route53.HealthCheckConfig{
+			Type:             aws.String(route53.HealthCheckTypeHttp),
+			IPAddress:        aws.String(ipAddress),
+			Port:             aws.Int64(port),
+			ResourcePath:     aws.String(path),
+			RequestInterval:  aws.Int64(30),
+			FailureThreshold: aws.Int64(3),
+		},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(reply.HealthCheck.Id), nil
+}
+
+// DeleteHealthCheck deletes a health check
+func (r *Route53Client) DeleteHealthCheck(healthCheckID string) error {
+
+	_, err := r.route53Svc.DeleteHealthCheck(&route53.DeleteHealthCheckInput{
+		HealthCheckId: aws.String(healthCheckID),
+	})
+
+	return err
+}
+
+func fromResourceRecordSet(recordSet *route53.ResourceRecordSet) Route53Record {
+
+	ret := Route53Record{
+		Name:          aws.StringValue(recordSet.Name),
+		Type:          aws.StringValue(recordSet.Type),
+		TTL:           aws.Int64Value(recordSet.TTL),
+		SetIdentifier: aws.StringValue(recordSet.SetIdentifier),
+		Weight:        aws.Int64Value(recordSet.Weight),
+		MultiValue:    aws.BoolValue(recordSet.MultiValueAnswer),
+		HealthCheckID: aws.StringValue(recordSet.HealthCheckId),
+		Values:        make([]string, 0),
+	}
+
+	for _, resourceRecord := range recordSet.ResourceRecords {
+		ret.Values = append(ret.Values, aws.StringValue(resourceRecord.Value))
+	}
+
+	return ret
+}
+
+func toResourceRecordSet(record Route53Record) *route53.ResourceRecordSet {
+
+	ret := &route53.ResourceRecordSet{
+		Name:            aws.String(record.Name),
+		Type:            aws.String(record.Type),
+		TTL:             aws.Int64(record.TTL),
+		ResourceRecords: make([]*route53.ResourceRecord, 0),
+	}
+
+	if record.SetIdentifier != "" {
+		ret.SetIdentifier = aws.String(record.SetIdentifier)
+
+		if record.MultiValue {
+			ret.MultiValueAnswer = aws.Bool(true)
+		} else {
+			ret.Weight = aws.Int64(record.Weight)
+		}
+	}
+
+	if record.HealthCheckID != "" {
+		ret.HealthCheckId = aws.String(record.HealthCheckID)
+	}
+
+	for _, value := range record.Values {
+		ret.ResourceRecords = append(ret.ResourceRecords, &route53.ResourceRecord{Value: aws.String(value)})
+	}
+
+	return ret
+}
@@ -1,33 +1,62 @@
 package util
 
 import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
 	"bitbucket.org/nnnco/rev-proxy/shared"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// S3Object a downloaded s3 object with its version information
+type S3Object struct {
+	Bytes        []byte
+	VersionID    string
+	ETag         string
+	LastModified time.Time
+}
+
+// S3API the s3 operations we rely on, so that they can be faked in tests
+type S3API interface {
+	DownloadFileInMemory(bucket string, key string) ([]byte, error)
+	DownloadObjectInMemory(bucket string, key string, versionID string) (*S3Object, error)
+	UploadFileFromMemory(bucket string, key string, data []byte) error
+	DeleteObject(bucket string, key string) error
+}
+
 // S3Client simplified client to access S3 resources on AWS
 type S3Client struct {
 	cfg          *shared.Config
-	session      *session.Session
+	s3Svc        s3iface.S3API
 	s3downloader *s3manager.Downloader
 }
 
-// NewS3Client Creates a new s3 client
-func NewS3Client(cfg *shared.Config) *S3Client {
+// NewS3Client Creates a new s3 client from a shared session
+func NewS3Client(cfg *shared.Config, mySession *session.Session) *S3Client {
 
-	mySession := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{Region: aws.String(cfg.AWS.Region)},
-	}))
+	s3Config := &aws.Config{S3ForcePathStyle: aws.Bool(cfg.AWS.S3ForcePathStyle)}
 
-	// Create a S3 clients from just a session
+	// e.g. a local minio
+	if cfg.AWS.S3Endpoint != "" {
+		s3Config.Endpoint = aws.String(cfg.AWS.S3Endpoint)
+	}
+
+	return NewS3ClientFromAPI(cfg, s3.New(mySession, s3Config))
+}
+
+// NewS3ClientFromAPI Creates a new s3 client on top of any S3 API implementation
+func NewS3ClientFromAPI(cfg *shared.Config, s3Svc s3iface.S3API) *S3Client {
 
 	ret := &S3Client{
 		cfg:          cfg,
-		session:      mySession,
-		s3downloader: s3manager.NewDownloader(mySession),
+		s3Svc:        s3Svc,
+		s3downloader: s3manager.NewDownloaderWithClient(s3Svc),
 	}
 
 	return ret
@@ -50,3 +79,71 @@ func (s *S3Client) DownloadFileInMemory(bucket string, key string) ([]byte, erro
 
 	return buf.Bytes(), nil
 }
+
+// DownloadObjectInMemory downloads a whole object along with its version metadata.
+// An empty versionID selects the latest version.
+func (s *S3Client) DownloadObjectInMemory(bucket string, key string, versionID string) (*S3Object, error) {
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	reply, err := s.s3Svc.GetObject(input)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer reply.Body.Close()
+
+	buf, err := ioutil.ReadAll(reply.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Object{
+		Bytes:        buf,
+		VersionID:    aws.StringValue(reply.VersionId),
+		ETag:         aws.StringValue(reply.ETag),
+		LastModified: aws.TimeValue(reply.LastModified),
+	}, nil
+}
+
+// UploadFileFromMemory writes a byte slice to s3
+func (s *S3Client) UploadFileFromMemory(bucket string, key string, data []byte) error {
+
+	_, err := s.s3Svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+
+	return err
+}
+
+// DeleteObject deletes an object, hiding all its versions
+func (s *S3Client) DeleteObject(bucket string, key string) error {
+
+	_, err := s.s3Svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
+
+// IsS3NotFound returns true when the error means the object does not exist
+func IsS3NotFound(err error) bool {
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound"
+	}
+
+	return false
+}
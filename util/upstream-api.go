@@ -0,0 +1,36 @@
+package util
+
+// UpstreamServer a server of an upstream, as pushed to a running nginx
+type UpstreamServer struct {
+	Address string
+	Port    int64
+	Server  string
+	Weight  int64
+	Backup  bool
+	Down    bool
+}
+
+// UpstreamAPI updates the servers of the upstreams of a running nginx, without a reload
+type UpstreamAPI interface {
+	UpdateUpstreams(upstreamMap map[string][]UpstreamServer) error
+}
+
+// OpenRestyClient pushes the upstreams to the ecs_ingress Lua module, which keeps them in a shared dict
+type OpenRestyClient struct {
+	url string
+}
+
+// NewOpenRestyClient Creates a new openresty client
+func NewOpenRestyClient(url string) *OpenRestyClient {
+
+	ret := &OpenRestyClient{
+		url: url,
+	}
+
+	return ret
+}
+
+// UpdateUpstreams replaces every upstream at once
+func (o *OpenRestyClient) UpdateUpstreams(upstreamMap map[string][]UpstreamServer) error {
+	return HTTPPostJSON(o.url, upstreamMap)
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"math"
+)
+
+// HAProxyMaxWeight the highest server weight HAProxy accepts
+const HAProxyMaxWeight = 256
+
+// upstreamWeight the weight of a pushed server. Weights start at 1 for nginx and HAProxy alike.
+func upstreamWeight(server UpstreamServer) int64 {
+
+	if server.Weight < 1 {
+		return 1
+	}
+
+	return server.Weight
+}
+
+// ScaleWeights brings the weights of an upstream within 1 and maxWeight, keeping their ratios as far as rounding
+// allows. Weights below 1 count as 1.
+func ScaleWeights(weightList []int64, maxWeight int64) []int64 {
+
+	highest := int64(1)
+
+	for _, weight := range weightList {
+		if weight > highest {
+			highest = weight
+		}
+	}
+
+	retList := make([]int64, len(weightList))
+
+	for index, weight := range weightList {
+
+		if weight < 1 {
+			weight = 1
+		}
+
+		if highest > maxWeight {
+			weight = int64(math.Round(float64(weight) * float64(maxWeight) / float64(highest)))
+		}
+
+		if weight < 1 {
+			weight = 1
+		}
+
+		retList[index] = weight
+	}
+
+	return retList
+}
+
+// haproxyServers returns the servers with their weights scaled within what HAProxy accepts
+func haproxyServers(serverList []UpstreamServer) []UpstreamServer {
+
+	weightList := make([]int64, len(serverList))
+
+	for index, server := range serverList {
+		weightList[index] = server.Weight
+	}
+
+	retList := make([]UpstreamServer, len(serverList))
+
+	for index, weight := range ScaleWeights(weightList, HAProxyMaxWeight) {
+		retList[index] = serverList[index]
+		retList[index].Weight = weight
+	}
+
+	return retList
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScaleWeights(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		weights  []int64
+		expected []int64
+	}{
+		{
+			name:     "within range",
+			weights:  []int64{0, 2, 256},
+			expected: []int64{1, 2, 256},
+		},
+		{
+			name:     "group weights",
+			weights:  []int64{3000, 3000, 3000, 1000},
+			expected: []int64{256, 256, 256, 85},
+		},
+		{
+			name:     "never below 1",
+			weights:  []int64{100000, 1},
+			expected: []int64{256, 1},
+		},
+	}
+
+	for _, test := range tests {
+
+		if weights := ScaleWeights(test.weights, HAProxyMaxWeight); !reflect.DeepEqual(weights, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, weights)
+		}
+	}
+}